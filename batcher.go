@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// batcher is used by sinks that send the data of many batches in one request (e.g. Prometheus remote write): it
+// collects items from concurrent publishers and flushes them together, once maxItems are pending or flushInterval
+// has passed since the first pending item. A flush sends requests of at most maxItems. Every publisher learns the
+// result of the requests that carried its items: enqueue reports it to a callback, add waits for it.
+//
+// Flushes never run concurrently, and the items are flushed in the order they were added. A request that fails and
+// may be retried (see retryWait) stays at the front of the pending items and is retried after the backoff; in the
+// meantime, nothing is flushed and nothing waits for a lock. Once maxPending items are pending, enqueue waits for a
+// flush to make room, so that a backend that is down does not make the pending items grow without bounds.
+type batcher[T any] struct {
+	maxItems      int
+	maxPending    int
+	flushInterval time.Duration
+	// flush sends one request; on failure, the duration tells whether and when it may be retried (see postOnce)
+	flush func(items []T) (time.Duration, error)
+	// retryWait decides whether a failed request is retried, and after which backoff (see httpPoster.retryWait)
+	retryWait func(attempt int, wait time.Duration) (time.Duration, bool)
+
+	mu      sync.Mutex
+	pending []T
+	waiters []*batchWaiter
+	timer   *time.Timer
+	// room is signalled when pending items have been flushed, or the batcher is closed
+	room *sync.Cond
+	// failures is the number of failed attempts to send the items at the front; backingOff is set while the retry
+	// waits for its timer
+	failures   int
+	backingOff bool
+	closed     bool
+
+	flushMu sync.Mutex
+}
+
+// batchWaiter is a publisher waiting for the flush of its items, which are the next ones in pending after those of
+// the waiters before it
+type batchWaiter struct {
+	items int
+	done  func(error)
+	// err is the first error of the requests that contained some of the items
+	err error
+}
+
+// batcherPendingRequests is how many requests of maxItems may be pending before enqueue waits
+const batcherPendingRequests = 10
+
+func newBatcher[T any](maxItems int, flushInterval time.Duration, flush func(items []T) (time.Duration, error),
+	retryWait func(attempt int, wait time.Duration) (time.Duration, bool)) *batcher[T] {
+	maxItems = max(maxItems, 1)
+	b := &batcher[T]{maxItems: maxItems, maxPending: batcherPendingRequests * maxItems, flushInterval: flushInterval,
+		flush: flush, retryWait: retryWait}
+	b.room = sync.NewCond(&b.mu)
+	return b
+}
+
+var errBatcherClosed = errors.New("sink is closed")
+
+// add queues the items for the next flush and waits for its result
+func (b *batcher[T]) add(items ...T) error {
+	result := make(chan error, 1)
+	if err := b.enqueue(func(err error) { result <- err }, items...); err != nil {
+		return err
+	}
+	return <-result
+}
+
+// enqueue queues the items for the next flush and returns without waiting for it; done is called with the result of
+// the flush, unless enqueue fails. done must not call the batcher.
+func (b *batcher[T]) enqueue(done func(error), items ...T) error {
+	if len(items) == 0 {
+		done(nil)
+		return nil
+	}
+	waiter := &batchWaiter{items: len(items), done: done}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && len(b.pending) >= b.maxPending {
+		b.room.Wait()
+	}
+	if b.closed {
+		return errBatcherClosed
+	}
+	b.pending = append(b.pending, items...)
+	b.waiters = append(b.waiters, waiter)
+	switch {
+	case b.backingOff:
+		// a retry waiting for its backoff is not overtaken
+	case len(b.pending) >= b.maxItems:
+		b.flushSoon()
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.flushInterval, b.flushPending)
+	}
+	return nil
+}
+
+// flushNow flushes what is pending without waiting for the flush interval or the backoff of a retry, and returns the
+// result; it returns right away if nothing is pending
+func (b *batcher[T]) flushNow() error {
+	b.mu.Lock()
+	if len(b.waiters) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	result := make(chan error, 1)
+	b.waiters = append(b.waiters, &batchWaiter{done: func(err error) { result <- err }})
+	// without a timer, the flush has already been started
+	if b.timer != nil {
+		b.flushSoon()
+	}
+	b.mu.Unlock()
+	return <-result
+}
+
+// flushSoon starts a flush right away, unless the timer has already fired and its flush is about to start. b.mu must
+// be held.
+func (b *batcher[T]) flushSoon() {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(0, b.flushPending)
+	} else if b.timer.Stop() {
+		b.timer.Reset(0)
+	}
+}
+
+// flushPending flushes the items that are pending when it starts, in requests of at most maxItems, and reports the
+// results to the waiting publishers. A request that is to be retried ends the flush; the retry flushes the rest.
+func (b *batcher[T]) flushPending() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.backingOff = false
+	remaining := len(b.pending)
+	b.mu.Unlock()
+
+	for {
+		b.mu.Lock()
+		n := min(remaining, b.maxItems)
+		request := b.pending[:n:n]
+		b.mu.Unlock()
+
+		var err error
+		if n > 0 {
+			var wait time.Duration
+			if wait, err = b.flush(request); err != nil {
+				b.mu.Lock()
+				if wait, retry := b.retryWait(b.failures, wait); retry && !b.closed {
+					b.failures++
+					b.backingOff = true
+					b.timer = time.AfterFunc(wait, b.flushPending)
+					b.mu.Unlock()
+					return
+				}
+				b.mu.Unlock()
+			}
+		}
+
+		b.mu.Lock()
+		b.failures = 0
+		b.pending = b.pending[n:]
+		remaining -= n
+		completed := b.completeWaiters(n, err)
+		b.room.Broadcast()
+		b.mu.Unlock()
+		for _, waiter := range completed {
+			waiter.done(waiter.err)
+		}
+		if remaining == 0 {
+			return
+		}
+	}
+}
+
+// completeWaiters records the result of a request with the first n pending items and returns the waiters whose items
+// are all flushed; a waiter with items beyond the request keeps waiting for the rest. b.mu must be held.
+func (b *batcher[T]) completeWaiters(n int, err error) []*batchWaiter {
+	var completed []*batchWaiter
+	for len(b.waiters) > 0 {
+		waiter := b.waiters[0]
+		if waiter.err == nil {
+			waiter.err = err
+		}
+		if waiter.items > n {
+			waiter.items -= n
+			break
+		}
+		n -= waiter.items
+		completed = append(completed, waiter)
+		b.waiters = b.waiters[1:]
+	}
+	return completed
+}
+
+func (b *batcher[T]) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// close flushes what is pending, without retries; afterwards, enqueue fails
+func (b *batcher[T]) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.room.Broadcast()
+	b.mu.Unlock()
+	b.flushPending()
+}
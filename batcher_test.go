@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFlusher records the requests of a batcher and fails the first ones
+type testFlusher struct {
+	mu       sync.Mutex
+	requests [][]int
+	failures int
+	wait     time.Duration
+}
+
+func (f *testFlusher) flush(items []int) (time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, append([]int(nil), items...))
+	if f.failures > 0 {
+		f.failures--
+		return f.wait, errors.New("write failed")
+	}
+	return 0, nil
+}
+
+func (f *testFlusher) sent() [][]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func retryTwice(attempt int, wait time.Duration) (time.Duration, bool) {
+	if wait < 0 || attempt >= 2 {
+		return 0, false
+	}
+	return 50 * time.Millisecond, true
+}
+
+func TestBatcherSplitsRequests(t *testing.T) {
+	f := &testFlusher{}
+	b := newBatcher(3, time.Hour, f.flush, retryTwice)
+	assert.NoError(t, b.add(1, 2, 3, 4, 5, 6, 7))
+	assert.Equal(t, [][]int{{1, 2, 3}, {4, 5, 6}, {7}}, f.sent())
+}
+
+func TestBatcherReportsFailedRequest(t *testing.T) {
+	f := &testFlusher{failures: 1, wait: -1}
+	b := newBatcher(2, time.Hour, f.flush, retryTwice)
+	// the items are split across both requests, the first one fails without retry
+	assert.EqualError(t, b.add(1, 2, 3), "write failed")
+	assert.Equal(t, [][]int{{1, 2}, {3}}, f.sent())
+}
+
+func TestBatcherRetriesWithoutBlocking(t *testing.T) {
+	f := &testFlusher{failures: 2}
+	b := newBatcher(2, time.Hour, f.flush, retryTwice)
+
+	first := make(chan error)
+	go func() { first <- b.add(1, 2) }()
+	assert.Eventually(t, func() bool { return len(f.sent()) == 1 }, time.Second, time.Millisecond)
+
+	// while the first request waits for its retry, a full add neither blocks nor overtakes it
+	second := make(chan error)
+	go func() { second <- b.add(3, 4) }()
+	assert.NoError(t, <-first)
+	assert.NoError(t, <-second)
+	assert.Equal(t, [][]int{{1, 2}, {1, 2}, {1, 2}, {3, 4}}, f.sent())
+}
+
+func TestBatcherFlushNowSkipsBackoff(t *testing.T) {
+	f := &testFlusher{failures: 1, wait: time.Hour}
+	b := newBatcher(2, time.Hour, f.flush, func(attempt int, wait time.Duration) (time.Duration, bool) {
+		return wait, attempt < 1
+	})
+
+	done := make(chan error)
+	go func() { done <- b.add(1, 2) }()
+	assert.Eventually(t, func() bool { return len(f.sent()) == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, b.flushNow())
+	assert.NoError(t, <-done)
+	assert.Equal(t, [][]int{{1, 2}, {1, 2}}, f.sent())
+}
+
+func TestBatcherClose(t *testing.T) {
+	f := &testFlusher{}
+	b := newBatcher(10, time.Hour, f.flush, retryTwice)
+	done := make(chan error)
+	go func() { done <- b.add(1) }()
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.pending) == 1
+	}, time.Second, time.Millisecond)
+	b.close()
+	assert.NoError(t, <-done)
+	assert.Equal(t, [][]int{{1}}, f.sent())
+	assert.Equal(t, errBatcherClosed, b.add(2))
+}
+
+func TestBatcherEnqueueDoesNotWaitForFlush(t *testing.T) {
+	f := &testFlusher{}
+	b := newBatcher(10, time.Hour, f.flush, retryTwice)
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.enqueue(func(err error) { results <- err }, i))
+	}
+	assert.Empty(t, f.sent())
+	require.NoError(t, b.flushNow())
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-results)
+	}
+	assert.Equal(t, [][]int{{0, 1, 2}}, f.sent())
+}
+
+func TestBatcherEnqueueWaitsForRoom(t *testing.T) {
+	f := &testFlusher{}
+	b := newBatcher(1, time.Hour, f.flush, retryTwice)
+	b.maxPending = 2
+	// the flush of the first item blocks on flushMu, so the pending items cannot be sent
+	b.flushMu.Lock()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.enqueue(func(error) {}, i))
+	}
+	enqueued := make(chan error)
+	go func() { enqueued <- b.enqueue(func(error) {}, 2) }()
+	select {
+	case <-enqueued:
+		t.Fatal("enqueue did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.flushMu.Unlock()
+	assert.NoError(t, <-enqueued)
+	b.close()
+	assert.Equal(t, [][]int{{0}, {1}, {2}}, f.sent())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// overflowValue replaces the values of tags beyond the cardinality limit with the overflow action
+const overflowValue = "__overflow__"
+
+// cardinalityConfig is the cardinality guard of the configuration file
+type cardinalityConfig struct {
+	// Limits is the maximum number of distinct values per host and service, by tag name (e.g. label: 100)
+	Limits map[string]int `yaml:"limits"`
+	// Action for values beyond the limit: overflow (default) replaces them with __overflow__, hash with one of
+	// Buckets values (__hash_0, __hash_1, ...) and drop drops the line
+	Action  string `yaml:"action"`
+	Buckets int    `yaml:"buckets"`
+	// Reset forgets the seen values after this interval, so values that are no longer used free up the limit; 0 never
+	// forgets them
+	Reset time.Duration `yaml:"reset"`
+}
+
+// cardinalityKey identifies the values of a tag of a host and service
+type cardinalityKey struct {
+	host, service, tag string
+}
+
+// cardinalityOffender is a tag of a host and service that exceeds its limit
+type cardinalityOffender struct {
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Tag     string `json:"tag"`
+	// Lines is the number of lines whose value was beyond the limit
+	Lines uint64 `json:"lines"`
+}
+
+func (o cardinalityOffender) String() string {
+	return fmt.Sprintf("tag %v of %v/%v exceeds the cardinality limit: %d lines", o.Tag, o.Host, o.Service, o.Lines)
+}
+
+// cardinalityGuard keeps unbounded tag values (e.g. labels containing PIDs or session IDs) from exploding the number
+// of series downstream: it tracks the distinct values of the limited tags per host and service, and applies the action
+// to values beyond the limit. The values seen first are kept.
+type cardinalityGuard struct {
+	limits  map[string]int
+	action  string
+	buckets uint32
+	reset   time.Duration
+
+	mu        sync.Mutex
+	seen      map[cardinalityKey]map[string]bool
+	since     time.Time
+	offenders map[cardinalityKey]uint64
+}
+
+func newCardinalityGuard(config cardinalityConfig) (*cardinalityGuard, error) {
+	g := &cardinalityGuard{
+		limits:    config.Limits,
+		action:    config.Action,
+		buckets:   10,
+		reset:     config.Reset,
+		seen:      map[cardinalityKey]map[string]bool{},
+		since:     time.Now(),
+		offenders: map[cardinalityKey]uint64{},
+	}
+	if g.action == "" {
+		g.action = "overflow"
+	}
+	if g.action != "overflow" && g.action != "hash" && g.action != "drop" {
+		return nil, fmt.Errorf("unknown cardinality action %q", g.action)
+	}
+	if config.Buckets > 0 {
+		g.buckets = uint32(config.Buckets)
+	}
+	for tag, limit := range g.limits {
+		if limit <= 0 {
+			return nil, fmt.Errorf("cardinality limit of tag %v must be positive", tag)
+		}
+	}
+	return g, nil
+}
+
+// guard applies the limits to the tags of the line; it returns false if the line is dropped
+func (g *cardinalityGuard) guard(m protocol.Metric) (protocol.Metric, bool) {
+	host, service := tagValue(m, "host"), tagValue(m, "service")
+	var tags []*protocol.Tag
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reset > 0 && time.Since(g.since) > g.reset {
+		g.seen = map[cardinalityKey]map[string]bool{}
+		g.since = time.Now()
+	}
+	for i, tag := range m.TagList() {
+		limit, ok := g.limits[tag.Key]
+		if !ok || g.allow(cardinalityKey{host: host, service: service, tag: tag.Key}, tag.Value, limit) {
+			continue
+		}
+		if g.action == "drop" {
+			return nil, false
+		}
+		if tags == nil {
+			tags = append([]*protocol.Tag(nil), m.TagList()...)
+		}
+		value := overflowValue
+		if g.action == "hash" {
+			h := fnv.New32a()
+			h.Write([]byte(tag.Value))
+			value = fmt.Sprintf("__hash_%d", h.Sum32()%g.buckets)
+		}
+		tags[i] = &protocol.Tag{Key: tag.Key, Value: value}
+	}
+	if tags == nil {
+		return m, true
+	}
+	return Metric{name: m.Name(), tags: tags, fields: m.FieldList(), timestamp: m.Time()}, true
+}
+
+// allow records the value and reports whether it is within the limit; g.mu must be held
+func (g *cardinalityGuard) allow(key cardinalityKey, value string, limit int) bool {
+	values := g.seen[key]
+	if values[value] {
+		return true
+	}
+	if len(values) < limit {
+		if values == nil {
+			values = map[string]bool{}
+			g.seen[key] = values
+		}
+		values[value] = true
+		return true
+	}
+	g.offenders[key]++
+	if count := g.offenders[key]; count == 1 || count%1000 == 0 {
+		logger.Warn("Tag exceeds its cardinality limit", "host", key.host, "service", key.service, "tag", key.tag,
+			"value", value, "limit", limit, "lines", count)
+	}
+	return false
+}
+
+// apply guards the lines of the batch; it returns nil if all lines were dropped
+func (g *cardinalityGuard) apply(batch *Batch) (*Batch, error) {
+	if len(g.limits) == 0 {
+		return batch, nil
+	}
+	return rewriteBatch(batch, g.guard)
+}
+
+// Offenders returns the tags that exceeded their limit, the ones with the most lines first
+func (g *cardinalityGuard) Offenders() []cardinalityOffender {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	offenders := make([]cardinalityOffender, 0, len(g.offenders))
+	for key, lines := range g.offenders {
+		offenders = append(offenders, cardinalityOffender{Host: key.host, Service: key.service, Tag: key.tag, Lines: lines})
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Lines != offenders[j].Lines {
+			return offenders[i].Lines > offenders[j].Lines
+		}
+		return offenders[i].String() < offenders[j].String()
+	})
+	return offenders
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// guardedLabels passes one line per label through the guard and returns the resulting labels
+func guardedLabels(t *testing.T, g *cardinalityGuard, host string, labels ...string) []string {
+	var data strings.Builder
+	for _, label := range labels {
+		fmt.Fprintf(&data, "metric,host=%v,label=%v,service=procs value=1 1\n", host, label)
+	}
+	batch, err := g.apply(&Batch{Data: []byte(data.String())})
+	require.Nil(t, err)
+	if batch == nil {
+		return nil
+	}
+	metrics, err := batch.Metrics()
+	require.Nil(t, err)
+	var result []string
+	for _, m := range metrics {
+		result = append(result, tagValue(m, "label"))
+	}
+	return result
+}
+
+func TestCardinalityGuardActions(t *testing.T) {
+	g, err := newCardinalityGuard(cardinalityConfig{Limits: map[string]int{"label": 2}})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", overflowValue, "a", overflowValue}, guardedLabels(t, g, "web1", "a", "b", "c", "a", "d"))
+	// the limit applies per host and service
+	assert.Equal(t, []string{"c", "d"}, guardedLabels(t, g, "web2", "c", "d"))
+	assert.Equal(t, []cardinalityOffender{{Host: "web1", Service: "procs", Tag: "label", Lines: 2}}, g.Offenders())
+
+	g, err = newCardinalityGuard(cardinalityConfig{Limits: map[string]int{"label": 1}, Action: "drop"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "a"}, guardedLabels(t, g, "web1", "a", "b", "a"))
+	assert.Nil(t, guardedLabels(t, g, "web1", "c"))
+
+	g, err = newCardinalityGuard(cardinalityConfig{Limits: map[string]int{"label": 1}, Action: "hash", Buckets: 4})
+	require.Nil(t, err)
+	labels := guardedLabels(t, g, "web1", "a", "session_8f3a", "session_8f3a", "session_1b2c")
+	assert.Equal(t, "a", labels[0])
+	assert.Equal(t, labels[1], labels[2])
+	for _, label := range labels[1:] {
+		assert.Regexp(t, `^__hash_[0-3]$`, label)
+	}
+}
+
+func TestCardinalityGuardReset(t *testing.T) {
+	g, err := newCardinalityGuard(cardinalityConfig{Limits: map[string]int{"label": 1}, Reset: 20 * time.Millisecond})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", overflowValue}, guardedLabels(t, g, "web1", "a", "b"))
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, []string{"b", overflowValue}, guardedLabels(t, g, "web1", "b", "a"))
+}
+
+func TestCardinalityGuardWithoutLimitsKeepsBatch(t *testing.T) {
+	g, err := newCardinalityGuard(cardinalityConfig{})
+	require.Nil(t, err)
+	batch := testBatch("web1", "ping")
+	guarded, err := g.apply(batch)
+	require.Nil(t, err)
+	assert.Same(t, batch, guarded)
+}
+
+func TestCardinalityGuardInvalidConfiguration(t *testing.T) {
+	_, err := newCardinalityGuard(cardinalityConfig{Action: "truncate"})
+	assert.NotNil(t, err)
+	_, err = newCardinalityGuard(cardinalityConfig{Limits: map[string]int{"label": 0}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the content of the daemon's configuration file (-c), e.g.:
+//
+//	tags:
+//	  site: vienna
+//	lookup:
+//	  path: /etc/ocxp-sender/hosts.csv
+//	relabel:
+//	  - source_labels: [host]
+//	    target_label: host
+//	    action: lowercase
+//	sinks:
+//	  - amqp://localhost:5672?alias=rabbitmq
+//	  - influxdb://localhost:8086?org=o&bucket=naemon&alias=tsdb
+//	cardinality:
+//	  limits: {label: 100}
+//	self_monitoring:
+//	  interval: 1m
+//	routes:
+//	  - match: {measurement: state}
+//	    sinks: [rabbitmq]
+//	    routing_key: alerts
+//	  - match: {measurement: metric}
+//	    sinks: [tsdb]
+type config struct {
+	// Sinks are the URLs of the sinks, as passed with -u; if set, they replace the sinks given on the command line
+	Sinks []string `yaml:"sinks"`
+	// Tags are added to every line, unless it already has a tag of the same name
+	Tags           map[string]string    `yaml:"tags"`
+	Lookup         lookupConfig         `yaml:"lookup"`
+	Relabel        []relabelConfig      `yaml:"relabel"`
+	Cardinality    cardinalityConfig    `yaml:"cardinality"`
+	Routes         []routeConfig        `yaml:"routes"`
+	SelfMonitoring selfMonitoringConfig `yaml:"self_monitoring"`
+}
+
+// loadConfig reads and validates a configuration file; unknown keys are rejected, as they are most likely typos
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && len(bytes.TrimSpace(b)) > 0 {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return c, nil
+}
+
+// sinkURLs returns the sinks of the configuration, or the ones from the command line if it has none
+func (c *config) sinkURLs(commandLine []string) []string {
+	if len(c.Sinks) > 0 {
+		return c.Sinks
+	}
+	return commandLine
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+const ControlAddress = "127.0.0.1:55551"
+
+// controlCommands are the subcommands that talk to the running daemon over its control channel
+var controlCommands = []string{"status", "stop", "flush", "reload"}
+
+// The control channel is a local TCP port of the daemon. A client sends one command per connection as a line
+// ("status", "stop", "flush <timeout>" or "reload") and receives a controlResponse as JSON.
+type controlResponse struct {
+	// Error is set if the command failed
+	Error   string        `json:"error,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Status  *daemonStatus `json:"status,omitempty"`
+	// PID of the daemon, set in the answer to stop
+	PID int `json:"pid,omitempty"`
+}
+
+// daemonStatus is the answer to the status command
+type daemonStatus struct {
+	PID           int                   `json:"pid"`
+	UptimeSeconds float64               `json:"uptime_seconds"`
+	Counters      map[string]float64    `json:"counters"`
+	Sinks         []sinkStatus          `json:"sinks"`
+	Offenders     []cardinalityOffender `json:"cardinality_offenders,omitempty"`
+}
+
+func newDaemonStatus(sink *fanOut) *daemonStatus {
+	status := &daemonStatus{
+		PID:           os.Getpid(),
+		UptimeSeconds: time.Since(stats.started).Seconds(),
+		Counters:      map[string]float64{},
+		Sinks:         sink.Status(),
+		Offenders:     sink.Offenders(),
+	}
+	for _, m := range daemonMetrics(status.Offenders, sink.spoolDepth()) {
+		if m.sink == "" && m.kind == "counter" {
+			status.Counters[m.name] = m.value
+		}
+	}
+	return status
+}
+
+func (s *daemonStatus) print() {
+	fmt.Printf("Daemon running for %v (pid %d)\n", (time.Duration(s.UptimeSeconds) * time.Second).String(), s.PID)
+	names := make([]string, 0, len(s.Counters))
+	for name := range s.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%v: %v\n", name, s.Counters[name])
+	}
+	fmt.Println("Sinks:")
+	for _, sink := range s.Sinks {
+		fmt.Printf("  %v\n", sink)
+	}
+	if len(s.Offenders) > 0 {
+		fmt.Println("Cardinality limits exceeded:")
+		for _, offender := range s.Offenders {
+			fmt.Printf("  %v\n", offender)
+		}
+	}
+}
+
+// controlRequest is a command received over the control channel; the daemon answers it on reply
+type controlRequest struct {
+	command string
+	args    []string
+	reply   chan controlResponse
+}
+
+// controlServer accepts the connections of the control channel and passes the commands on to the daemon
+type controlServer struct {
+	listener net.Listener
+	requests chan controlRequest
+	closed   chan struct{}
+	handlers sync.WaitGroup
+}
+
+func startControlServer(address string) (*controlServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &controlServer{listener: listener, requests: make(chan controlRequest), closed: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.handlers.Add(1)
+			go s.handle(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *controlServer) handle(conn net.Conn) {
+	defer s.handlers.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	request := controlRequest{command: fields[0], args: fields[1:], reply: make(chan controlResponse, 1)}
+	select {
+	case s.requests <- request:
+	case <-s.closed:
+		return
+	}
+	var response controlResponse
+	select {
+	case response = <-request.reply:
+	case <-s.closed:
+		// the daemon may have answered right before it stopped (e.g. stop)
+		select {
+		case response = <-request.reply:
+		default:
+			return
+		}
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+func (s *controlServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting commands and waits until the answers of the accepted ones are sent
+func (s *controlServer) Close() error {
+	close(s.closed)
+	err := s.listener.Close()
+	s.handlers.Wait()
+	return err
+}
+
+// sendControlCommand sends a command to the daemon and returns its response
+func sendControlCommand(address string, timeout time.Duration, command ...string) (*controlResponse, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("daemon is not running: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintln(conn, strings.Join(command, " ")); err != nil {
+		return nil, err
+	}
+	response := &controlResponse{}
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, fmt.Errorf("invalid response of the daemon: %w", err)
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// controlCommand implements "ocxp-sender status|stop|flush|reload"
+func controlCommand(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	address := flags.String("control", ControlAddress, "address of the control channel of the daemon")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for the daemon to finish the command")
+	asJSON := flags.Bool("json", false, "print the status as JSON (status)")
+	flags.SetNormalizeFunc(normalizeFlagName)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %v [flags]\n\n", os.Args[0], command)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *timeout < 0 {
+		fail("Invalid --timeout: must not be negative")
+	}
+
+	request := []string{command}
+	if command == "flush" {
+		request = append(request, timeout.String())
+	}
+	response, err := sendControlCommand(*address, *timeout+5*time.Second, request...)
+	failOnError(err, "Command "+command+" failed")
+
+	switch {
+	case command == "status" && *asJSON:
+		b, err := json.MarshalIndent(response.Status, "", "  ")
+		failOnError(err, "Failed to encode status")
+		fmt.Println(string(b))
+	case command == "status":
+		response.Status.print()
+	case command == "stop":
+		fmt.Println(response.Message)
+		// the daemon has stopped once its process is gone
+		deadline := time.Now().Add(*timeout)
+		for {
+			if err := syscall.Kill(response.PID, 0); errors.Is(err, syscall.ESRCH) {
+				fmt.Println("Daemon stopped")
+				return
+			}
+			if time.Now().After(deadline) {
+				fail("Daemon did not stop within " + timeout.String())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	default:
+		fmt.Println(response.Message)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlChannel(t *testing.T) {
+	f, err := newFanOut([]string{"test://controlled?alias=controlled"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+	control, err := startControlServer("127.0.0.1:0")
+	require.Nil(t, err)
+	defer control.Close()
+
+	// the daemon's main loop
+	reloadErr := errors.New("invalid configuration")
+	go func() {
+		for request := range control.requests {
+			handleControlRequest(request, f, func() error { return reloadErr })
+		}
+	}()
+
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	require.Nil(t, f.Flush(time.Second))
+	response, err := sendControlCommand(control.Addr(), time.Second, "status")
+	require.Nil(t, err)
+	require.NotNil(t, response.Status)
+	require.Len(t, response.Status.Sinks, 1)
+	assert.Equal(t, "controlled", response.Status.Sinks[0].Alias)
+	assert.Equal(t, uint64(1), response.Status.Sinks[0].Delivered)
+	assert.Contains(t, response.Status.Counters, "connections_accepted")
+
+	response, err = sendControlCommand(control.Addr(), time.Second, "flush", "1s")
+	require.Nil(t, err)
+	assert.Equal(t, "Flushed all sinks", response.Message)
+	_, err = sendControlCommand(control.Addr(), time.Second, "flush", "abc")
+	assert.ErrorContains(t, err, `invalid flush timeout "abc"`)
+	_, err = sendControlCommand(control.Addr(), time.Second, "flush", "-1s")
+	assert.EqualError(t, err, `invalid flush timeout "-1s": must not be negative`)
+
+	_, err = sendControlCommand(control.Addr(), time.Second, "reload")
+	assert.EqualError(t, err, "failed to reload configuration, keeping the current one: invalid configuration")
+	reloadErr = nil
+	response, err = sendControlCommand(control.Addr(), time.Second, "reload")
+	require.Nil(t, err)
+	assert.Equal(t, "Reloaded configuration", response.Message)
+
+	_, err = sendControlCommand(control.Addr(), time.Second, "restart")
+	assert.EqualError(t, err, `unknown command "restart"`)
+}
+
+func TestControlChannelWithoutDaemon(t *testing.T) {
+	control, err := startControlServer("127.0.0.1:0")
+	require.Nil(t, err)
+	address := control.Addr()
+	control.Close()
+	_, err = sendControlCommand(address, time.Second, "status")
+	assert.ErrorContains(t, err, "daemon is not running")
+}
+
+func TestFanOutFlush(t *testing.T) {
+	f, err := newFanOut([]string{"test://flushed?queue_backoff=1h"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+	sink := controlledSinkFor("flushed")
+	sink.set(func(s *controlledSink) { s.failures = 1 })
+
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	// the retry would only happen after an hour
+	require.Nil(t, f.Flush(time.Second))
+	assert.Equal(t, 1, sink.count())
+
+	blocked := make(chan struct{})
+	sink.set(func(s *controlledSink) { s.blocked = blocked })
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	assert.ErrorContains(t, f.Flush(20*time.Millisecond), "still pending")
+	close(blocked)
+	require.Nil(t, f.Flush(time.Second))
+}
+
+func TestFanOutFlushDoesNotCheckHealth(t *testing.T) {
+	f, err := newFanOut([]string{"test://flushed-health"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+	sink := controlledSinkFor("flushed-health")
+	checks := func() int {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return sink.healthChecks
+	}
+	assert.Eventually(t, func() bool { return checks() == 1 }, time.Second, time.Millisecond)
+
+	// the flush polls the queue, but uses the health from the background check
+	blocked := make(chan struct{})
+	sink.set(func(s *controlledSink) { s.blocked = blocked })
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	assert.ErrorContains(t, f.Flush(50*time.Millisecond), "still pending")
+	assert.Equal(t, 1, checks())
+	close(blocked)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// lookupConfig is the lookup file of the configuration file, which provides additional tags per host and service
+type lookupConfig struct {
+	// Path of a CSV file (with a header line) or, if it ends in .json, a JSON file with an array of objects. The
+	// columns/keys host and (optionally) service select the lines, the others are the tags added to them.
+	Path string `yaml:"path"`
+	// Interval in which the file is checked for changes (default 30s)
+	Interval time.Duration `yaml:"interval"`
+}
+
+// lookupKey selects the entries of the lookup table; an empty service applies to all services of the host
+type lookupKey struct {
+	host, service string
+}
+
+// lookupTable is the content of a lookup file
+type lookupTable map[lookupKey][]*protocol.Tag
+
+// enricher adds tags to every line of the batches: the tags of the lookup file entry of the line's host and service,
+// the tags of its host, and the static tags. Tags a line already has are not overwritten, and among the added tags the
+// more specific ones win.
+type enricher struct {
+	static []*protocol.Tag
+	lookup atomic.Pointer[lookupTable]
+
+	path     string
+	modTime  time.Time
+	size     int64
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// newEnricher loads the lookup file, if there is one, and starts watching it for changes
+func newEnricher(tags map[string]string, lookup lookupConfig) (*enricher, error) {
+	e := &enricher{static: sortedTags(tags), path: lookup.Path}
+	if e.path == "" {
+		return e, nil
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	interval := lookup.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	e.stop, e.done = make(chan struct{}), make(chan struct{})
+	go e.watch(interval)
+	return e, nil
+}
+
+func sortedTags(tags map[string]string) []*protocol.Tag {
+	list := make([]*protocol.Tag, 0, len(tags))
+	for key, value := range tags {
+		if value != "" {
+			list = append(list, &protocol.Tag{Key: key, Value: value})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// load reads the lookup file if it has changed since it was last read
+func (e *enricher) load() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(e.modTime) && info.Size() == e.size {
+		return nil
+	}
+	table, err := readLookupFile(e.path)
+	if err != nil {
+		return err
+	}
+	e.lookup.Store(&table)
+	e.modTime, e.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// watch reloads the lookup file whenever it changes; if it cannot be read, the current table stays in place
+func (e *enricher) watch(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			modTime := e.modTime
+			if err := e.load(); err != nil {
+				logger.Warn("Failed to reload lookup file, keeping the current entries", "path", e.path, "error", err)
+			} else if !e.modTime.Equal(modTime) {
+				logger.Info("Reloaded lookup file", "path", e.path)
+			}
+		}
+	}
+}
+
+// close stops watching the lookup file
+func (e *enricher) close() {
+	if e.stop == nil {
+		return
+	}
+	e.stopOnce.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+func readLookupFile(path string) (lookupTable, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]string
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(b, &rows); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+	} else {
+		records, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		for i, record := range records {
+			if i == 0 {
+				continue
+			}
+			row := map[string]string{}
+			for j, column := range records[0] {
+				row[strings.TrimSpace(column)] = strings.TrimSpace(record[j])
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	table := lookupTable{}
+	for i, row := range rows {
+		key := lookupKey{host: row["host"], service: row["service"]}
+		if key.host == "" {
+			return nil, fmt.Errorf("%v: entry %d has no host", path, i+1)
+		}
+		delete(row, "host")
+		delete(row, "service")
+		table[key] = sortedTags(row)
+	}
+	return table, nil
+}
+
+// enrich adds the tags to the line
+func (e *enricher) enrich(m protocol.Metric) (protocol.Metric, bool) {
+	tags := append([]*protocol.Tag(nil), m.TagList()...)
+	has := func(key string) bool {
+		for _, tag := range tags {
+			if tag.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+	add := func(list []*protocol.Tag) {
+		for _, tag := range list {
+			if !has(tag.Key) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if table := e.lookup.Load(); table != nil {
+		host, service := tagValue(m, "host"), tagValue(m, "service")
+		if service != "" {
+			add((*table)[lookupKey{host: host, service: service}])
+		}
+		add((*table)[lookupKey{host: host}])
+	}
+	add(e.static)
+	return Metric{name: m.Name(), tags: tags, fields: m.FieldList(), timestamp: m.Time()}, true
+}
+
+// apply enriches the lines of the batch
+func (e *enricher) apply(batch *Batch) (*Batch, error) {
+	if len(e.static) == 0 && e.path == "" {
+		return batch, nil
+	}
+	return rewriteBatch(batch, e.enrich)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func enrichedData(t *testing.T, e *enricher, data string) string {
+	batch, err := e.apply(&Batch{Data: []byte(data)})
+	require.Nil(t, err)
+	return string(batch.Data)
+}
+
+func TestEnricherStaticTags(t *testing.T) {
+	e, err := newEnricher(map[string]string{"site": "vienna", "instance": "naemon01", "service": "other"}, lookupConfig{})
+	require.Nil(t, err)
+	assert.Equal(t, "state,host=web1,service=ping,instance=naemon01,site=vienna value=0i 1\n",
+		enrichedData(t, e, "state,host=web1,service=ping value=0i 1\n"))
+
+	e, err = newEnricher(nil, lookupConfig{})
+	require.Nil(t, err)
+	batch := testBatch("web1", "ping")
+	enriched, err := e.apply(batch)
+	require.Nil(t, err)
+	assert.Same(t, batch, enriched)
+}
+
+func TestEnricherLookupFile(t *testing.T) {
+	for _, file := range []struct{ name, content string }{
+		{"hosts.csv", "host,service,team,environment\nweb1,,web,prod\nweb1,ping,network,\ndb1,,dba,test\n"},
+		{"hosts.json", `[{"host": "web1", "team": "web", "environment": "prod"}, {"host": "web1", "service": "ping", "team": "network"}, {"host": "db1", "team": "dba", "environment": "test"}]`},
+	} {
+		t.Run(file.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), file.name)
+			require.Nil(t, ioutil.WriteFile(path, []byte(file.content), 0644))
+			e, err := newEnricher(map[string]string{"environment": "unknown", "site": "vienna"}, lookupConfig{Path: path})
+			require.Nil(t, err)
+			defer e.close()
+
+			assert.Equal(t, "state,host=web1,service=ping,team=network,environment=prod,site=vienna value=0i 1\n",
+				enrichedData(t, e, "state,host=web1,service=ping value=0i 1\n"))
+			assert.Equal(t, "state,host=web1,service=http,environment=prod,team=web,site=vienna value=0i 1\n",
+				enrichedData(t, e, "state,host=web1,service=http value=0i 1\n"))
+			assert.Equal(t, "state,host=db1,team=ops,environment=test,site=vienna value=0i 1\n",
+				enrichedData(t, e, "state,host=db1,team=ops value=0i 1\n"))
+			assert.Equal(t, "state,host=mail1,service=smtp,environment=unknown,site=vienna value=0i 1\n",
+				enrichedData(t, e, "state,host=mail1,service=smtp value=0i 1\n"))
+		})
+	}
+}
+
+func TestEnricherReloadsLookupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.csv")
+	require.Nil(t, ioutil.WriteFile(path, []byte("host,team\nweb1,web\n"), 0644))
+	e, err := newEnricher(nil, lookupConfig{Path: path, Interval: 10 * time.Millisecond})
+	require.Nil(t, err)
+	defer e.close()
+	assert.Equal(t, "state,host=web1,team=web value=0i 1\n", enrichedData(t, e, "state,host=web1 value=0i 1\n"))
+
+	// a broken file is not applied
+	require.Nil(t, ioutil.WriteFile(path, []byte("host,team\nweb1\n"), 0644))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "state,host=web1,team=web value=0i 1\n", enrichedData(t, e, "state,host=web1 value=0i 1\n"))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("host,team\nweb1,frontend\n"), 0644))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	assert.Eventually(t, func() bool {
+		return enrichedData(t, e, "state,host=web1 value=0i 1\n") == "state,host=web1,team=frontend value=0i 1\n"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEnricherInvalidLookupFile(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newEnricher(nil, lookupConfig{Path: filepath.Join(dir, "missing.csv")})
+	assert.NotNil(t, err)
+
+	path := filepath.Join(dir, "hosts.json")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`[{"team": "web"}]`), 0644))
+	_, err = newEnricher(nil, lookupConfig{Path: path})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of the client, so that the log of Naemon tells what happened to the check result
+const (
+	// exitDelivered: the daemon has taken the data
+	exitDelivered = 0
+	// exitFailed: the data is lost (as with invalid parameters, see failOnError)
+	exitFailed = 1
+	// exitDropped: the daemon was unavailable, the data was written to the drop directory
+	exitDropped = 2
+	// exitPublished: the daemon was unavailable, the client published the data to the sinks itself
+	exitPublished = 3
+)
+
+// fallbackMethods are what a client can do with the data if the daemon is unavailable
+var fallbackMethods = []string{"drop", "publish"}
+
+// fallbackOptions are the settings of a client for the case that the daemon is unavailable
+type fallbackOptions struct {
+	// methods are tried in order until one succeeds
+	methods []string
+	// spoolDir is the spool of the daemon, which contains the drop directory
+	spoolDir   string
+	sinkURLs   []string
+	configPath string
+	// timeout is how long publishing to the sinks may take
+	timeout time.Duration
+}
+
+func (o fallbackOptions) validate() error {
+	for _, method := range o.methods {
+		switch method {
+		case "drop":
+			if o.spoolDir == "" {
+				return errors.New("fallback drop requires --spool-dir")
+			}
+		case "publish":
+		default:
+			return fmt.Errorf("unknown fallback %q (supported: %v)", method, strings.Join(fallbackMethods, ", "))
+		}
+	}
+	return nil
+}
+
+// fallBack handles the data the daemon did not take with the first method that succeeds, and returns the exit code;
+// data the daemon may have received in part is not handled, so that it is not delivered twice
+func fallBack(data []byte, daemonErr error, options fallbackOptions) int {
+	if errors.Is(daemonErr, errPartiallySent) {
+		logger.Error("Failed to hand over the data to the daemon, not falling back", "error", daemonErr)
+		return exitFailed
+	}
+	logger.Warn("Failed to hand over the data to the daemon", "error", daemonErr)
+	for _, method := range options.methods {
+		switch method {
+		case "drop":
+			err := dropForDaemon(data, options.spoolDir)
+			if err == nil {
+				logger.Info("Dropped the data for the daemon", "path", options.spoolDir)
+				return exitDropped
+			}
+			logger.Error("Failed to drop the data for the daemon", "path", options.spoolDir, "error", err)
+		case "publish":
+			err := publishDirectly(data, options)
+			if err == nil {
+				logger.Info("Published the data to the sinks")
+				return exitPublished
+			}
+			logger.Error("Failed to publish the data to the sinks", "error", err)
+		}
+	}
+	logger.Error("The data is lost")
+	return exitFailed
+}
+
+// dropForDaemon writes the data to the drop directory of the spool, from which the daemon takes it
+func dropForDaemon(data []byte, spoolDir string) error {
+	s, err := openSpool(spoolDir)
+	if err != nil {
+		return err
+	}
+	return s.drop(data)
+}
+
+// publishDirectly publishes the data to the sinks, through the pipeline of the configuration file, as the daemon
+// would. It fails unless every sink delivered the data (or did not get it because of its filter or the routing).
+func publishDirectly(data []byte, options fallbackOptions) error {
+	f, err := newClientFanOut(options.configPath, options.sinkURLs)
+	if err != nil {
+		return err
+	}
+	parseErrors := stats.parseErrors.Load()
+	if err := f.Publish(&Batch{Data: data}); err != nil {
+		f.Close()
+		return err
+	}
+	// what is still pending after the timeout gets a last attempt when the fan-out is closed
+	f.Flush(options.timeout)
+	f.Close()
+	if stats.parseErrors.Load() > parseErrors {
+		return errors.New("the data could not be parsed")
+	}
+	var failed []string
+	for _, status := range f.Status() {
+		if status.Failed > 0 || status.Dropped > 0 {
+			failed = append(failed, fmt.Sprintf("%v: %v", status.Alias, status.LastError))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// newClientFanOut creates the fan-out of the daemon for another process, e.g. a client that publishes directly or a
+// replay: the sinks and the pipeline of the configuration file (if any), with the sinks given on the command line as
+// default
+func newClientFanOut(configPath string, commandLine []string) (*fanOut, error) {
+	cfg := &config{}
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath); err != nil {
+			return nil, err
+		}
+	}
+	var sinkURLs []string
+	for _, sinkURL := range cfg.sinkURLs(commandLine) {
+		sinkURLs = append(sinkURLs, clientSinkURL(sinkURL))
+	}
+	return newFanOut(sinkURLs, cfg, nil)
+}
+
+// clientSinkURL adapts the URL of a sink for a process other than the daemon, which must not take over the connection of
+// the daemon or of other clients: with MQTT, a client id is connected only once, so the client gets an id of its own, a
+// clean session and no store, which keeps the persistent session of the daemon
+func clientSinkURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") {
+		return rawURL
+	}
+	query := u.Query()
+	clientID := query.Get("client_id")
+	if clientID == "" {
+		clientID = defaultMQTTClientID()
+	}
+	query.Set("client_id", clientID+"-"+strconv.Itoa(os.Getpid()))
+	query.Set("clean_session", "true")
+	query.Del("store")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackOptions(t *testing.T) {
+	assert.Nil(t, fallbackOptions{}.validate())
+	assert.Nil(t, fallbackOptions{methods: []string{"publish", "drop"}, spoolDir: "/tmp"}.validate())
+	assert.EqualError(t, fallbackOptions{methods: []string{"drop"}}.validate(), "fallback drop requires --spool-dir")
+	assert.NotNil(t, fallbackOptions{methods: []string{"carrier-pigeon"}}.validate())
+}
+
+func TestFallBack(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("state,host=web1,service=ping value=0i 1\n")
+	options := fallbackOptions{spoolDir: dir, sinkURLs: []string{"test://fallback"}, timeout: time.Second}
+	assert.Equal(t, exitFailed, fallBack(data, assert.AnError, options))
+
+	options.methods = []string{"publish", "drop"}
+	assert.Equal(t, exitPublished, fallBack(data, assert.AnError, options))
+	assert.Equal(t, 1, controlledSinkFor("fallback").count())
+
+	// the daemon may have received part of the data
+	assert.Equal(t, exitFailed, fallBack(data, fmt.Errorf("%w: connection reset by peer", errPartiallySent), options))
+	assert.Equal(t, 1, controlledSinkFor("fallback").count())
+
+	// the sink cannot be reached either, the data is left for the daemon
+	options.sinkURLs = []string{"test-unreachable://fallback?queue_retries=0"}
+	assert.Equal(t, exitDropped, fallBack(data, assert.AnError, options))
+	s, err := openSpool(dir)
+	require.Nil(t, err)
+	batches, err := s.takeDropped(10)
+	require.Nil(t, err)
+	require.Len(t, batches, 1)
+	assert.Equal(t, string(data), string(batches[0].Data))
+}
+
+func TestClientSinkURL(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	assert.Equal(t, "mqtt://broker:1883?clean_session=true&client_id="+url.QueryEscape(defaultMQTTClientID()+"-"+pid)+"&qos=2",
+		clientSinkURL("mqtt://broker:1883?qos=2"))
+	assert.Equal(t, "mqtts://broker:8883?clean_session=true&client_id=naemon-"+pid,
+		clientSinkURL("mqtts://broker:8883?client_id=naemon&clean_session=false&store=/var/lib/ocxp-sender"))
+	assert.Equal(t, "amqp://localhost:5672?alias=rabbitmq", clientSinkURL("amqp://localhost:5672?alias=rabbitmq"))
+}
+
+func TestIngestDropped(t *testing.T) {
+	s, err := openSpool(t.TempDir())
+	require.Nil(t, err)
+	require.Nil(t, s.drop([]byte("state,host=web1,service=ping value=0i 1\n")))
+	require.Nil(t, s.drop([]byte("state,host=web2,service=ping value=0i 1\n")))
+	f, err := newFanOut([]string{"test://ingested?alias=ingested"}, &config{Tags: map[string]string{"site": "vienna"}}, nil)
+	require.Nil(t, err)
+
+	// the dropped data passes the pipeline, like the data of any other client
+	ingestDropped(s, f)
+	require.Nil(t, f.Close())
+	controlledSinkFor("ingested").set(func(s *controlledSink) {
+		assert.Equal(t, []string{
+			"state,host=web1,service=ping,site=vienna value=0i 1\n",
+			"state,host=web2,service=ping,site=vienna value=0i 1\n",
+		}, s.published)
+	})
+	batches, err := s.takeDropped(10)
+	require.Nil(t, err)
+	assert.Empty(t, batches)
+}
+
+func TestIngestDroppedWhatFitsIntoTheQueues(t *testing.T) {
+	s, err := openSpool(t.TempDir())
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, s.drop([]byte("state,host=web1,service=ping value=0i 1\n")))
+	}
+	f, err := newFanOut([]string{"test://roomy?alias=roomy", "test://narrow?alias=narrow&queue_size=2"}, &config{}, nil)
+	require.Nil(t, err)
+	blocked := make(chan struct{})
+	controlledSinkFor("narrow").set(func(s *controlledSink) { s.blocked = blocked })
+
+	// the narrow queue has room for two batches, the third one stays in the spool
+	ingestDropped(s, f)
+	close(blocked)
+	require.Nil(t, f.Flush(time.Second))
+	ingestDropped(s, f)
+	require.Nil(t, f.Close())
+	for _, status := range f.Status() {
+		assert.Equal(t, uint64(3), status.Delivered, status.Alias)
+		assert.Equal(t, uint64(0), status.Dropped, status.Alias)
+	}
+}
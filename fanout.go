@@ -0,0 +1,723 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fanOut is the Sink the daemon publishes to: it hands every batch over to any number of sinks. Each sink has its own
+// queue and worker, so a slow or unavailable sink does not hold up the others, and its own retry policy and filter.
+//
+// The settings of the fan-out are passed as query parameters of the sink URLs, alongside the settings of the sink
+// itself; they are removed before the sink is created:
+//
+//	alias          name of the sink in the status (default: the URL without credentials and options)
+//	queue_size     number of batches that are buffered for the sink; further batches are dropped (default 1000)
+//	queue_retries  how often a failed publish is retried (default 3)
+//	queue_backoff  wait before the first retry, doubled with every retry (default 1s)
+//	filter         only batches matching the filter are published to the sink, see parseBatchFilter
+//
+// Before the batches are queued, they pass the pipeline: the lines get the static and looked-up tags (see enricher),
+// are relabeled (see relabeler), have the cardinality of their tags limited (see cardinalityGuard), then the routing
+// rules decide which lines go to which sinks (see router).
+type fanOut struct {
+	pipeline atomic.Pointer[pipeline]
+	// failures receives an error if a sink has become unavailable, which the daemon treats like a failed publish
+	failures chan<- error
+	// connectLazily creates the sinks of the first configuration in the background (see lazySink), so that the daemon
+	// starts even if a backend is unavailable; the sinks added by a reload are always connected right away
+	connectLazily bool
+
+	// mu serializes the changes of the configuration
+	mu sync.Mutex
+	// spool is set by useSpool; it is read without mu by the status
+	spool atomic.Pointer[spool]
+}
+
+// sinkQueue is a sink of the fan-out together with its queue and delivery status
+type sinkQueue struct {
+	// url is the URL the sink was created from, including the settings of the fan-out
+	url     string
+	alias   string
+	sink    Sink
+	filter  batchFilter
+	retries int
+	backoff time.Duration
+	queue   chan *Batch
+	done    chan struct{}
+
+	// pending is the number of batches queued or being published
+	pending atomic.Int64
+	// flushNow cuts the backoff before a retry short
+	flushNow chan struct{}
+	// spool receives the batches that are left when the queue is closed; nil drops them
+	spool *spool
+
+	mu      sync.Mutex
+	closing bool
+	failing bool // the last publish failed
+	// health is the result of the last health check of the sink (see watchHealth); a delivered batch makes the sink
+	// healthy, a failed one checks it again
+	health   error
+	status   sinkStatus
+	latency  *histogram
+	failures chan<- error
+}
+
+// sinkStatus is the delivery status of a sink of the fan-out
+type sinkStatus struct {
+	Alias       string    `json:"alias"`
+	Queued      int       `json:"queued"`
+	Delivered   uint64    `json:"delivered"`
+	Filtered    uint64    `json:"filtered"`
+	Retried     uint64    `json:"retried"`
+	Failed      uint64    `json:"failed"`
+	Dropped     uint64    `json:"dropped"`
+	Spooled     uint64    `json:"spooled"`
+	Recoveries  uint64    `json:"recoveries"`
+	Reconnects  uint64    `json:"reconnects"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Healthy     bool      `json:"healthy"`
+	// Latency is the duration of the successful publishes (including retries) in seconds
+	Latency histogramSnapshot `json:"latency"`
+}
+
+func (s sinkStatus) String() string {
+	health := "healthy"
+	if !s.Healthy {
+		health = "unhealthy"
+	}
+	status := fmt.Sprintf("%v: %v, %d queued, %d delivered, %d filtered, %d retried, %d failed, %d dropped, %d spooled, %d recoveries, %d reconnects",
+		s.Alias, health, s.Queued, s.Delivered, s.Filtered, s.Retried, s.Failed, s.Dropped, s.Spooled, s.Recoveries, s.Reconnects)
+	if s.LastError != "" {
+		status += ", last error: " + s.LastError
+	}
+	return status
+}
+
+// pipeline holds the sinks and the processing steps of the configuration file; it is replaced as a whole when the
+// configuration is reloaded, so a batch never sees a mix of old and new steps, or is routed to the wrong sink
+type pipeline struct {
+	queues    []*sinkQueue
+	enricher  *enricher
+	relabeler *relabeler
+	guard     *cardinalityGuard
+	router    *router
+}
+
+// newFanOut creates the sinks and starts their workers; cfg provides the pipeline. failures may be nil.
+func newFanOut(sinkURLs []string, cfg *config, failures chan<- error) (*fanOut, error) {
+	f := &fanOut{failures: failures}
+	if err := f.configure(sinkURLs, cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// configure replaces the sinks and the pipeline with the ones of the configuration. Sinks whose URL is unchanged are
+// kept with their connection and queue; new sinks are created, removed ones deliver their queue and are closed. If
+// the configuration is invalid or a new sink cannot be created, the current sinks and pipeline stay in place.
+func (f *fanOut) configure(sinkURLs []string, cfg *config) error {
+	if len(sinkURLs) == 0 {
+		return errors.New("no sink configured")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// current is nil for the first configuration
+	var current map[string]*sinkQueue
+	if old := f.pipeline.Load(); old != nil {
+		current = map[string]*sinkQueue{}
+		for _, q := range old.queues {
+			current[q.url] = q
+		}
+	}
+	p := &pipeline{}
+	var created []*sinkQueue
+	fail := func(err error) error {
+		for _, q := range created {
+			q.close()
+		}
+		return err
+	}
+	for _, sinkURL := range sinkURLs {
+		if q, ok := current[sinkURL]; ok {
+			delete(current, sinkURL)
+			p.queues = append(p.queues, q)
+			continue
+		}
+		q, err := newSinkQueue(sinkURL, f.failures, f.connectLazily && current == nil)
+		if err != nil {
+			return fail(err)
+		}
+		created = append(created, q)
+		p.queues = append(p.queues, q)
+	}
+
+	aliases := make([]string, 0, len(p.queues))
+	for _, q := range p.queues {
+		// the alias identifies the sink in the status, the routing rules and the spool
+		if slices.Contains(aliases, q.alias) {
+			return fail(fmt.Errorf("duplicate sink alias %v", q.alias))
+		}
+		aliases = append(aliases, q.alias)
+	}
+	var err error
+	if p.relabeler, err = newRelabeler(cfg.Relabel); err != nil {
+		return fail(err)
+	}
+	if p.guard, err = newCardinalityGuard(cfg.Cardinality); err != nil {
+		return fail(err)
+	}
+	if p.router, err = newRouter(cfg.Routes, aliases); err != nil {
+		return fail(err)
+	}
+	if p.enricher, err = newEnricher(cfg.Tags, cfg.Lookup); err != nil {
+		return fail(fmt.Errorf("lookup file: %w", err))
+	}
+	if f.spool.Load() != nil {
+		for _, q := range created {
+			if err := f.requeueSpooled(q); err != nil {
+				logger.Error("Failed to read spool", "sink", q.alias, "error", err)
+			}
+		}
+	}
+
+	old := f.pipeline.Swap(p)
+	if old == nil {
+		return nil
+	}
+	old.enricher.close()
+	// batches that were already routed to a removed sink are delivered before it is closed
+	for _, q := range current {
+		if err := q.close(); err != nil {
+			logger.Warn("Failed to close removed sink", "sink", q.alias, "error", err)
+		}
+	}
+	return nil
+}
+
+func newSinkQueue(sinkURL string, failures chan<- error, lazy bool) (*sinkQueue, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	options := &sinkOptions{values: query}
+	q := &sinkQueue{
+		url:      sinkURL,
+		alias:    options.String("alias", (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()),
+		retries:  options.Int("queue_retries", 3),
+		backoff:  options.Duration("queue_backoff", time.Second),
+		done:     make(chan struct{}),
+		latency:  newHistogram(latencyBounds...),
+		flushNow: make(chan struct{}, 1),
+		failures: failures,
+	}
+	size := options.Int("queue_size", 1000)
+	if size < 1 {
+		options.fail("queue_size", errors.New("must be at least 1"))
+	}
+	if q.retries < 0 {
+		options.fail("queue_retries", errors.New("must not be negative"))
+	}
+	if q.backoff < 0 {
+		options.fail("queue_backoff", errors.New("must not be negative"))
+	}
+	q.filter, err = parseBatchFilter(options.String("filter", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter of sink %v: %w", q.alias, err)
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	q.queue = make(chan *Batch, size)
+	for _, name := range []string{"alias", "queue_size", "queue_retries", "queue_backoff", "filter"} {
+		query.Del(name)
+	}
+	u.RawQuery = query.Encode()
+
+	if lazy {
+		q.sink, err = newLazySink(q.alias, u.String())
+	} else {
+		q.sink, err = newSink(u.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup sink %v: %w", q.alias, err)
+	}
+	q.status = sinkStatus{Alias: q.alias, Healthy: true}
+	go q.run()
+	go q.watchHealth()
+	return q, nil
+}
+
+// Publish passes the batch through the pipeline and queues the resulting batches for every sink whose filter they
+// match; it does not wait for the delivery. A sink whose queue is full drops the batch. A batch that cannot be parsed
+// is dropped (and counted as parse error).
+func (f *fanOut) Publish(batch *Batch) error {
+	p := f.pipeline.Load()
+	routed, err := f.process(p, batch)
+	if err != nil {
+		stats.parseErrors.Add(1)
+		logger.Warn("Dropped batch that could not be parsed", "host", batch.Tag("host"), "service", batch.Tag("service"), "error", err)
+		return nil
+	}
+	for _, r := range routed {
+		p.queues[r.sink].enqueue(r.batch)
+	}
+	return nil
+}
+
+func (f *fanOut) process(p *pipeline, batch *Batch) ([]routedBatch, error) {
+	batch, err := p.enricher.apply(batch)
+	if err != nil || batch == nil {
+		return nil, err
+	}
+	if batch, err = p.relabeler.apply(batch); err != nil || batch == nil {
+		return nil, err
+	}
+	if batch, err = p.guard.apply(batch); err != nil || batch == nil {
+		return nil, err
+	}
+	return p.router.route(batch)
+}
+
+// Health reports the sinks that were not able to deliver at their last health check
+func (f *fanOut) Health() error {
+	var unhealthy []string
+	for _, q := range f.pipeline.Load().queues {
+		if err := q.cachedHealth(); err != nil {
+			unhealthy = append(unhealthy, fmt.Sprintf("%v: %v", q.alias, err))
+		}
+	}
+	if len(unhealthy) > 0 {
+		return errors.New(strings.Join(unhealthy, "; "))
+	}
+	return nil
+}
+
+// Close stops accepting batches, delivers the queued ones (without retries) and closes the sinks. With a spool, the
+// batches that cannot be delivered are spooled instead, as are the queued ones of an unhealthy sink.
+func (f *fanOut) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.pipeline.Load()
+	p.enricher.close()
+	var errs []string
+	for _, q := range p.queues {
+		if err := q.close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", q.alias, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// spoolDepth returns the number of batches in the spool, or 0 without a spool
+func (f *fanOut) spoolDepth() int {
+	s := f.spool.Load()
+	if s == nil {
+		return 0
+	}
+	depth, err := s.depth()
+	if err != nil {
+		logger.Warn("Failed to read spool", "error", err)
+	}
+	return depth
+}
+
+// Offenders returns the tags that exceed their cardinality limit, since the configuration was last (re)loaded
+func (f *fanOut) Offenders() []cardinalityOffender {
+	return f.pipeline.Load().guard.Offenders()
+}
+
+// useSpool makes the sinks spool the batches that are left when they are closed, and queues the batches spooled by
+// the last run
+func (f *fanOut) useSpool(s *spool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spool.Store(s)
+	for _, q := range f.pipeline.Load().queues {
+		if err := f.requeueSpooled(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// room returns the number of batches that can be published before the queue of a sink is full
+func (f *fanOut) room() int {
+	room := math.MaxInt
+	for _, q := range f.pipeline.Load().queues {
+		room = min(room, q.room())
+	}
+	return room
+}
+
+// takeSpooled queues the batches that are left in the spool because the queues had no room for them when the spool was
+// read; they are queued after the batches received since
+func (f *fanOut) takeSpooled() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool.Load() == nil {
+		return
+	}
+	for _, q := range f.pipeline.Load().queues {
+		if err := f.requeueSpooled(q); err != nil {
+			logger.Error("Failed to read spool", "sink", q.alias, "error", err)
+		}
+	}
+}
+
+// requeueSpooled makes the sink use the spool and queues the batches spooled for it, as many as its queue has room
+// for; the others stay in the spool
+func (f *fanOut) requeueSpooled(q *sinkQueue) error {
+	q.spool = f.spool.Load()
+	batches, err := q.spool.take(q.alias, q.room())
+	for _, batch := range batches {
+		q.enqueue(batch)
+	}
+	if len(batches) > 0 {
+		logger.Info("Queued spooled batches", "sink", q.alias, "batches", len(batches))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool of sink %v: %w", q.alias, err)
+	}
+	return nil
+}
+
+// Flush delivers the queued batches and the data the sinks buffer, skipping the backoff before retries. It waits until
+// all queues are empty, at most for the timeout; it does not wait for sinks that were unhealthy at their last health
+// check.
+func (f *fanOut) Flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	// a sink that buffers data is flushed once, and again as long as batches are queued for it; the result of the
+	// running flush is sent to its channel
+	flushing := map[*sinkQueue]chan error{}
+	flushed := map[*sinkQueue]bool{}
+	for {
+		var pending, unhealthy []string
+		for _, q := range f.pipeline.Load().queues {
+			if done := flushing[q]; done != nil {
+				select {
+				case err := <-done:
+					delete(flushing, q)
+					if err != nil {
+						return fmt.Errorf("%v: %w", q.alias, err)
+					}
+				default:
+				}
+			}
+			n := q.pending.Load()
+			if n > 0 {
+				if err := q.cachedHealth(); err != nil {
+					unhealthy = append(unhealthy, fmt.Sprintf("%v: %d batches (%v)", q.alias, n, err))
+				} else {
+					pending = append(pending, fmt.Sprintf("%v: %d batches", q.alias, n))
+				}
+			}
+			select {
+			case q.flushNow <- struct{}{}:
+			default:
+			}
+			if flusher, ok := q.sink.(Flusher); ok && flushing[q] == nil && (!flushed[q] || n > 0) {
+				done := make(chan error, 1)
+				flushing[q], flushed[q] = done, true
+				go func() { done <- flusher.Flush() }()
+			}
+			if flushing[q] != nil {
+				pending = append(pending, fmt.Sprintf("%v: flushing buffered data", q.alias))
+			}
+		}
+		if len(pending) == 0 && len(unhealthy) == 0 {
+			return nil
+		}
+		if len(pending) == 0 {
+			return fmt.Errorf("still pending for unhealthy sinks: %v", strings.Join(unhealthy, "; "))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still pending after %v: %v", timeout, strings.Join(append(pending, unhealthy...), "; "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Status returns the delivery status of every sink
+func (f *fanOut) Status() []sinkStatus {
+	queues := f.pipeline.Load().queues
+	statuses := make([]sinkStatus, 0, len(queues))
+	for _, q := range queues {
+		statuses = append(statuses, q.currentStatus())
+	}
+	return statuses
+}
+
+func (q *sinkQueue) enqueue(batch *Batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closing {
+		q.status.Dropped++
+		return
+	}
+	if !q.filter.match(batch) {
+		q.status.Filtered++
+		return
+	}
+	q.pending.Add(1)
+	select {
+	case q.queue <- batch:
+	default:
+		q.pending.Add(-1)
+		q.status.Dropped++
+		if q.status.Dropped == 1 || q.status.Dropped%1000 == 0 {
+			logger.Warn("Queue of sink is full, dropping batches", "sink", q.alias, "dropped", q.status.Dropped)
+		}
+	}
+}
+
+// room returns the number of batches that can be queued before the queue is full
+func (q *sinkQueue) room() int {
+	return cap(q.queue) - len(q.queue)
+}
+
+// run publishes the queued batches until the queue is closed
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for batch := range q.queue {
+		q.mu.Lock()
+		closing := q.closing
+		q.mu.Unlock()
+		if closing && q.spool != nil && q.cachedHealth() != nil {
+			q.spoolBatch(batch)
+			q.pending.Add(-1)
+		} else {
+			q.publish(batch)
+		}
+	}
+}
+
+// spoolBatch writes a batch that cannot be delivered to the spool
+func (q *sinkQueue) spoolBatch(batch *Batch) {
+	err := q.spool.write(q.alias, batch)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		q.status.Failed++
+		logger.Error("Failed to spool batch", "sink", q.alias, "error", err)
+		return
+	}
+	q.status.Spooled++
+}
+
+// publish hands a batch over to the sink, retrying with exponential backoff unless the queue is closing. A sink that
+// delivers in the background (see AsyncSink) takes the batch over right away and reports the result of the delivery
+// later, so the worker goes on with the next batch; such a sink retries the delivery itself.
+func (q *sinkQueue) publish(batch *Batch) {
+	backoff := q.backoff
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := handOver(q.sink, batch, func(err error) { q.delivered(batch, start, err) })
+		if err == nil {
+			return
+		}
+		var encodingErr *encodingError
+		if errors.As(err, &encodingErr) {
+			// the batch is the problem, not the sink
+			q.mu.Lock()
+			q.status.LastError = err.Error()
+			q.status.Failed++
+			q.mu.Unlock()
+			q.pending.Add(-1)
+			logger.Error("Failed to encode batch for sink", "sink", q.alias, "host", batch.Tag("host"), "service", batch.Tag("service"), "error", err)
+			return
+		}
+		q.mu.Lock()
+		if attempt >= q.retries || q.closing {
+			q.mu.Unlock()
+			q.delivered(batch, start, err)
+			return
+		}
+		q.status.LastError = err.Error()
+		q.failing = true
+		q.status.Retried++
+		q.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-q.flushNow:
+		}
+		backoff *= 2
+	}
+}
+
+// delivered records the final result of publishing a batch. A batch that could not be delivered is spooled if the
+// queue is closing, otherwise it is lost.
+func (q *sinkQueue) delivered(batch *Batch, start time.Time, err error) {
+	defer q.pending.Add(-1)
+	var healthErr error
+	if err != nil {
+		// checked first, so that the status never shows the failure with the health from before it
+		healthErr = q.checkHealth()
+	}
+	q.mu.Lock()
+	if err == nil {
+		q.status.Delivered++
+		q.status.LastSuccess = time.Now()
+		q.health = nil
+		if q.failing {
+			q.failing = false
+			q.status.Recoveries++
+		}
+		q.mu.Unlock()
+		q.latency.observe(time.Since(start).Seconds())
+		return
+	}
+	q.status.LastError = err.Error()
+	q.failing = true
+	if q.closing && q.spool != nil {
+		q.mu.Unlock()
+		q.spoolBatch(batch)
+		return
+	}
+	q.status.Failed++
+	q.mu.Unlock()
+
+	logger.Error("Failed to publish to sink", "sink", q.alias, "host", batch.Tag("host"), "service", batch.Tag("service"), "error", err)
+	if healthErr != nil && q.failures != nil && q.hasConnected() {
+		// the sink has lost its connection; let the daemon decide (it exits and gets respawned)
+		select {
+		case q.failures <- fmt.Errorf("sink %v: %w", q.alias, err):
+		default:
+		}
+	}
+}
+
+// healthCheckInterval is how often the health of the sinks is checked in the background
+const healthCheckInterval = 10 * time.Second
+
+// watchHealth checks the health of the sink until the queue is closed, so that the status, Flush and the health
+// checks of the daemon can use the result without waiting for the sink
+func (q *sinkQueue) watchHealth() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		q.checkHealth()
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth checks the health of the sink and keeps the result
+func (q *sinkQueue) checkHealth() error {
+	err := q.sink.Health()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.health = err
+	return err
+}
+
+// cachedHealth returns the result of the last health check of the sink
+func (q *sinkQueue) cachedHealth() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.health
+}
+
+// hasConnected reports whether the sink has ever been connected. A sink that never was keeps trying to connect, so a
+// new daemon would not help.
+func (q *sinkQueue) hasConnected() bool {
+	if lazy, ok := q.sink.(*lazySink); ok {
+		return lazy.connected()
+	}
+	return true
+}
+
+func (q *sinkQueue) close() error {
+	q.mu.Lock()
+	if !q.closing {
+		q.closing = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	// a publish waiting for its retry gives up right away
+	select {
+	case q.flushNow <- struct{}{}:
+	default:
+	}
+	<-q.done
+	return q.sink.Close()
+}
+
+func (q *sinkQueue) currentStatus() sinkStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := q.status
+	status.Queued = len(q.queue)
+	status.Healthy = q.health == nil
+	if reconnector, ok := q.sink.(Reconnector); ok {
+		status.Reconnects = reconnector.Reconnects()
+	}
+	status.Latency = q.latency.snapshot()
+	return status
+}
+
+// batchFilter selects batches by the tags of their first line (host, service and the variables); all conditions have
+// to match
+type batchFilter []filterCondition
+
+type filterCondition struct {
+	tag     string
+	pattern string
+	negate  bool
+}
+
+// parseBatchFilter parses a filter in the form "tag=pattern,tag!=pattern,...", where pattern is a glob pattern
+// (e.g. "host=web*,service!=ssh"). An empty filter matches every batch.
+func parseBatchFilter(filter string) (batchFilter, error) {
+	var conditions batchFilter
+	if filter == "" {
+		return conditions, nil
+	}
+	for _, condition := range strings.Split(filter, ",") {
+		c := filterCondition{}
+		parts := strings.SplitN(condition, "!=", 2)
+		if len(parts) == 2 {
+			c.negate = true
+		} else {
+			parts = strings.SplitN(condition, "=", 2)
+		}
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("condition %q is not in the form tag=pattern or tag!=pattern", condition)
+		}
+		c.tag, c.pattern = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, err := path.Match(c.pattern, ""); err != nil {
+			return nil, fmt.Errorf("condition %q: %w", condition, err)
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+func (f batchFilter) match(batch *Batch) bool {
+	for _, c := range f {
+		matched, _ := path.Match(c.pattern, batch.Tag(c.tag))
+		if matched == c.negate {
+			return false
+		}
+	}
+	return true
+}
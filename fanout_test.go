@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// controlledSink is a sink whose behaviour is controlled by the test: publishes block while blocked is set, fail while
+// failing is set, fail as long as failures is positive and fail with rejected if it is set; healthChecks counts the
+// calls of Health
+type controlledSink struct {
+	mu        sync.Mutex
+	published []string
+	failing   bool
+	failures  int
+	rejected  error
+	blocked   chan struct{}
+	closed    bool
+
+	healthChecks int
+}
+
+func (s *controlledSink) set(fn func(s *controlledSink)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s)
+}
+
+func (s *controlledSink) Publish(batch *Batch) error {
+	s.mu.Lock()
+	blocked := s.blocked
+	s.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	if s.rejected != nil {
+		err := s.rejected
+		s.rejected = nil
+		return err
+	}
+	if s.failing || s.closed {
+		return errors.New("unavailable")
+	}
+	s.published = append(s.published, string(batch.Data))
+	return nil
+}
+
+func (s *controlledSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthChecks++
+	if s.failing {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (s *controlledSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *controlledSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.published)
+}
+
+// controlledSinks are the sinks created for test://<name> URLs; the URL options must not reach the sink
+var controlledSinks = struct {
+	sync.Mutex
+	sinks map[string]*controlledSink
+}{sinks: map[string]*controlledSink{}}
+
+func init() {
+	registerSink(func(u *url.URL) (Sink, error) {
+		if u.RawQuery != "" {
+			return nil, errors.New("unexpected options " + u.RawQuery)
+		}
+		controlledSinks.Lock()
+		defer controlledSinks.Unlock()
+		s := &controlledSink{}
+		controlledSinks.sinks[u.Host] = s
+		return s, nil
+	}, "test")
+	registerSink(func(u *url.URL) (Sink, error) {
+		return nil, errors.New("connection refused")
+	}, "test-unreachable")
+}
+
+func controlledSinkFor(name string) *controlledSink {
+	controlledSinks.Lock()
+	defer controlledSinks.Unlock()
+	return controlledSinks.sinks[name]
+}
+
+func testBatch(host string, service string) *Batch {
+	return &Batch{Data: []byte("state,host=" + host + ",service=" + service + " value=0i 1\n")}
+}
+
+func TestFanOutSlowSinkDoesNotBlockOthers(t *testing.T) {
+	f, err := newFanOut([]string{"test://slow", "test://fast"}, &config{}, nil)
+	require.Nil(t, err)
+	slow, fast := controlledSinkFor("slow"), controlledSinkFor("fast")
+	unblock := make(chan struct{})
+	slow.set(func(s *controlledSink) { s.blocked = unblock })
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, f.Publish(testBatch("h", "s")))
+	}
+	assert.Eventually(t, func() bool { return fast.count() == 10 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, slow.count())
+
+	close(unblock)
+	assert.Eventually(t, func() bool { return slow.count() == 10 }, time.Second, 10*time.Millisecond)
+	require.Nil(t, f.Close())
+}
+
+func TestFanOutFilter(t *testing.T) {
+	f, err := newFanOut([]string{"test://web?filter=host%3Dweb*,service!%3Dssh", "test://all"}, &config{}, nil)
+	require.Nil(t, err)
+	for _, batch := range []*Batch{testBatch("web1", "ping"), testBatch("web1", "ssh"), testBatch("db1", "ping")} {
+		require.Nil(t, f.Publish(batch))
+	}
+	require.Nil(t, f.Close())
+
+	assert.Equal(t, []string{string(testBatch("web1", "ping").Data)}, controlledSinkFor("web").published)
+	assert.Equal(t, 3, controlledSinkFor("all").count())
+	assert.Equal(t, uint64(2), f.Status()[0].Filtered)
+}
+
+func TestFanOutRetries(t *testing.T) {
+	failures := make(chan error, 1)
+	f, err := newFanOut([]string{"test://flaky?queue_retries=2&queue_backoff=10ms&alias=flaky"}, &config{}, failures)
+	require.Nil(t, err)
+	defer f.Close()
+	s := controlledSinkFor("flaky")
+	// the publish and the first retry fail
+	s.set(func(s *controlledSink) { s.failures = 2 })
+
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	assert.Eventually(t, func() bool { return s.count() == 1 }, time.Second, 10*time.Millisecond)
+	status := f.Status()[0]
+	assert.Equal(t, "flaky", status.Alias)
+	assert.Equal(t, uint64(1), status.Delivered)
+	assert.Equal(t, uint64(2), status.Retried)
+	assert.Equal(t, uint64(0), status.Failed)
+	assert.Equal(t, uint64(1), status.Recoveries)
+	assert.Equal(t, "unavailable", status.LastError)
+	assert.Len(t, failures, 0)
+}
+
+func TestFanOutDoesNotRetryEncodingErrors(t *testing.T) {
+	failures := make(chan error, 1)
+	f, err := newFanOut([]string{"test://encoding?queue_backoff=1h&alias=encoding"}, &config{}, failures)
+	require.Nil(t, err)
+	defer f.Close()
+	s := controlledSinkFor("encoding")
+	s.set(func(s *controlledSink) { s.rejected = &encodingError{err: errors.New("no state line")} })
+
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	// the queue does not wait for the backoff before the next batch
+	assert.Eventually(t, func() bool { return s.count() == 1 }, time.Second, 10*time.Millisecond)
+	status := f.Status()[0]
+	assert.Equal(t, uint64(1), status.Failed)
+	assert.Equal(t, uint64(0), status.Retried)
+	assert.Equal(t, uint64(0), status.Recoveries)
+	assert.Len(t, failures, 0)
+}
+
+func TestFanOutReportsUnavailableSink(t *testing.T) {
+	failures := make(chan error, 1)
+	f, err := newFanOut([]string{"test://down?queue_retries=1&queue_backoff=1ms"}, &config{}, failures)
+	require.Nil(t, err)
+	defer f.Close()
+	controlledSinkFor("down").set(func(s *controlledSink) { s.failing = true })
+
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	select {
+	case err := <-failures:
+		assert.Equal(t, "sink test://down: unavailable", err.Error())
+	case <-time.After(time.Second):
+		t.Fatal("unavailable sink was not reported")
+	}
+	status := f.Status()[0]
+	assert.Equal(t, uint64(1), status.Failed)
+	assert.False(t, status.Healthy)
+	assert.NotNil(t, f.Health())
+	assert.True(t, strings.HasPrefix(status.String(), "test://down: unhealthy, 0 queued, 0 delivered"), status.String())
+}
+
+func TestFanOutConnectsLazily(t *testing.T) {
+	failures := make(chan error, 1)
+	f := &fanOut{failures: failures, connectLazily: true}
+	require.Nil(t, f.configure([]string{"test-unreachable://down?queue_retries=1&queue_backoff=1ms"}, &config{}))
+	defer f.Close()
+
+	// a sink that has never been connected keeps trying, the daemon does not have to be replaced
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	assert.Eventually(t, func() bool { return f.Status()[0].Failed == 1 }, time.Second, time.Millisecond)
+	assert.Len(t, failures, 0)
+	assert.EqualError(t, f.Health(), "test-unreachable://down: not connected: connection refused")
+
+	// sinks added by a reload have to connect right away
+	assert.NotNil(t, f.configure([]string{"test-unreachable://down?queue_retries=1&queue_backoff=1ms", "test-unreachable://added"}, &config{}))
+	_, err := newFanOut([]string{"test-unreachable://down"}, &config{}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestFanOutDropsWhenQueueIsFull(t *testing.T) {
+	f, err := newFanOut([]string{"test://full?queue_size=2"}, &config{}, nil)
+	require.Nil(t, err)
+	s := controlledSinkFor("full")
+	unblock := make(chan struct{})
+	s.set(func(s *controlledSink) { s.blocked = unblock })
+
+	// one batch is being published, two are queued, the rest is dropped
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	assert.Eventually(t, func() bool { return f.Status()[0].Queued == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 4; i++ {
+		require.Nil(t, f.Publish(testBatch("h", "s")))
+	}
+	status := f.Status()[0]
+	assert.Equal(t, 2, status.Queued)
+	assert.Equal(t, uint64(2), status.Dropped)
+
+	close(unblock)
+	require.Nil(t, f.Close())
+	assert.Equal(t, 3, s.count())
+}
+
+func TestFanOutEmptyBatch(t *testing.T) {
+	replacement := "alerts"
+	f, err := newFanOut([]string{"test://empty"}, &config{
+		Tags:    map[string]string{"dc": "vie"},
+		Relabel: []relabelConfig{{SourceLabels: []string{"host"}, TargetLabel: "team", Replacement: &replacement}},
+	}, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, f.Publish(&Batch{Data: []byte{}}))
+	require.Nil(t, f.Close())
+	assert.Equal(t, 0, controlledSinkFor("empty").count())
+}
+
+func TestFanOutInvalidConfiguration(t *testing.T) {
+	_, err := newFanOut(nil, &config{}, nil)
+	assert.NotNil(t, err)
+	_, err = newFanOut([]string{"test://a?filter=host"}, &config{}, nil)
+	assert.NotNil(t, err)
+	_, err = newFanOut([]string{"test://a?queue_size=many"}, &config{}, nil)
+	assert.NotNil(t, err)
+	_, err = newFanOut([]string{"test://a", "nosuchsink://b"}, &config{}, nil)
+	assert.NotNil(t, err)
+	_, err = newFanOut([]string{"test://a?queue_size=-1"}, &config{}, nil)
+	assert.EqualError(t, err, "invalid value for sink option queue_size: must be at least 1")
+	_, err = newFanOut([]string{"test://a?queue_size=0"}, &config{}, nil)
+	assert.NotNil(t, err)
+	_, err = newFanOut([]string{"test://a?queue_retries=-1"}, &config{}, nil)
+	assert.EqualError(t, err, "invalid value for sink option queue_retries: must not be negative")
+	_, err = newFanOut([]string{"test://a?queue_backoff=-1s"}, &config{}, nil)
+	assert.EqualError(t, err, "invalid value for sink option queue_backoff: must not be negative")
+	_, err = newFanOut([]string{"test://a?alias=same", "test://b?alias=same"}, &config{}, nil)
+	assert.EqualError(t, err, "duplicate sink alias same")
+}
+
+func TestFanOutReloadRejectsInvalidQueueOptions(t *testing.T) {
+	f, err := newFanOut([]string{"test://reloaded?alias=reloaded"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+
+	// the running sinks stay in place
+	assert.NotNil(t, f.configure([]string{"test://reloaded?alias=reloaded&queue_size=-5"}, &config{}))
+	assert.NotNil(t, f.configure([]string{"test://reloaded?alias=reloaded", "test://other?alias=reloaded"}, &config{}))
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	assert.Eventually(t, func() bool { return controlledSinkFor("reloaded").count() == 1 }, time.Second, time.Millisecond)
+}
+
+func TestFanOutReconfiguresSinks(t *testing.T) {
+	f, err := newFanOut([]string{"test://kept?alias=kept", "test://removed?alias=removed"}, &config{}, nil)
+	require.Nil(t, err)
+	kept, removed := controlledSinkFor("kept"), controlledSinkFor("removed")
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+
+	// unchanged sinks keep their connection, removed ones deliver their queue and are closed
+	require.Nil(t, f.configure([]string{"test://kept?alias=kept", "test://added?alias=added"}, &config{}))
+	added := controlledSinkFor("added")
+	assert.Same(t, kept, controlledSinkFor("kept"))
+	removed.set(func(s *controlledSink) {
+		assert.True(t, s.closed)
+		assert.Len(t, s.published, 1)
+	})
+
+	// an invalid configuration is rejected, and the sinks created for it are closed again
+	assert.NotNil(t, f.configure([]string{"test://kept?alias=kept", "nosuchsink://b"}, &config{}))
+	assert.NotNil(t, f.configure([]string{"test://kept?alias=kept", "test://rejected?alias=rejected"},
+		&config{Routes: []routeConfig{{Sinks: []string{"unknown"}}}}))
+	controlledSinkFor("rejected").set(func(s *controlledSink) { assert.True(t, s.closed) })
+
+	require.Nil(t, f.Publish(testBatch("web2", "ping")))
+	require.Nil(t, f.Close())
+	assert.Equal(t, 2, kept.count())
+	assert.Equal(t, 1, added.count())
+	var aliases []string
+	for _, status := range f.Status() {
+		aliases = append(aliases, status.Alias)
+	}
+	assert.Equal(t, []string{"kept", "added"}, aliases)
+}
+
+func TestBatchFilter(t *testing.T) {
+	filter, err := parseBatchFilter("host=web*, a!=x?z")
+	require.Nil(t, err)
+	assert.True(t, filter.match(&Batch{Data: []byte("state,host=web1,a=abc value=0i 1\n")}))
+	assert.False(t, filter.match(&Batch{Data: []byte("state,host=web1,a=xyz value=0i 1\n")}))
+	assert.False(t, filter.match(&Batch{Data: []byte("state,host=db1 value=0i 1\n")}))
+
+	_, err = parseBatchFilter("host=[")
+	assert.NotNil(t, err)
+}
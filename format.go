@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// checkResult is the structured form of one check result, as it is transported by the lines of a single batch. It is
+// used for consumers that are not Influx-aware and prefer JSON over line protocol. A batch without the state line
+// (e.g. the metric lines that routing rules split off) has no state and output. Lines of other measurements (e.g. of
+// the self-monitoring) are kept in Metrics.
+type checkResult struct {
+	Host      string            `json:"host"`
+	Service   string            `json:"service"`
+	State     *int64            `json:"state,omitempty"`
+	Output    string            `json:"output,omitempty"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	PerfData  []perfDataEntry   `json:"perfdata"`
+	Metrics   []lineEntry       `json:"metrics,omitempty"`
+}
+
+// lineEntry is a line that is neither a state nor a metric line; host and service are those of the document
+type lineEntry struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Fields      map[string]any    `json:"fields"`
+}
+
+// perfDataEntry is a single parsed performance data entry; thresholds and limits are only present if reported
+type perfDataEntry struct {
+	Label string   `json:"label"`
+	Value float64  `json:"value"`
+	UOM   string   `json:"uom,omitempty"`
+	Warn  *float64 `json:"warn,omitempty"`
+	Crit  *float64 `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// checkResultFromMetrics reassembles a check result from the lines created by parse: the "state" line provides
+// state and output, each "metric" line becomes a perfdata entry and all tags but the well-known ones become vars.
+// Without a state line, host, service, vars and timestamp are taken from the first metric line; without either, host,
+// service and timestamp are taken from the first line of another measurement.
+func checkResultFromMetrics(metrics []protocol.Metric) (*checkResult, error) {
+	result := checkResult{PerfData: []perfDataEntry{}}
+	var identity, firstOther protocol.Metric
+	for _, m := range metrics {
+		switch m.Name() {
+		case "state":
+			identity = m
+			for _, field := range m.FieldList() {
+				switch field.Key {
+				case "value":
+					state, ok := field.Value.(int64)
+					if !ok {
+						return nil, fmt.Errorf("state has unexpected type %T", field.Value)
+					}
+					result.State = &state
+				case "output":
+					result.Output, _ = field.Value.(string)
+				}
+			}
+		case "metric":
+			if identity == nil {
+				identity = m
+			}
+			entry := perfDataEntry{Label: tagValue(m, "label"), UOM: tagValue(m, "uom")}
+			for _, field := range m.FieldList() {
+				v, ok := field.Value.(float64)
+				if !ok {
+					continue
+				}
+				switch field.Key {
+				case "value":
+					entry.Value = v
+				case "warn":
+					entry.Warn = &v
+				case "crit":
+					entry.Crit = &v
+				case "min":
+					entry.Min = &v
+				case "max":
+					entry.Max = &v
+				}
+			}
+			result.PerfData = append(result.PerfData, entry)
+		default:
+			if firstOther == nil {
+				firstOther = m
+			}
+			entry := lineEntry{Measurement: m.Name(), Fields: map[string]any{}}
+			for _, tag := range m.TagList() {
+				if tag.Key == "host" || tag.Key == "service" {
+					continue
+				}
+				if entry.Tags == nil {
+					entry.Tags = map[string]string{}
+				}
+				entry.Tags[tag.Key] = tag.Value
+			}
+			for _, field := range m.FieldList() {
+				entry.Fields[field.Key] = field.Value
+			}
+			result.Metrics = append(result.Metrics, entry)
+		}
+	}
+	if identity == nil && firstOther == nil {
+		return nil, errors.New("batch contains no lines")
+	}
+	if identity == nil {
+		result.Timestamp = firstOther.Time()
+		result.Host, result.Service = tagValue(firstOther, "host"), tagValue(firstOther, "service")
+		return &result, nil
+	}
+	result.Timestamp = identity.Time()
+	for _, tag := range identity.TagList() {
+		switch tag.Key {
+		case "host":
+			result.Host = tag.Value
+		case "service":
+			result.Service = tag.Value
+		case "label", "uom":
+			// of the perfdata entry
+		default:
+			if result.Vars == nil {
+				result.Vars = map[string]string{}
+			}
+			result.Vars[tag.Key] = tag.Value
+		}
+	}
+	return &result, nil
+}
+
+// lineProtocol turns the check result back into the lines parse would have created for it, e.g. to replay JSON
+// archives through a sink
+func (r *checkResult) lineProtocol() ([]byte, error) {
+	tags := []*protocol.Tag{{Key: "host", Value: r.Host}, {Key: "service", Value: r.Service}}
+	keys := make([]string, 0, len(r.Vars))
+	for key := range r.Vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, &protocol.Tag{Key: key, Value: r.Vars[key]})
+	}
+
+	var b bytes.Buffer
+	encoder := protocol.NewEncoder(&b)
+	for _, entry := range r.PerfData {
+		metric := Metric{
+			name:      "metric",
+			fields:    []*protocol.Field{{Key: "value", Value: entry.Value}},
+			tags:      append([]*protocol.Tag{{Key: "label", Value: entry.Label}}, tags...),
+			timestamp: r.Timestamp,
+		}
+		if entry.UOM != "" {
+			metric.tags = append(metric.tags, &protocol.Tag{Key: "uom", Value: entry.UOM})
+		}
+		for _, f := range []struct {
+			key   string
+			value *float64
+		}{{"warn", entry.Warn}, {"crit", entry.Crit}, {"min", entry.Min}, {"max", entry.Max}} {
+			if f.value != nil {
+				metric.fields = append(metric.fields, &protocol.Field{Key: f.key, Value: *f.value})
+			}
+		}
+		if _, err := encoder.Encode(metric); err != nil {
+			return nil, err
+		}
+	}
+	if r.State != nil {
+		if _, err := encoder.Encode(state2metric("state", int(*r.State), r.Output, tags, r.Timestamp)); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range r.Metrics {
+		if _, err := encoder.Encode(entry.metric(r.Host, r.Service, r.Timestamp)); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// metric returns the line of the entry, with the host and service of its document
+func (e lineEntry) metric(host string, service string, timestamp time.Time) Metric {
+	m := Metric{name: e.Measurement, timestamp: timestamp}
+	for _, tag := range []*protocol.Tag{{Key: "host", Value: host}, {Key: "service", Value: service}} {
+		if tag.Value != "" {
+			m.tags = append(m.tags, tag)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(e.Tags)) {
+		m.tags = append(m.tags, &protocol.Tag{Key: key, Value: e.Tags[key]})
+	}
+	for _, key := range slices.Sorted(maps.Keys(e.Fields)) {
+		m.fields = append(m.fields, &protocol.Field{Key: key, Value: e.Fields[key]})
+	}
+	return m
+}
+
+// payloadFormat is the encoding in which a sink delivers batches; it is selected per sink with the format option
+type payloadFormat string
+
+const (
+	// formatLineProtocol forwards the Influx Line Protocol lines as they were received
+	formatLineProtocol payloadFormat = "lineprotocol"
+	// formatJSON delivers one JSON document (see checkResult) per batch
+	formatJSON payloadFormat = "json"
+)
+
+func parseFormat(name string) (payloadFormat, error) {
+	switch f := payloadFormat(name); f {
+	case formatLineProtocol, formatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unsupported format %q", name)
+}
+
+// ContentType returns the MIME type of the format, e.g. for AMQP's content type property
+func (f payloadFormat) ContentType() string {
+	if f == formatJSON {
+		return "application/json"
+	}
+	return "text/plain"
+}
+
+// Encode returns the payload of the batch in this format. Its errors are encodingErrors.
+func (f payloadFormat) Encode(batch *Batch) ([]byte, error) {
+	if f == formatJSON {
+		payload, err := encodeJSON(batch)
+		if err != nil {
+			return nil, &encodingError{err: err}
+		}
+		return payload, nil
+	}
+	return batch.Data, nil
+}
+
+// encodingError is an error encoding a batch into the payload of a sink; the batch will not be encoded by a retry
+// either, and the sink is not to blame
+type encodingError struct {
+	err error
+}
+
+func (e *encodingError) Error() string {
+	return "failed to encode batch: " + e.err.Error()
+}
+
+func (e *encodingError) Unwrap() error {
+	return e.err
+}
+
+// encodeJSON returns the batch as a single JSON check result document
+func encodeJSON(batch *Batch) ([]byte, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	result, err := checkResultFromMetrics(metrics)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeJSON(t *testing.T) {
+	timestamp := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	lines, err := parse("host", "service", 1, "WARNING - / is filling up", variableFlags{"a=xyz", "b=23"}, "/=2643MB;5948;5958;0;5968 load=0.5;;;0", timestamp)
+	assert.Nil(t, err)
+	b, err := encodeJSON(&Batch{Data: lines.Bytes()})
+	assert.Nil(t, err)
+
+	expected := `{"host":"host","service":"service","state":1,"output":"WARNING - / is filling up","vars":{"a":"xyz","b":"23"},"timestamp":"2021-11-01T03:00:00Z","perfdata":[{"label":"/","value":2643,"uom":"MB","warn":5948,"crit":5958,"min":0,"max":5968},{"label":"load","value":0.5,"min":0}]}`
+	assert.Equal(t, expected, string(b))
+}
+
+func TestEncodeJSONWithoutPerfData(t *testing.T) {
+	timestamp := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	lines, err := parse("host", "service", 0, "", nil, "", timestamp)
+	assert.Nil(t, err)
+	b, err := encodeJSON(&Batch{Data: lines.Bytes()})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"host":"host","service":"service","state":0,"timestamp":"2021-11-01T03:00:00Z","perfdata":[]}`, string(b))
+}
+
+func TestEncodeJSONWithoutState(t *testing.T) {
+	// the metric lines split off by a routing rule
+	b, err := formatJSON.Encode(&Batch{Data: []byte("metric,label=/,host=h,service=s,team=ops,uom=MB value=1 1\nmetric,label=load,host=h,service=s,team=ops value=0.5 1\n")})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"host":"h","service":"s","vars":{"team":"ops"},"timestamp":"1970-01-01T00:00:00.000000001Z","perfdata":[{"label":"/","value":1,"uom":"MB"},{"label":"load","value":0.5}]}`, string(b))
+
+	var result checkResult
+	assert.Nil(t, json.Unmarshal(b, &result))
+	lines, err := result.lineProtocol()
+	assert.Nil(t, err)
+	assert.Equal(t, "metric,label=/,host=h,service=s,team=ops,uom=MB value=1 1\nmetric,label=load,host=h,service=s,team=ops value=0.5 1\n", string(lines))
+
+	_, err = formatJSON.Encode(&Batch{Data: []byte{}})
+	assert.EqualError(t, err, "failed to encode batch: batch contains no lines")
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := parseFormat("json")
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", f.ContentType())
+	f, err = parseFormat("lineprotocol")
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", f.ContentType())
+	_, err = parseFormat("xml")
+	assert.NotNil(t, err)
+}
+
+func TestCheckResultLineProtocol(t *testing.T) {
+	timestamp := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	b, err := parse("host", "service", 1, "WARNING", variableFlags{"a=xyz", "b=23"}, "/=2643MB;5948;5958;0;5968 load=0.5;;;0", timestamp)
+	assert.Nil(t, err)
+
+	result, err := checkResultFromMetrics(mustMetrics(t, b.Bytes()))
+	assert.Nil(t, err)
+	lines, err := result.lineProtocol()
+	assert.Nil(t, err)
+	assert.Equal(t, b.String(), string(lines))
+}
+
+func mustMetrics(t *testing.T, data []byte) []protocol.Metric {
+	metrics, err := (&Batch{Data: data}).Metrics()
+	assert.Nil(t, err)
+	return metrics
+}
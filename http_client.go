@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetryInterval caps the exponential backoff between retries, and the wait requested with Retry-After
+const maxRetryInterval = 30 * time.Second
+
+// httpPoster sends request bodies to HTTP write endpoints (InfluxDB, Prometheus remote write, ...). Requests that
+// fail with a network error, 429 or 5xx are retried with exponential backoff, a Retry-After header of the server
+// takes precedence over the backoff.
+type httpPoster struct {
+	client        *http.Client
+	header        http.Header
+	maxRetries    int
+	retryInterval time.Duration
+
+	// closed ends the retries of post
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newHTTPPoster configures a poster from the options timeout (per request, default 10s), max_retries (default
+// maxRetries) and retry_interval (initial backoff, doubled with every retry, default 1s)
+func newHTTPPoster(options *sinkOptions, maxRetries int) *httpPoster {
+	return &httpPoster{
+		client:        &http.Client{Timeout: options.Duration("timeout", 10*time.Second)},
+		header:        http.Header{},
+		maxRetries:    options.Int("max_retries", maxRetries),
+		retryInterval: options.Duration("retry_interval", time.Second),
+		closed:        make(chan struct{}),
+	}
+}
+
+// close stops the retries of running posts and closes the idle connections; a request in flight is not cancelled
+func (p *httpPoster) close() {
+	p.closeOnce.Do(func() { close(p.closed) })
+	p.client.CloseIdleConnections()
+}
+
+// post sends the body to the URL, retrying as described above until the poster is closed
+func (p *httpPoster) post(url string, body []byte) error {
+	for attempt := 0; ; attempt++ {
+		wait, err := p.postOnce(url, body)
+		if err == nil {
+			return nil
+		}
+		wait, retry := p.retryWait(attempt, wait)
+		if !retry {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-p.closed:
+			return err
+		}
+	}
+}
+
+// retryWait returns the backoff before retrying a request whose attempt (counted from 0) failed, given the wait
+// returned by postOnce; false means that the request is not to be retried
+func (p *httpPoster) retryWait(attempt int, wait time.Duration) (time.Duration, bool) {
+	if wait < 0 || attempt >= p.maxRetries {
+		return 0, false
+	}
+	if wait > 0 {
+		return wait, true
+	}
+	wait = p.retryInterval
+	for i := 0; i < attempt && wait < maxRetryInterval; i++ {
+		wait *= 2
+	}
+	return min(wait, maxRetryInterval), true
+}
+
+// postOnce sends a single request. When it fails, the returned duration tells whether the request may be retried:
+// negative means no, zero means after the regular backoff and positive after exactly that time (Retry-After).
+func (p *httpPoster) postOnce(url string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header = p.header.Clone()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err // network errors are worth a retry
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+	err = fmt.Errorf("write failed with %v: %s", resp.Status, bytes.TrimSpace(message))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5 {
+		return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), err
+	}
+	return -1, err
+}
+
+// parseRetryAfter interprets a Retry-After header, which is either a number of seconds or an HTTP date; it returns
+// 0 if the header is missing or invalid. The wait is capped at maxRetryInterval, so that a server cannot stall the
+// sink for hours.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return min(time.Duration(seconds)*time.Second, maxRetryInterval)
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return min(t.Sub(now), maxRetryInterval)
+	}
+	return 0
+}
+
+// ping checks an endpoint with a GET request
+func (p *httpPoster) ping(url string) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ping failed with %v", resp.Status)
+	}
+	return nil
+}
+
+// probe checks whether an endpoint that does not offer a ping (e.g. a write endpoint) is reachable: any response
+// except a server error counts
+func (p *httpPoster) probe(url string) error {
+	resp, err := p.client.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 5 {
+		return fmt.Errorf("probe failed with %v", resp.Status)
+	}
+	return nil
+}
+
+// gzipBytes compresses a request body
+func gzipBytes(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0*time.Second, parseRetryAfter("", now))
+	assert.Equal(t, 0*time.Second, parseRetryAfter("soon", now))
+	assert.Equal(t, 20*time.Second, parseRetryAfter("20", now))
+	assert.Equal(t, 25*time.Second, parseRetryAfter(now.Add(25*time.Second).Format(http.TimeFormat), now))
+	// capped at maxRetryInterval
+	assert.Equal(t, maxRetryInterval, parseRetryAfter("86400", now))
+	assert.Equal(t, maxRetryInterval, parseRetryAfter(now.Add(time.Hour).Format(http.TimeFormat), now))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusServer is the optional HTTP server of the daemon (--http):
+//
+//	/healthz      200 while the daemon accepts clients
+//	/readyz       200 if all sinks are able to deliver, 503 with the unhealthy sinks otherwise
+//	/metrics      the self-monitoring metrics in the Prometheus exposition format
+//	/debug/pprof  live profiling, see net/http/pprof
+type statusServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// startStatusServer starts serving on the address; healthy reports whether the daemon accepts clients
+func startStatusServer(address string, sink *fanOut, healthy func() error) (*statusServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, sink.Health())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheusMetrics(w, selfMetrics(sink))
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	s := &statusServer{
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("HTTP server stopped", "error", err)
+		}
+	}()
+	return s, nil
+}
+
+func writeCheck(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *statusServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *statusServer) Close() error {
+	return s.server.Close()
+}
+
+// writePrometheusMetrics writes the metrics in the Prometheus text exposition format. The names get the prefix
+// ocxp_sender_, counters the suffix _total; the metrics of the sinks are labelled with sink.
+func writePrometheusMetrics(w io.Writer, metrics []selfMetric) {
+	// all samples of a metric have to follow its HELP and TYPE lines
+	var names []string
+	byName := map[string][]selfMetric{}
+	for _, m := range metrics {
+		if _, ok := byName[m.name]; !ok {
+			names = append(names, m.name)
+		}
+		byName[m.name] = append(byName[m.name], m)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		samples := byName[name]
+		fullName := "ocxp_sender_" + name
+		if samples[0].kind == "counter" {
+			fullName += "_total"
+		}
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", fullName, samples[0].help, fullName, samples[0].kind)
+		for _, m := range samples {
+			if m.kind != "histogram" {
+				fmt.Fprintf(w, "%v%v %v\n", fullName, prometheusLabels(m.sink, ""), formatPrometheusValue(m.value))
+				continue
+			}
+			for i, bound := range m.histogram.Bounds {
+				fmt.Fprintf(w, "%v_bucket%v %d\n", fullName,
+					prometheusLabels(m.sink, formatPrometheusValue(bound)), m.histogram.Counts[i])
+			}
+			fmt.Fprintf(w, "%v_bucket%v %d\n", fullName, prometheusLabels(m.sink, "+Inf"), m.histogram.Count)
+			fmt.Fprintf(w, "%v_sum%v %v\n", fullName, prometheusLabels(m.sink, ""), formatPrometheusValue(m.histogram.Sum))
+			fmt.Fprintf(w, "%v_count%v %d\n", fullName, prometheusLabels(m.sink, ""), m.histogram.Count)
+		}
+	}
+}
+
+func prometheusLabels(sink string, le string) string {
+	var labels []string
+	if sink != "" {
+		labels = append(labels, "sink="+strconv.Quote(sink))
+	}
+	if le != "" {
+		labels = append(labels, "le="+strconv.Quote(le))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatPrometheusValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getStatus(t *testing.T, server *statusServer, path string) (int, string) {
+	response, err := http.Get("http://" + server.Addr() + path)
+	require.Nil(t, err)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	require.Nil(t, err)
+	return response.StatusCode, string(body)
+}
+
+func TestStatusServer(t *testing.T) {
+	f, err := newFanOut([]string{"test://served?alias=served&queue_retries=0"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+	var healthErr error
+	server, err := startStatusServer("127.0.0.1:0", f, func() error { return healthErr })
+	require.Nil(t, err)
+	defer server.Close()
+
+	code, body := getStatus(t, server, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+	healthErr = errors.New("not accepting clients")
+	code, _ = getStatus(t, server, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	code, _ = getStatus(t, server, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	// the health is checked again once a delivery fails
+	controlledSinkFor("served").set(func(s *controlledSink) { s.failing = true })
+	require.Nil(t, f.Publish(testBatch("h", "s")))
+	assert.Eventually(t, func() bool { return f.Status()[0].Failed == 1 }, time.Second, time.Millisecond)
+	code, body = getStatus(t, server, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "served: unavailable\n", body)
+
+	code, body = getStatus(t, server, "/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "# TYPE ocxp_sender_connections_accepted_total counter\n")
+	assert.Contains(t, body, "ocxp_sender_sink_healthy{sink=\"served\"} 0\n")
+	assert.Contains(t, body, "ocxp_sender_sink_publish_latency_seconds_bucket{sink=\"served\",le=\"+Inf\"} 0\n")
+
+	code, body = getStatus(t, server, "/debug/pprof/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "goroutine")
+}
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	var b strings.Builder
+	writePrometheusMetrics(&b, []selfMetric{
+		{name: "sink_delivered", help: "Batches delivered", kind: "counter", sink: "a", value: 2},
+		{name: "uptime_seconds", help: "Uptime", kind: "gauge", value: 1.5},
+		{name: "sink_delivered", help: "Batches delivered", kind: "counter", sink: "b", value: 3},
+		{name: "batch_lines", help: "Lines per batch", kind: "histogram",
+			histogram: histogramSnapshot{Bounds: []float64{1, 10}, Counts: []uint64{1, 3}, Sum: 12, Count: 4}},
+	})
+	assert.Equal(t, `# HELP ocxp_sender_batch_lines Lines per batch
+# TYPE ocxp_sender_batch_lines histogram
+ocxp_sender_batch_lines_bucket{le="1"} 1
+ocxp_sender_batch_lines_bucket{le="10"} 3
+ocxp_sender_batch_lines_bucket{le="+Inf"} 4
+ocxp_sender_batch_lines_sum 12
+ocxp_sender_batch_lines_count 4
+# HELP ocxp_sender_sink_delivered_total Batches delivered
+# TYPE ocxp_sender_sink_delivered_total counter
+ocxp_sender_sink_delivered_total{sink="a"} 2
+ocxp_sender_sink_delivered_total{sink="b"} 3
+# HELP ocxp_sender_uptime_seconds Uptime
+# TYPE ocxp_sender_uptime_seconds gauge
+ocxp_sender_uptime_seconds 1.5
+`, b.String())
+}
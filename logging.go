@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// logger is the logger of ocxp-sender, see setupLogging. The attributes have the same keys throughout: sink (alias of
+// the sink), client (address of the client), host and service (of the check result), error and path (of a file).
+var logger = slog.New(&rateLimitHandler{Handler: slog.NewTextHandler(os.Stderr, nil), limiter: newLogLimiter(5, time.Minute)})
+
+// logOptions are the settings of the logger from the command line
+type logOptions struct {
+	// level is debug, info, warn or error
+	level string
+	// format is logfmt or json
+	format string
+	// output is a file, syslog, or empty for stderr
+	output string
+	// maxSize is the size in MB at which the file is rotated; 0 disables rotation
+	maxSize int
+	// maxFiles is the number of rotated files that are kept
+	maxFiles int
+}
+
+// addLogFlags adds the flags of the logger; output is the default of --log-file
+func addLogFlags(flags *flag.FlagSet, options *logOptions, output string, usage string) {
+	flags.StringVar(&options.level, "log-level", "info", "minimum level of the logged messages: debug, info, warn or error")
+	flags.StringVar(&options.format, "log-format", "logfmt", "format of the log: logfmt or json")
+	flags.StringVar(&options.output, "log-file", output, usage)
+	flags.IntVar(&options.maxSize, "log-max-size", 10, "size of the log file in MB at which it is rotated; 0 disables rotation")
+	flags.IntVar(&options.maxFiles, "log-max-files", 5, "number of rotated log files that are kept")
+}
+
+// setupLogging configures the logger; the returned closer closes its output
+func setupLogging(options logOptions) (io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(options.level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", options.level)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: level}
+
+	var out io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	// writes that depend on the level of the message
+	var prioritized func(level slog.Level, p []byte) error
+	switch {
+	case options.output == "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ocxp-sender")
+		if err != nil {
+			return nil, err
+		}
+		closer = w
+		prioritized = func(level slog.Level, p []byte) error { return writeSyslog(w, level, string(p)) }
+		// syslog has its own timestamps
+		handlerOptions.ReplaceAttr = dropTime
+	case options.output != "":
+		f, err := openRotatingFile(options.output, int64(options.maxSize)*1024*1024, options.maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	case stderrIsJournal():
+		// the journal has its own timestamps, and takes the priority from a prefix, see sd-daemon(3)
+		prioritized = func(level slog.Level, p []byte) error {
+			_, err := fmt.Fprintf(os.Stderr, "<%d>%s", journalPriority(level), p)
+			return err
+		}
+		handlerOptions.ReplaceAttr = dropTime
+	}
+
+	var handler slog.Handler
+	var writer *priorityWriter
+	if prioritized != nil {
+		writer = &priorityWriter{write: prioritized}
+		out = writer
+	}
+	switch options.format {
+	case "logfmt":
+		handler = slog.NewTextHandler(out, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(out, handlerOptions)
+	default:
+		closer.Close()
+		return nil, fmt.Errorf("invalid log format %q (supported: logfmt, json)", options.format)
+	}
+	if writer != nil {
+		handler = &priorityHandler{Handler: handler, out: writer}
+	}
+	logger = slog.New(&rateLimitHandler{Handler: handler, limiter: newLogLimiter(5, time.Minute)})
+	return closer, nil
+}
+
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// stderrIsJournal reports whether stderr is connected to the journal: systemd sets JOURNAL_STREAM to its device and
+// inode, see systemd.exec(5)
+func stderrIsJournal() bool {
+	var dev, ino uint64
+	if _, err := fmt.Sscanf(os.Getenv("JOURNAL_STREAM"), "%d:%d", &dev, &ino); err != nil {
+		return false
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &stat); err != nil {
+		return false
+	}
+	return uint64(stat.Dev) == dev && uint64(stat.Ino) == ino
+}
+
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func writeSyslog(w *syslog.Writer, level slog.Level, message string) error {
+	switch {
+	case level >= slog.LevelError:
+		return w.Err(message)
+	case level >= slog.LevelWarn:
+		return w.Warning(message)
+	case level >= slog.LevelInfo:
+		return w.Info(message)
+	default:
+		return w.Debug(message)
+	}
+}
+
+// priorityWriter is the output of a handler for destinations that need the level of each message (syslog, the
+// journal); priorityHandler sets the level before the handler writes the message
+type priorityWriter struct {
+	mu    sync.Mutex
+	level slog.Level
+	write func(level slog.Level, p []byte) error
+}
+
+func (w *priorityWriter) Write(p []byte) (int, error) {
+	if err := w.write(w.level, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type priorityHandler struct {
+	slog.Handler
+	out *priorityWriter
+}
+
+func (h *priorityHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *priorityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &priorityHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h *priorityHandler) WithGroup(name string) slog.Handler {
+	return &priorityHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+// rateLimitHandler limits repeated warnings and errors: messages with the same level, text and sink are let through
+// a few times per interval, further ones are suppressed. The first message let through again tells how many were
+// suppressed.
+type rateLimitHandler struct {
+	slog.Handler
+	limiter *logLimiter
+	// sink is the sink attribute added with WithAttrs
+	sink string
+}
+
+func (h *rateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+	sink := h.sink
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "sink" {
+			sink = a.Value.String()
+			return false
+		}
+		return true
+	})
+	allowed, suppressed := h.limiter.allow(r.Level.String() + "\x00" + r.Message + "\x00" + sink)
+	if !allowed {
+		return nil
+	}
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *rateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	sink := h.sink
+	for _, a := range attrs {
+		if a.Key == "sink" {
+			sink = a.Value.String()
+		}
+	}
+	return &rateLimitHandler{Handler: h.Handler.WithAttrs(attrs), limiter: h.limiter, sink: sink}
+}
+
+func (h *rateLimitHandler) WithGroup(name string) slog.Handler {
+	return &rateLimitHandler{Handler: h.Handler.WithGroup(name), limiter: h.limiter, sink: h.sink}
+}
+
+// logLimiter counts the messages per key in windows of the interval
+type logLimiter struct {
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*logWindow
+}
+
+type logWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLogLimiter(burst int, interval time.Duration) *logLimiter {
+	return &logLimiter{burst: burst, interval: interval, now: time.Now, windows: map[string]*logWindow{}}
+}
+
+// allow reports whether a message with the key may be logged, and how many were suppressed since the last one
+func (l *logLimiter) allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	w := l.windows[key]
+	if w == nil || now.Sub(w.start) >= l.interval {
+		suppressed := 0
+		if w != nil {
+			suppressed = w.suppressed
+		}
+		l.windows[key] = &logWindow{start: now, count: 1}
+		return true, suppressed
+	}
+	if w.count < l.burst {
+		w.count++
+		return true, 0
+	}
+	w.suppressed++
+	return false, 0
+}
+
+// rotatingFile is a log file that is rotated when it would exceed maxSize: <path> is renamed to <path>.1, <path>.1 to
+// <path>.2 and so on, keeping maxFiles rotated files
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(f.path + "." + strconv.Itoa(f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+	if f.maxFiles > 0 {
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
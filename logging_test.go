@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLogLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		allowed, suppressed := l.allow("a")
+		assert.True(t, allowed)
+		assert.Equal(t, 0, suppressed)
+	}
+	for i := 0; i < 3; i++ {
+		allowed, _ := l.allow("a")
+		assert.False(t, allowed)
+	}
+	// other keys are counted separately
+	allowed, _ := l.allow("b")
+	assert.True(t, allowed)
+
+	now = now.Add(time.Minute)
+	allowed, suppressed := l.allow("a")
+	assert.True(t, allowed)
+	assert.Equal(t, 3, suppressed)
+	allowed, suppressed = l.allow("a")
+	assert.True(t, allowed)
+	assert.Equal(t, 0, suppressed)
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Unix(0, 0)
+	limiter := newLogLimiter(1, time.Minute)
+	limiter.now = func() time.Time { return now }
+	l := slog.New(&rateLimitHandler{Handler: slog.NewTextHandler(&out, &slog.HandlerOptions{ReplaceAttr: dropTime}), limiter: limiter})
+
+	l.Error("Failed to publish to sink", "sink", "a", "error", "refused")
+	l.Error("Failed to publish to sink", "sink", "a", "error", "refused")
+	l.With("sink", "b").Error("Failed to publish to sink", "error", "refused")
+	// info messages are not limited
+	l.Info("Sink status", "sink", "a")
+	l.Info("Sink status", "sink", "a")
+	now = now.Add(time.Minute)
+	l.Error("Failed to publish to sink", "sink", "a", "error", "refused")
+
+	assert.Equal(t, `level=ERROR msg="Failed to publish to sink" sink=a error=refused
+level=ERROR msg="Failed to publish to sink" sink=b error=refused
+level=INFO msg="Sink status" sink=a
+level=INFO msg="Sink status" sink=a
+level=ERROR msg="Failed to publish to sink" sink=a error=refused suppressed=1
+`, out.String())
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ocxp-sender.log")
+	f, err := openRotatingFile(path, 10, 2)
+	require.Nil(t, err)
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.Nil(t, err)
+	}
+	require.Nil(t, f.Close())
+
+	read := func(name string) string {
+		data, _ := os.ReadFile(name)
+		return string(data)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// an existing file counts towards the size
+	f, err = openRotatingFile(path, 10, 2)
+	require.Nil(t, err)
+	_, err = f.Write([]byte("fifth\n"))
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	assert.Equal(t, "fifth\n", read(path))
+	assert.Equal(t, "fourth\n", read(path+".1"))
+}
+
+func TestSetupLogging(t *testing.T) {
+	previous := logger
+	t.Cleanup(func() { logger = previous })
+	path := filepath.Join(t.TempDir(), "ocxp-sender.log")
+
+	closer, err := setupLogging(logOptions{level: "warn", format: "json", output: path, maxSize: 10, maxFiles: 5})
+	require.Nil(t, err)
+	logger.Info("Daemon started")
+	logger.Warn("Failed to notify systemd", "error", "no socket")
+	require.Nil(t, closer.Close())
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var message map[string]any
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &message))
+	assert.Equal(t, "WARN", message["level"])
+	assert.Equal(t, "Failed to notify systemd", message["msg"])
+	assert.Equal(t, "no socket", message["error"])
+
+	_, err = setupLogging(logOptions{level: "loud", format: "logfmt"})
+	assert.EqualError(t, err, `invalid log level "loud"`)
+	_, err = setupLogging(logOptions{level: "info", format: "xml"})
+	assert.EqualError(t, err, `invalid log format "xml" (supported: logfmt, json)`)
+}
@@ -2,31 +2,44 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
-	"runtime"
-	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	protocol "github.com/influxdata/line-protocol"
 	flag "github.com/spf13/pflag"
-	"github.com/streadway/amqp"
 )
 
 const ExchangeName = "naemon"
 const DaemonAddress = "127.0.0.1:55550"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveCommand(os.Args[2:])
+		return
+	}
+	for _, command := range controlCommands {
+		if len(os.Args) > 1 && os.Args[1] == command {
+			controlCommand(command, os.Args[2:])
+			return
+		}
+	}
+
 	var host string
 	var service string
 	var output string
@@ -34,51 +47,60 @@ func main() {
 	var variableFlags variableFlags
 	var perfData string
 	var daemonize bool
-	var amqpURL string
-	var cpuprofile string
-	var memprofile string
+	var sinkURLs []string
+	var configPath string
+	var httpAddress string
+	var controlAddress string
+	var spoolDir string
+	var shutdownTimeout time.Duration
+	var inactivityTimeout time.Duration
+	var logging logOptions
+	var spawnTimeout time.Duration
+	var readyFD int
+	var fallbacks []string
 	flag.VarP(&variableFlags, "var", "v", "variables in the form \"name=value\" (multiple -v allowed); get forwarded as tags")
 	flag.StringVarP(&host, "host", "h", "", "Name of host")
 	flag.StringVarP(&service, "service", "s", "", "Name of service")
 	flag.IntVarP(&state, "state", "t", 0, "State of the check")
 	flag.StringVarP(&output, "output", "o", "", "Output of the check result (optional)")
 	flag.StringVarP(&perfData, "perfdata", "p", "", "Performance data")
-	flag.StringVarP(&amqpURL, "amqp-url", "u", "amqp://localhost:5672", "URL of the AMQP (e.g. RabbitMQ) server to send the data to")
+	flag.StringArrayVarP(&sinkURLs, "url", "u", []string{"amqp://localhost:5672"}, "URL of the sink to send the data to; the scheme selects the sink (e.g. amqp:// for RabbitMQ); multiple -u send the data to all of them")
+	flag.StringVarP(&configPath, "config", "c", "", "Configuration file of the daemon (sinks, routing rules)")
+	flag.StringVarP(&controlAddress, "control", "", ControlAddress, "Address of the control channel of the daemon (see the status, stop, flush and reload subcommands); disabled if empty")
+	flag.StringVarP(&spoolDir, "spool-dir", "", "", "Directory in which the daemon keeps the batches it could not deliver before it stopped, to deliver them when it starts again")
+	flag.DurationVarP(&shutdownTimeout, "shutdown-timeout", "", 15*time.Second, "How long the stopping daemon waits for clients and deliveries")
+	flag.DurationVarP(&inactivityTimeout, "inactivity-timeout", "", 6*time.Minute, "How long the daemon runs without receiving data before it stops; 0 disables it")
+	addLogFlags(flag.CommandLine, &logging, filepath.Join(os.TempDir(), "ocxp-sender.log"), "File the daemon logs to, or syslog; stderr if empty. Clients always log to stderr")
+	flag.DurationVarP(&spawnTimeout, "spawn-timeout", "", 10*time.Second, "How long to wait for a spawned daemon to accept the data")
+	flag.StringSliceVarP(&fallbacks, "fallback", "", nil, "What to do with the data if the daemon is unavailable, tried in order: drop (into the drop directory of --spool-dir, for the daemon) and/or publish (to the sinks directly)")
+	flag.IntVarP(&readyFD, "ready-fd", "", 0, "File descriptor on which the daemon reports that it is ready (set by the spawning client)")
+	flag.CommandLine.MarkHidden("ready-fd")
 	flag.BoolVarP(&daemonize, "daemonize", "d", false, "Whether or not to spawn a daemon process that runs infinitely")
-	flag.StringVarP(&cpuprofile, "cpuprofile", "", "", "write cpu profile to `file`")
-	flag.StringVarP(&memprofile, "memprofile", "", "", "write memory profile to `file`")
+	flag.StringVarP(&httpAddress, "http", "", "", "Address the daemon serves health checks, metrics and profiling on over HTTP (e.g. 127.0.0.1:9550); disabled if empty")
+	flag.CommandLine.SetNormalizeFunc(normalizeFlagName)
 	flag.Parse()
 
 	if daemonize { // run as daemon
-		if cpuprofile != "" {
-			f, err := os.Create(cpuprofile)
-			if err != nil {
-				log.Fatal("could not create CPU profile: ", err)
-			}
-			defer f.Close() // error handling omitted for example
-			if err := pprof.StartCPUProfile(f); err != nil {
-				log.Fatal("could not start CPU profile: ", err)
-			}
-			defer pprof.StopCPUProfile()
-		}
-
-		fmt.Println("Running daemon...")
-		runDaemon(DaemonAddress, amqpURL, 6*time.Minute)
-		fmt.Println("Stopping daemon")
-
-		if memprofile != "" {
-			f, err := os.Create(memprofile)
-			if err != nil {
-				log.Fatal("could not create memory profile: ", err)
-			}
-			defer f.Close() // error handling omitted for example
-			runtime.GC()    // get up-to-date statistics
-			if err := pprof.WriteHeapProfile(f); err != nil {
-				log.Fatal("could not write memory profile: ", err)
-			}
-		}
-
+		closer, err := setupLogging(logging)
+		failOnError(err, "Failed to setup logging")
+		defer closer.Close()
+		runDaemon(daemonOptions{
+			listenAddress:     DaemonAddress,
+			sinkURLs:          sinkURLs,
+			configPath:        configPath,
+			httpAddress:       httpAddress,
+			controlAddress:    controlAddress,
+			spoolDir:          spoolDir,
+			inactivityTimeout: inactivityTimeout,
+			shutdownTimeout:   shutdownTimeout,
+			readyFD:           readyFD,
+		})
 	} else { // run as regular program that sends its metrics to the daemon
+		clientLogging := logging
+		clientLogging.output = ""
+		_, err := setupLogging(clientLogging)
+		failOnError(err, "Failed to setup logging")
+
 		if !isFlagPassed("host") {
 			fail("host name not set")
 		}
@@ -92,107 +114,345 @@ func main() {
 			fail("Performance data not set")
 		}
 
+		fallback := fallbackOptions{
+			methods:    fallbacks,
+			spoolDir:   spoolDir,
+			sinkURLs:   sinkURLs,
+			configPath: configPath,
+			timeout:    spawnTimeout,
+		}
+		failOnError(fallback.validate(), "Invalid --fallback")
+
 		b, err := parse(host, service, state, output, variableFlags, perfData, time.Now())
 		failOnError(err, "Failed to parse inputs")
 
 		// only publish if there are actually metrics/perfdata
 		if b.Len() > 0 {
-			// fmt.Println("Sending:")
-			//fmt.Println(b.String())
-
-			conn, err := net.Dial("tcp", DaemonAddress)
-			if err == nil { // try to connect to already running daemon
-				defer conn.Close()
-				// write to socket
-				_, err = conn.Write(b.Bytes())
-				failOnError(err, "Failed to write")
-			} else {
-				fmt.Println("Trying to spawn daemon")
-
-				// spawn daemon
-				binary, err := exec.LookPath(os.Args[0])
-				failOnError(err, "Failed to lookup binary")
-				_, _ = os.StartProcess(binary, []string{binary, "-d", "-u", amqpURL}, &os.ProcAttr{Dir: "", Env: nil,
-					Files: []*os.File{nil, nil, nil}, Sys: nil})
-
-				// we don't fail when daemon start failed, because maybe another run has started it successfully
-				// failOnError(err, "Failed to spawn daemon")
-
-				// give daemon time to startup
-				time.Sleep(500 * time.Millisecond)
-
-				// try to connect and send one more time
-				conn, err := net.Dial("tcp", DaemonAddress)
-				failOnError(err, "Failed to connect to daemon")
-				defer conn.Close()
-				_, err = conn.Write(b.Bytes())
-				failOnError(err, "Failed to write")
+			args := []string{"-d"}
+			for _, sinkURL := range sinkURLs {
+				args = append(args, "-u", sinkURL)
+			}
+			if configPath != "" {
+				args = append(args, "-c", configPath)
+			}
+			if httpAddress != "" {
+				args = append(args, "--http", httpAddress)
+			}
+			if isFlagPassed("control") {
+				args = append(args, "--control", controlAddress)
+			}
+			if spoolDir != "" {
+				args = append(args, "--spool-dir", spoolDir)
+			}
+			if isFlagPassed("shutdown-timeout") {
+				args = append(args, "--shutdown-timeout", shutdownTimeout.String())
+			}
+			if isFlagPassed("inactivity-timeout") {
+				args = append(args, "--inactivity-timeout", inactivityTimeout.String())
+			}
+			args = append(args, "--log-file", logging.output)
+			for _, name := range []string{"log-level", "log-format", "log-max-size", "log-max-files"} {
+				if isFlagPassed(name) {
+					args = append(args, "--"+name, flag.Lookup(name).Value.String())
+				}
+			}
+			err = deliverToDaemon(DaemonAddress, b.Bytes(), spawnOptions{
+				args:     args,
+				logPath:  logging.output,
+				lockPath: defaultSpawnLockPath,
+				timeout:  spawnTimeout,
+			})
+			if err != nil {
+				os.Exit(fallBack(b.Bytes(), err, fallback))
 			}
 		}
 	}
 }
 
-func runDaemon(listenAddress string, amqpURL string, inactivityTimeout time.Duration) {
+// daemonOptions are the settings of the daemon from the command line
+type daemonOptions struct {
+	listenAddress string
+	sinkURLs      []string
+	configPath    string
+	// httpAddress is the address of the status server; empty disables it
+	httpAddress string
+	// controlAddress is the address of the control channel; empty disables it
+	controlAddress string
+	// spoolDir keeps the batches that could not be delivered before the daemon stopped; empty drops them
+	spoolDir string
+	// inactivityTimeout stops the daemon if it receives no data for this long; 0 disables it
+	inactivityTimeout time.Duration
+	// shutdownTimeout is how long the daemon waits for clients and deliveries when it stops
+	shutdownTimeout time.Duration
+	// readyFD is the pipe of the spawning client, see signalReady; 0 if the daemon was not spawned
+	readyFD int
+}
+
+func runDaemon(options daemonOptions) {
+	configPath, inactivityTimeout := options.configPath, options.inactivityTimeout
 
-	// setup TCP server
-	connection, err := net.Listen("tcp", listenAddress)
+	// setup TCP server, or take over the socket of systemd
+	connection, err := listen(options.listenAddress)
 	failOnError(err, "Failed to listen on port")
 	defer connection.Close()
-
-	// setup amqp connection
-	amqpConnection, err := amqp.Dial(amqpURL)
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer amqpConnection.Close()
-	channel, err := amqpConnection.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer channel.Close()
-	err = channel.ExchangeDeclare(
-		ExchangeName, // name
-		"fanout",     // type
-		true,         // durable
-		false,        // auto-deleted
-		false,        // internal
-		false,        // no-wait
-		nil,          // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
+	var accepting atomic.Bool
+	accepting.Store(true)
 
 	errorChan := make(chan error, 1)
 	heartbeatChan := make(chan bool, 1)
 
+	cfg := &config{}
+	if configPath != "" {
+		cfg, err = loadConfig(configPath)
+		failOnError(err, "Failed to load configuration")
+	}
+
+	// setup sinks, e.g. the amqp connection; they connect in the background, so that the daemon accepts data even if a
+	// backend is unavailable
+	sink := &fanOut{failures: errorChan, connectLazily: true}
+	failOnError(sink.configure(cfg.sinkURLs(options.sinkURLs), cfg), "Failed to setup sink")
+	defer func() {
+		sink.Close()
+		logSinkStatus(sink)
+		logger.Info("Daemon stopped")
+	}()
+	// the data dropped by clients while the daemon was unavailable is taken in at the start and then every minute
+	var dropped <-chan time.Time
+	var spool *spool
+	if options.spoolDir != "" {
+		spool, err = openSpool(options.spoolDir)
+		failOnError(err, "Failed to open spool directory")
+		failOnError(sink.useSpool(spool), "Failed to read spool")
+		ingestDropped(spool, sink)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		dropped = ticker.C
+	}
+
 	// signal handling to allow graceful exit
 	stopSignal := make(chan os.Signal, 1)
 	signal.Notify(stopSignal, os.Interrupt, syscall.SIGTERM)
+	statusSignal := make(chan os.Signal, 1)
+	signal.Notify(statusSignal, syscall.SIGUSR1)
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
 
+	clients := newActiveClients()
 	go func() {
 		for {
 			conn, err := connection.Accept()
 			if err != nil {
-				errorChan <- err
+				// on shutdown, the listener is closed on purpose
+				if accepting.Swap(false) {
+					errorChan <- err
+				}
 				return
 			}
+			stats.connections.Add(1)
 
-			go handleClient(conn, channel, errorChan, heartbeatChan)
+			clients.add(conn)
+			go func() {
+				defer clients.remove(conn)
+				handleClient(conn, sink, errorChan, heartbeatChan)
+			}()
 		}
 	}()
 
-	inactivityTimer := time.NewTimer(inactivityTimeout)
+	if options.httpAddress != "" {
+		server, err := startStatusServer(options.httpAddress, sink, func() error {
+			if !accepting.Load() {
+				return errors.New("not accepting clients")
+			}
+			return nil
+		})
+		failOnError(err, "Failed to start HTTP server")
+		defer server.Close()
+	}
+
+	// requests of the control channel; a nil channel never delivers
+	var controlRequests chan controlRequest
+	if options.controlAddress != "" {
+		control, err := startControlServer(options.controlAddress)
+		failOnError(err, "Failed to listen on control port")
+		defer control.Close()
+		controlRequests = control.requests
+	}
+
+	monitor := startSelfMonitor(sink, cfg.SelfMonitoring)
+
+	reload := func() error {
+		notify("RELOADING=1")
+		defer notify("READY=1")
+		cfg, err := reloadConfig(configPath, options.sinkURLs, sink)
+		if err != nil {
+			return err
+		}
+		monitor.stop()
+		monitor = startSelfMonitor(sink, cfg.SelfMonitoring)
+		return nil
+	}
+
+	// a nil channel never delivers, which disables the timeout or the watchdog
+	var inactivityTimer *time.Timer
+	var inactivity <-chan time.Time
+	if inactivityTimeout > 0 {
+		inactivityTimer = time.NewTimer(inactivityTimeout)
+		inactivity = inactivityTimer.C
+	}
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	notify("READY=1\nSTATUS=Accepting check results on " + connection.Addr().String())
+	signalReady(options.readyFD)
+	logger.Info("Daemon started", "pid", os.Getpid(), "address", connection.Addr().String())
 L:
 	for {
-		inactivityTimer.Reset(inactivityTimeout)
 		select {
 		case err = <-errorChan:
-			fmt.Printf("Encountered error while processing message: %v", err)
+			logger.Error("Stopping after an error", "error", err)
 			break L
-		case <-heartbeatChan: // heartbeat encountered, continue loop and restart select
-		case <-inactivityTimer.C:
-			fmt.Println("Reached inactivity timeout, closing...")
+		case <-heartbeatChan: // heartbeat encountered, restart the inactivity timeout
+			// only received data counts as activity: the other cases (signals, the watchdog, control requests)
+			// must not keep an idle daemon alive
+			if inactivityTimer != nil {
+				inactivityTimer.Reset(inactivityTimeout)
+			}
+		case <-inactivity:
+			logger.Info("Stopping after the inactivity timeout", "timeout", inactivityTimeout)
 			break L
 		case <-stopSignal:
-			fmt.Println("Received stop signal, closing...")
+			logger.Info("Stopping on signal")
 			break L
+		case <-statusSignal:
+			logSinkStatus(sink)
+		case <-reloadSignal:
+			if err := reload(); err != nil {
+				logger.Error("Failed to reload configuration, keeping the current one", "path", configPath, "error", err)
+			}
+		case <-watchdog:
+			notify("WATCHDOG=1")
+		case <-dropped:
+			sink.takeSpooled()
+			ingestDropped(spool, sink)
+		case request := <-controlRequests:
+			if request.command == "stop" {
+				logger.Info("Stopping on command")
+				request.reply <- controlResponse{Message: "Stopping daemon", PID: os.Getpid()}
+				break L
+			}
+			handleControlRequest(request, sink, reload)
+		}
+
+	}
+
+	// graceful shutdown: accept no more clients, let the active ones finish, deliver what is queued; the deferred
+	// close of the sinks spools what is left and closes the connections
+	deadline := time.Now().Add(options.shutdownTimeout)
+	notify("STOPPING=1")
+	accepting.Store(false)
+	connection.Close()
+	if cutOff := clients.wait(deadline); cutOff > 0 {
+		logger.Warn("Cut off clients that did not finish within the shutdown timeout", "clients", cutOff)
+	}
+	monitor.stop()
+	if err := sink.Flush(time.Until(deadline)); err != nil {
+		logger.Warn("Not all batches were delivered within the shutdown timeout", "error", err)
+	}
+}
+
+// ingestDropped publishes the data that clients dropped into the spool while the daemon was unavailable, as much as
+// the queues of the sinks have room for; the rest stays in the spool for the next time
+func ingestDropped(spool *spool, sink *fanOut) {
+	batches, err := spool.takeDropped(sink.room())
+	if err != nil {
+		logger.Error("Failed to read the data dropped by clients", "path", spool.incomingDir(), "error", err)
+	}
+	for _, batch := range batches {
+		stats.received(batch.Data)
+		if err := sink.Publish(batch); err != nil {
+			logger.Error("Failed to publish the data dropped by a client", "error", err)
 		}
+	}
+	if len(batches) > 0 {
+		logger.Info("Took in the data dropped by clients", "batches", len(batches))
+	}
+}
+
+// notify passes the state of the daemon on to systemd, if it runs as its service
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		logger.Warn("Failed to notify systemd", "error", err)
+	}
+}
+
+// reloadConfig applies the sinks and the pipeline (tags, lookup file, relabel steps, cardinality limits and routing
+// rules) of the configuration file and returns the configuration; commandLine are the sinks given with -u. An invalid
+// configuration is rejected and the current one stays in place.
+func reloadConfig(configPath string, commandLine []string, sink *fanOut) (*config, error) {
+	if configPath == "" {
+		return nil, errors.New("no configuration file to reload")
+	}
+	cfg, err := loadConfig(configPath)
+	if err == nil {
+		err = sink.configure(cfg.sinkURLs(commandLine), cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Reloaded sinks, tags, lookup file, relabel steps, cardinality limits, routing rules and self-monitoring", "path", configPath)
+	return cfg, nil
+}
 
+// handleControlRequest answers the commands of the control channel except stop. A flush runs in the background, so
+// the daemon keeps serving clients meanwhile.
+func handleControlRequest(request controlRequest, sink *fanOut, reload func() error) {
+	switch request.command {
+	case "status":
+		request.reply <- controlResponse{Status: newDaemonStatus(sink)}
+	case "reload":
+		if err := reload(); err != nil {
+			request.reply <- controlResponse{Error: "failed to reload configuration, keeping the current one: " + err.Error()}
+			return
+		}
+		request.reply <- controlResponse{Message: "Reloaded configuration"}
+	case "flush":
+		timeout := 30 * time.Second
+		if len(request.args) > 0 {
+			d, err := time.ParseDuration(request.args[0])
+			if err == nil && d < 0 {
+				err = errors.New("must not be negative")
+			}
+			if err != nil {
+				request.reply <- controlResponse{Error: fmt.Sprintf("invalid flush timeout %q: %v", request.args[0], err)}
+				return
+			}
+			timeout = d
+		}
+		go func() {
+			if err := sink.Flush(timeout); err != nil {
+				request.reply <- controlResponse{Error: err.Error()}
+				return
+			}
+			request.reply <- controlResponse{Message: "Flushed all sinks"}
+		}()
+	default:
+		request.reply <- controlResponse{Error: fmt.Sprintf("unknown command %q", request.command)}
+	}
+}
+
+// logSinkStatus logs the delivery status of every sink and the tags that exceed their cardinality limit
+func logSinkStatus(sink *fanOut) {
+	for _, s := range sink.Status() {
+		logger.Info("Sink status", "sink", s.Alias, "healthy", s.Healthy, "queued", s.Queued, "delivered", s.Delivered,
+			"filtered", s.Filtered, "retried", s.Retried, "failed", s.Failed, "dropped", s.Dropped, "spooled", s.Spooled,
+			"recoveries", s.Recoveries, "reconnects", s.Reconnects, "last_error", s.LastError)
+	}
+	for _, o := range sink.Offenders() {
+		logger.Info("Cardinality limit exceeded", "host", o.Host, "service", o.Service, "tag", o.Tag, "lines", o.Lines)
 	}
 }
 
@@ -210,17 +470,19 @@ var bufPool = sync.Pool{
 	},
 }
 
-func handleClient(conn net.Conn, channel *amqp.Channel, doneChan chan error, heartbeatChan chan bool) {
+func handleClient(conn net.Conn, sink Sink, doneChan chan error, heartbeatChan chan bool) {
 	defer conn.Close()
 
 	buffer := bufPool.Get().(*Buffer)
+	buffer.B = buffer.B[:0]
 	tmp := bufPool.Get().(*Buffer)
 	n := 0
 	for {
 		tmpN, err := conn.Read(tmp.B)
 		if err != nil {
 			if err != io.EOF {
-				doneChan <- err
+				logger.Error("Failed to read from client", "client", conn.RemoteAddr().String(), "error", err)
+				reportError(doneChan, err)
 				return
 			}
 			break
@@ -229,30 +491,84 @@ func handleClient(conn net.Conn, channel *amqp.Channel, doneChan chan error, hea
 		n += tmpN
 	}
 	bufPool.Put(tmp)
+	// nothing to publish, e.g. a probe of the port
+	if n == 0 {
+		bufPool.Put(buffer)
+		return
+	}
 
-	received := buffer.B[:n]
-
-	// NOTE: we assume that amqp.Channel and its publish method are thread safe and one channel can be used in multiple goroutines
-	// the documentation is not 100% clear on this, but there seems to be a proper lock/mutex in place:
-	// https://github.com/streadway/amqp/blob/master/channel.go#L1331
-	err := channel.Publish(
-		ExchangeName, // exchange
-		"",           // routing key
-		false,        // mandatory
-		false,        // immediate
-		amqp.Publishing{
-			ContentType:  "text/plain",
-			Body:         received,
-			DeliveryMode: 2,
-		})
+	// the buffer goes back into the pool, so the batch gets its own copy of the received data
+	batch := &Batch{Data: append([]byte(nil), buffer.B[:n]...)}
+	bufPool.Put(buffer)
+	stats.received(batch.Data)
+
+	err := sink.Publish(batch)
 	if err != nil {
-		doneChan <- err
+		reportError(doneChan, err)
 		return
 	}
 
-	bufPool.Put(buffer)
+	// a pending heartbeat is as good as a new one
+	select {
+	case heartbeatChan <- true:
+	default:
+	}
+}
 
-	heartbeatChan <- true
+// reportError passes an error on to the daemon, unless another one is pending; the daemon stops on the first error
+func reportError(errorChan chan error, err error) {
+	select {
+	case errorChan <- err:
+	default:
+	}
+}
+
+// activeClients tracks the connections of the clients, so that the daemon can wait for them when it stops
+type activeClients struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newActiveClients() *activeClients {
+	return &activeClients{conns: map[net.Conn]bool{}}
+}
+
+func (c *activeClients) add(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[conn] = true
+	c.wg.Add(1)
+}
+
+func (c *activeClients) remove(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+	c.wg.Done()
+}
+
+// wait waits for the clients to finish until the deadline; then it closes the remaining connections and returns their
+// number
+func (c *activeClients) wait(deadline time.Time) int {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(time.Until(deadline)):
+	}
+	c.mu.Lock()
+	cutOff := len(c.conns)
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+	<-done
+	return cutOff
 }
 
 func parse(host string, service string, state int, output string, variableFlags variableFlags, perfData string, timestamp time.Time) (*bytes.Buffer, error) {
@@ -316,7 +632,7 @@ func encodePerfData(str string, addedTags []*protocol.Tag, timestamp time.Time,
 
 		v, err := strconv.ParseFloat(perfSlice[2], 64)
 		if err != nil {
-			fmt.Println(err)
+			logger.Warn("Skipped performance data value", "label", label, "error", err)
 			continue
 		}
 
@@ -386,12 +702,14 @@ func (m Metric) FieldList() []*protocol.Field {
 
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Fatalf("%s: %s", msg, err)
+		logger.Error(msg, "error", err)
+		os.Exit(exitFailed)
 	}
 }
 
 func fail(msg string) {
-	log.Fatalf("%s", msg)
+	logger.Error(msg)
+	os.Exit(exitFailed)
 }
 
 type variableFlags []string
@@ -408,6 +726,15 @@ func (i *variableFlags) Type() string {
 	return "string"
 }
 
+// normalizeFlagName keeps deprecated flag names working
+func normalizeFlagName(f *flag.FlagSet, name string) flag.NormalizedName {
+	switch name {
+	case "amqp-url":
+		name = "url"
+	}
+	return flag.NormalizedName(name)
+}
+
 func isFlagPassed(name string) bool {
 	found := false
 	flag.Visit(func(f *flag.Flag) {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io"
+	"net"
 	"testing"
 	"time"
 
@@ -36,6 +38,43 @@ func TestOutput(t *testing.T) {
 	assert.Equal(t, expected, b.String())
 }
 
+func TestActiveClientsWait(t *testing.T) {
+	clients := newActiveClients()
+	// a client is handled until its connection is closed
+	handle := func(conn net.Conn) {
+		clients.add(conn)
+		go func() {
+			defer clients.remove(conn)
+			io.Copy(io.Discard, conn)
+		}()
+	}
+	assert.Equal(t, 0, clients.wait(time.Now().Add(time.Second)))
+
+	finished, finishedPeer := net.Pipe()
+	handle(finished)
+	stuck, stuckPeer := net.Pipe()
+	defer stuckPeer.Close()
+	handle(stuck)
+	finishedPeer.Close()
+
+	start := time.Now()
+	assert.Equal(t, 1, clients.wait(time.Now().Add(50*time.Millisecond)))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestHandleClientWithoutData(t *testing.T) {
+	sink := &controlledSink{}
+	done := make(chan error, 1)
+	heartbeat := make(chan bool, 1)
+	conn, peer := net.Pipe()
+	peer.Close()
+
+	handleClient(conn, sink, done, heartbeat)
+	assert.Equal(t, 0, sink.count())
+	assert.Empty(t, done)
+	assert.Empty(t, heartbeat)
+}
+
 func BenchmarkParse(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, _ = parse("host", "service", 0, "", variableFlags{"a=xyz", "b=23", "c=asd"}, "/=2643MB;5948;5958;0;5968", time.Now())
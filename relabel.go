@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// relabelConfig is a relabeling step of the configuration file. It works like Prometheus' relabel_config: the tags of
+// a line are its labels, the measurement is the label __name__.
+type relabelConfig struct {
+	// Action is one of replace (default), keep, drop, labelmap, labeldrop, labelkeep, hashmod, lowercase and uppercase
+	Action       string   `yaml:"action"`
+	SourceLabels []string `yaml:"source_labels"`
+	// Separator joins the values of the source labels (default ";")
+	Separator *string `yaml:"separator"`
+	// Regex is matched against the joined source values, or the label names for labelmap, labeldrop and labelkeep; it
+	// is anchored at both ends (default "(.*)")
+	Regex *string `yaml:"regex"`
+	// TargetLabel receives the result of replace, hashmod, lowercase and uppercase
+	TargetLabel string `yaml:"target_label"`
+	// Replacement is the value (replace) or label name (labelmap) written, with $1 etc. referring to the groups of
+	// the regex (default "$1")
+	Replacement *string `yaml:"replacement"`
+	// Modulus of hashmod
+	Modulus uint64 `yaml:"modulus"`
+}
+
+// relabelRule is a compiled relabelConfig
+type relabelRule struct {
+	action       string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	modulus      uint64
+}
+
+// relabeler rewrites the tags of the lines of batches, or drops lines, as configured by the relabel steps. The steps
+// are applied in order to every line; labels starting with "__" (except __name__) can be used as temporary labels
+// between steps and are removed afterwards.
+type relabeler struct {
+	rules []relabelRule
+}
+
+func newRelabeler(configs []relabelConfig) (*relabeler, error) {
+	r := &relabeler{}
+	for i, config := range configs {
+		rule, err := compileRelabelConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("relabel step %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func compileRelabelConfig(config relabelConfig) (relabelRule, error) {
+	rule := relabelRule{
+		action:       config.Action,
+		sourceLabels: config.SourceLabels,
+		separator:    ";",
+		targetLabel:  config.TargetLabel,
+		replacement:  "$1",
+		modulus:      config.Modulus,
+	}
+	if rule.action == "" {
+		rule.action = "replace"
+	}
+	if config.Separator != nil {
+		rule.separator = *config.Separator
+	}
+	if config.Replacement != nil {
+		rule.replacement = *config.Replacement
+	}
+	expr := "(.*)"
+	if config.Regex != nil {
+		expr = *config.Regex
+	}
+	var err error
+	if rule.regex, err = regexp.Compile("^(?:" + expr + ")$"); err != nil {
+		return rule, err
+	}
+
+	switch rule.action {
+	case "replace", "hashmod", "lowercase", "uppercase":
+		if rule.targetLabel == "" {
+			return rule, fmt.Errorf("%v requires a target_label", rule.action)
+		}
+		if rule.action == "hashmod" && rule.modulus == 0 {
+			return rule, fmt.Errorf("hashmod requires a modulus")
+		}
+	case "keep", "drop":
+		if len(rule.sourceLabels) == 0 {
+			return rule, fmt.Errorf("%v requires source_labels", rule.action)
+		}
+	case "labelmap", "labeldrop", "labelkeep":
+	default:
+		return rule, fmt.Errorf("unknown action %q", rule.action)
+	}
+	return rule, nil
+}
+
+// labelSet is the tags of a line plus __name__, in the order of the line
+type labelSet []*protocol.Tag
+
+func (l labelSet) get(name string) string {
+	for _, tag := range l {
+		if tag.Key == name {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// set sets a label; an empty value removes it
+func (l labelSet) set(name string, value string) labelSet {
+	for i, tag := range l {
+		if tag.Key == name {
+			if value == "" {
+				return append(l[:i:i], l[i+1:]...)
+			}
+			l[i] = &protocol.Tag{Key: name, Value: value}
+			return l
+		}
+	}
+	if value == "" {
+		return l
+	}
+	return append(l, &protocol.Tag{Key: name, Value: value})
+}
+
+// apply runs the step on the labels; it returns false if the line is to be dropped
+func (r *relabelRule) apply(labels labelSet) (labelSet, bool) {
+	values := make([]string, 0, len(r.sourceLabels))
+	for _, name := range r.sourceLabels {
+		values = append(values, labels.get(name))
+	}
+	value := strings.Join(values, r.separator)
+
+	switch r.action {
+	case "replace":
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			break
+		}
+		target := string(r.regex.ExpandString(nil, r.targetLabel, value, match))
+		replacement := string(r.regex.ExpandString(nil, r.replacement, value, match))
+		labels = labels.set(target, replacement)
+	case "keep":
+		if !r.regex.MatchString(value) {
+			return nil, false
+		}
+	case "drop":
+		if r.regex.MatchString(value) {
+			return nil, false
+		}
+	case "hashmod":
+		sum := md5.Sum([]byte(value))
+		labels = labels.set(r.targetLabel, fmt.Sprint(binary.BigEndian.Uint64(sum[8:])%r.modulus))
+	case "lowercase":
+		labels = labels.set(r.targetLabel, strings.ToLower(value))
+	case "uppercase":
+		labels = labels.set(r.targetLabel, strings.ToUpper(value))
+	case "labelmap":
+		for _, tag := range append(labelSet(nil), labels...) {
+			if r.regex.MatchString(tag.Key) {
+				labels = labels.set(r.regex.ReplaceAllString(tag.Key, r.replacement), tag.Value)
+			}
+		}
+	case "labeldrop", "labelkeep":
+		kept := labels[:0:0]
+		for _, tag := range labels {
+			if tag.Key == "__name__" || r.regex.MatchString(tag.Key) == (r.action == "labelkeep") {
+				kept = append(kept, tag)
+			}
+		}
+		labels = kept
+	}
+	return labels, true
+}
+
+// relabelMetric runs all steps on a line; it returns false if the line is dropped
+func (r *relabeler) relabelMetric(m protocol.Metric) (protocol.Metric, bool) {
+	labels := append(labelSet{{Key: "__name__", Value: m.Name()}}, m.TagList()...)
+	for i := range r.rules {
+		var keep bool
+		if labels, keep = r.rules[i].apply(labels); !keep {
+			return nil, false
+		}
+	}
+
+	name := labels.get("__name__")
+	if name == "" {
+		return nil, false
+	}
+	tags := make([]*protocol.Tag, 0, len(labels))
+	for _, tag := range labels {
+		if !strings.HasPrefix(tag.Key, "__") {
+			tags = append(tags, tag)
+		}
+	}
+	return Metric{name: name, tags: tags, fields: m.FieldList(), timestamp: m.Time()}, true
+}
+
+// apply relabels the lines of the batch; it returns nil if all lines were dropped
+func (r *relabeler) apply(batch *Batch) (*Batch, error) {
+	if len(r.rules) == 0 {
+		return batch, nil
+	}
+	return rewriteBatch(batch, r.relabelMetric)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func testRelabeler(t *testing.T, steps string) *relabeler {
+	var configs []relabelConfig
+	require.Nil(t, yaml.Unmarshal([]byte(steps), &configs))
+	r, err := newRelabeler(configs)
+	require.Nil(t, err)
+	return r
+}
+
+// relabeledLines returns the lines of the relabeled batch, or nil if all were dropped
+func relabeledLines(t *testing.T, r *relabeler, data string) []string {
+	batch, err := r.apply(&Batch{Data: []byte(data)})
+	require.Nil(t, err)
+	if batch == nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(batch.Data), "\n"), "\n")
+}
+
+func TestRelabelActions(t *testing.T) {
+	line := "metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod value=1.2 1\n"
+	tests := []struct {
+		name     string
+		steps    string
+		expected []string
+	}{
+		{"replace", `
+- source_labels: [host]
+  regex: '([^.]+)\..*'
+  target_label: host`,
+			[]string{"metric,host=Web1,label=rta,service=ping,var_env=prod value=1.2 1"}},
+		{"replace with separator and new label", `
+- source_labels: [service, label]
+  separator: _
+  target_label: series
+  replacement: s_$1`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod,series=s_ping_rta value=1.2 1"}},
+		{"replace without match", `
+- source_labels: [service]
+  regex: http
+  target_label: service
+  replacement: web`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod value=1.2 1"}},
+		{"replace with empty value removes the label", `
+- target_label: var_env
+  replacement: ''`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping value=1.2 1"}},
+		{"measurement", `
+- source_labels: [__name__]
+  target_label: __name__
+  replacement: naemon_$1`,
+			[]string{"naemon_metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod value=1.2 1"}},
+		{"lowercase", `
+- source_labels: [host]
+  target_label: host
+  action: lowercase`,
+			[]string{"metric,host=web1.example.com,label=rta,service=ping,var_env=prod value=1.2 1"}},
+		{"keep", `
+- source_labels: [service]
+  regex: ping|http
+  action: keep`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod value=1.2 1"}},
+		{"keep drops", `
+- source_labels: [service]
+  regex: http
+  action: keep`,
+			nil},
+		{"drop", `
+- source_labels: [var_env]
+  regex: prod
+  action: drop`,
+			nil},
+		{"labelmap", `
+- regex: var_(.+)
+  action: labelmap`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod,env=prod value=1.2 1"}},
+		{"labeldrop", `
+- regex: var_.*
+  action: labeldrop`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping value=1.2 1"}},
+		{"labelkeep", `
+- regex: host|service
+  action: labelkeep`,
+			[]string{"metric,host=Web1.Example.COM,service=ping value=1.2 1"}},
+		{"hashmod and temporary labels", `
+- source_labels: [host]
+  target_label: __shard
+  modulus: 4
+  action: hashmod
+- source_labels: [__shard]
+  regex: '[0-2]'
+  action: keep
+- source_labels: [__shard]
+  target_label: shard`,
+			[]string{"metric,host=Web1.Example.COM,label=rta,service=ping,var_env=prod,shard=1 value=1.2 1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, relabeledLines(t, testRelabeler(t, test.steps), line))
+		})
+	}
+}
+
+func TestRelabelDropsSingleLines(t *testing.T) {
+	r := testRelabeler(t, `
+- source_labels: [__name__, label]
+  regex: metric;pl
+  action: drop`)
+	assert.Equal(t, []string{
+		"metric,host=web1,label=rta,service=ping value=1.2 1",
+		"state,host=web1,service=ping value=2i 1",
+	}, relabeledLines(t, r, routerTestBatch))
+}
+
+func TestRelabelWithoutStepsKeepsBatch(t *testing.T) {
+	r := testRelabeler(t, ``)
+	batch := &Batch{Data: []byte(routerTestBatch)}
+	relabeled, err := r.apply(batch)
+	require.Nil(t, err)
+	assert.Same(t, batch, relabeled)
+}
+
+func TestRelabelInvalidSteps(t *testing.T) {
+	for _, steps := range []string{
+		`[{action: rename}]`,
+		`[{source_labels: [host], regex: '('}]`,
+		`[{source_labels: [host]}]`,
+		`[{action: keep}]`,
+		`[{source_labels: [host], target_label: shard, action: hashmod}]`,
+	} {
+		var configs []relabelConfig
+		require.Nil(t, yaml.Unmarshal([]byte(steps), &configs))
+		_, err := newRelabeler(configs)
+		assert.NotNil(t, err, steps)
+	}
+}
+
+func TestFanOutRelabelsBeforeRouting(t *testing.T) {
+	replacement := "alerts"
+	sinks := []string{"test://relabeled?alias=relabeled"}
+	f, err := newFanOut(sinks, &config{
+		Relabel: []relabelConfig{{SourceLabels: []string{"host"}, TargetLabel: "team", Replacement: &replacement}},
+		Routes:  []routeConfig{{Match: matchConfig{Tags: map[string]string{"team": "other"}}, Drop: true}},
+	}, nil)
+	require.Nil(t, err)
+	sink := controlledSinkFor("relabeled")
+
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	assert.Eventually(t, func() bool { return sink.count() == 1 }, time.Second, 10*time.Millisecond)
+
+	// invalid steps are rejected, the current ones stay in place
+	assert.NotNil(t, f.configure(sinks, &config{Relabel: []relabelConfig{{Action: "rename"}}}))
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+
+	require.Nil(t, f.configure(sinks, &config{Relabel: []relabelConfig{{SourceLabels: []string{"host"}, Action: "drop"}}}))
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	require.Nil(t, f.Close())
+	sink.set(func(s *controlledSink) {
+		assert.Equal(t, []string{
+			"state,host=web1,service=ping,team=alerts value=0i 1\n",
+			"state,host=web1,service=ping,team=alerts value=0i 1\n",
+		}, s.published)
+	})
+}
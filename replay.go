@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+	flag "github.com/spf13/pflag"
+)
+
+// replayCommand implements "ocxp-sender replay [flags] file|directory...": it reads archived batches (e.g. written by
+// the file sink) and publishes them through the sinks and the pipeline of the daemon, e.g. to backfill a gap after an
+// outage.
+func replayCommand(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	var sinkURLs []string
+	flags.StringArrayVarP(&sinkURLs, "url", "u", []string{"amqp://localhost:5672"}, "URL of a sink to replay the data to (multiple allowed); ignored if the configuration file lists sinks")
+	configPath := flags.StringP("config", "c", "", "configuration file of the daemon (sinks, routing rules)")
+	from := flags.String("from", "", "only replay check results at or after this time (RFC 3339 or YYYY-MM-DD)")
+	to := flags.String("to", "", "only replay check results before this time (RFC 3339 or YYYY-MM-DD)")
+	hosts := flags.StringSlice("host", nil, "only replay check results of these hosts (glob patterns, multiple allowed)")
+	services := flags.StringSlice("service", nil, "only replay check results of these services (glob patterns, multiple allowed)")
+	rate := flags.Float64("rate", 0, "maximum number of check results published per second (0 = unlimited)")
+	checkpointPath := flags.String("checkpoint", "", "file in which the progress is recorded; a replay with the same checkpoint resumes where the last one stopped")
+	progressInterval := flags.Duration("progress", 10*time.Second, "interval in which the progress is reported and recorded")
+	timeout := flags.Duration("timeout", time.Minute, "maximum wait for the sinks to deliver before the progress is recorded")
+	flags.SetNormalizeFunc(normalizeFlagName)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] file|directory...\n\nReplays line protocol or JSON files (optionally gzipped) through the sinks.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var err error
+	filter := replayFilter{hosts: *hosts, services: *services}
+	filter.from, err = parseReplayTime(*from)
+	failOnError(err, "Invalid --from")
+	filter.to, err = parseReplayTime(*to)
+	failOnError(err, "Invalid --to")
+	files, err := replayFiles(flags.Args())
+	failOnError(err, "Failed to list files")
+	checkpoint, err := loadReplayCheckpoint(*checkpointPath)
+	failOnError(err, "Failed to load checkpoint")
+
+	f, err := newClientFanOut(*configPath, sinkURLs)
+	failOnError(err, "Failed to setup sinks")
+	r := newReplayer(f, filter, *rate, checkpoint, os.Stdout, *progressInterval, *timeout)
+	stopSignal := make(chan os.Signal, 1)
+	signal.Notify(stopSignal, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stopSignal
+		r.stop()
+	}()
+
+	err = r.replay(files)
+	// the sinks are closed before failOnError exits, so that they send what they buffer
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == errReplayInterrupted {
+		fmt.Println("Interrupted")
+	}
+	if err != nil && *checkpointPath != "" {
+		fmt.Printf("Run again with --checkpoint %v to resume\n", *checkpointPath)
+	}
+	failOnError(err, "Replay failed")
+}
+
+// parseReplayTime parses the --from and --to flags; an empty value means no limit
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// replayFiles expands directories to the files within, oldest first: rotated segments of the file sink are ordered by
+// the timestamp in their name, because compressing a segment changes its modification time, other files by their
+// modification time
+func replayFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		entries, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return replayAge(entries[i]).before(replayAge(entries[j])) })
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() {
+				files = append(files, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// replayAge returns the time up to which a file holds data: the rotation of a segment, or else the last write
+func replayAge(entry os.FileInfo) fileSegment {
+	if segment, ok := parseFileSegment(entry.Name()); ok {
+		return segment
+	}
+	return fileSegment{rotated: entry.ModTime()}
+}
+
+// replayFilter selects the check results to replay; zero values do not filter
+type replayFilter struct {
+	from, to time.Time
+	hosts    []string
+	services []string
+}
+
+func (f replayFilter) match(batch *Batch) (bool, error) {
+	metrics, err := batch.Metrics()
+	if err != nil || len(metrics) == 0 {
+		return false, err
+	}
+	timestamp := metrics[0].Time()
+	if !f.from.IsZero() && timestamp.Before(f.from) {
+		return false, nil
+	}
+	if !f.to.IsZero() && !timestamp.Before(f.to) {
+		return false, nil
+	}
+	return matchesAny(f.hosts, batch.Tag("host")) && matchesAny(f.services, batch.Tag("service")), nil
+}
+
+// matchesAny tells whether the value matches one of the glob patterns, or there are no patterns
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// replayCheckpoint records how far each file has been delivered: the offset in its (decompressed) data after the last
+// delivered batch, by segment name (see replaySegment)
+type replayCheckpoint struct {
+	path    string
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// loadReplayCheckpoint reads the checkpoint file; without a path, the checkpoint is kept in memory only
+func loadReplayCheckpoint(path string) (*replayCheckpoint, error) {
+	c := &replayCheckpoint{path: path, Offsets: map[string]int64{}}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if c.Offsets == nil {
+		c.Offsets = map[string]int64{}
+	}
+	return c, nil
+}
+
+// replaySegment returns the name under which the checkpoint records a file: its name without the directory, which may
+// be moved or mounted elsewhere, and without the .gz suffix, which the file sink adds when it compresses a rotated
+// segment. The offsets are those of the decompressed data, so they stay valid.
+func replaySegment(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), ".gz")
+}
+
+// save writes the checkpoint atomically
+func (c *replayCheckpoint) save() error {
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(c.path+".tmp", c.path)
+}
+
+var errReplayInterrupted = errors.New("replay interrupted")
+
+// replayer publishes the batches of files through a fan-out. The checkpoint only records batches the sinks have
+// delivered: it is saved in the progress interval and after every file, once the sinks have delivered what was
+// published so far. A replay that fails or is interrupted resumes after the last recorded batch, so the batches
+// published since are published again.
+type replayer struct {
+	sink             *fanOut
+	filter           replayFilter
+	interval         time.Duration // minimum time between two publishes
+	checkpoint       *replayCheckpoint
+	out              io.Writer
+	progressInterval time.Duration
+	timeout          time.Duration // maximum wait for the delivery before the checkpoint is saved
+
+	stopped int32
+	// segment and offset tell where the batches published so far end
+	segment string
+	offset  int64
+	// undelivered is set once the sinks failed to deliver; nothing is recorded afterwards
+	undelivered error
+
+	start        time.Time
+	lastPublish  time.Time
+	lastProgress time.Time
+	filesDone    int
+	filesTotal   int
+	published    int
+	skipped      int
+}
+
+func newReplayer(sink *fanOut, filter replayFilter, rate float64, checkpoint *replayCheckpoint, out io.Writer, progressInterval time.Duration,
+	timeout time.Duration) *replayer {
+	r := &replayer{sink: sink, filter: filter, checkpoint: checkpoint, out: out, progressInterval: progressInterval, timeout: timeout}
+	if rate > 0 {
+		r.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return r
+}
+
+// stop makes replay return errReplayInterrupted after the current batch
+func (r *replayer) stop() {
+	atomic.StoreInt32(&r.stopped, 1)
+}
+
+func (r *replayer) isStopped() bool {
+	return atomic.LoadInt32(&r.stopped) != 0
+}
+
+// replay publishes the batches of all files; the progress is recorded regularly and when replay returns
+func (r *replayer) replay(files []string) error {
+	r.start = time.Now()
+	r.lastProgress = r.start
+	r.filesTotal = len(files)
+	for _, file := range files {
+		err := r.replayFile(file)
+		if err != nil {
+			// what was published before is recorded if it is delivered
+			if commitErr := r.commit(); commitErr != nil && !errors.Is(err, commitErr) {
+				fmt.Fprintf(r.out, "Progress not recorded: %v\n", commitErr)
+			}
+		} else {
+			err = r.commit()
+		}
+		if err != nil {
+			r.progress()
+			return err
+		}
+		r.filesDone++
+	}
+	r.progress()
+	return nil
+}
+
+func (r *replayer) replayFile(file string) error {
+	segment := replaySegment(file)
+	done := r.checkpoint.Offsets[segment]
+	f, reader, err := openReplayFile(file)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if done > 0 {
+		_, err := io.CopyN(ioutil.Discard, reader, done)
+		if err == io.EOF {
+			// another file with the name of a replayed one, e.g. the current file of the file sink after a rotation
+			fmt.Fprintf(r.out, "%v is shorter than recorded in the checkpoint, replaying it from the start\n", file)
+			f.Close()
+			if f, reader, err = openReplayFile(file); err != nil {
+				return err
+			}
+			done = 0
+		} else if err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+	}
+
+	err = readBatches(reader, func(batch *Batch, end int64) error {
+		if r.isStopped() {
+			return errReplayInterrupted
+		}
+		match, err := r.filter.match(batch)
+		if err != nil {
+			return fmt.Errorf("batch at offset %d: %w", done+end, err)
+		}
+		if match {
+			r.wait()
+			if err := r.publish(batch); err == errReplayInterrupted {
+				return err
+			} else if err != nil {
+				return fmt.Errorf("failed to publish batch at offset %d: %w", done+end, err)
+			}
+			r.published++
+		} else {
+			r.skipped++
+		}
+		r.segment, r.offset = segment, done+end
+		if time.Since(r.lastProgress) >= r.progressInterval {
+			r.progress()
+			return r.commit()
+		}
+		return nil
+	})
+	if err != nil && err != errReplayInterrupted {
+		return fmt.Errorf("%v: %w", file, err)
+	}
+	return err
+}
+
+// openReplayFile opens a file and returns it with a reader of its decompressed data
+func openReplayFile(file string) (*os.File, io.Reader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := decompressedReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%v: %w", file, err)
+	}
+	return f, reader, nil
+}
+
+// publish waits until every sink has room in its queue, so that no batch is dropped, and publishes the batch; it fails
+// once a sink failed to deliver or dropped a batch
+func (r *replayer) publish(batch *Batch) error {
+	for r.sink.room() == 0 {
+		if r.isStopped() {
+			return errReplayInterrupted
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := r.sink.Publish(batch); err != nil {
+		return err
+	}
+	return r.checkDelivery()
+}
+
+// checkDelivery reports the sinks that failed to deliver or dropped batches
+func (r *replayer) checkDelivery() error {
+	var failed []string
+	for _, status := range r.sink.Status() {
+		if status.Failed > 0 || status.Dropped > 0 {
+			failed = append(failed, fmt.Sprintf("%v: %d failed, %d dropped (%v)", status.Alias, status.Failed, status.Dropped, status.LastError))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("not delivered by %v", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// commit waits until the sinks have delivered the batches published so far, and records them in the checkpoint
+func (r *replayer) commit() error {
+	if r.undelivered != nil {
+		return r.undelivered
+	}
+	err := r.sink.Flush(r.timeout)
+	if err == nil {
+		err = r.checkDelivery()
+	}
+	if err != nil {
+		r.undelivered = err
+		return err
+	}
+	if r.segment != "" {
+		r.checkpoint.Offsets[r.segment] = r.offset
+	}
+	return r.checkpoint.save()
+}
+
+// wait enforces the rate limit
+func (r *replayer) wait() {
+	if r.interval == 0 {
+		return
+	}
+	if next := r.lastPublish.Add(r.interval); time.Now().Before(next) {
+		time.Sleep(time.Until(next))
+	}
+	r.lastPublish = time.Now()
+}
+
+func (r *replayer) progress() {
+	r.lastProgress = time.Now()
+	elapsed := r.lastProgress.Sub(r.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(r.published) / elapsed
+	}
+	fmt.Fprintf(r.out, "Replayed %d check results (%d filtered) from %d/%d files, %.1f/s\n", r.published, r.skipped, r.filesDone, r.filesTotal, rate)
+}
+
+// decompressedReader transparently decompresses gzipped files (e.g. rotated by the file sink)
+func decompressedReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// readBatches reads line protocol or JSON check results (one document per line, or just concatenated) and calls fn
+// for each batch with the offset in r after the batch, where a later read can resume. The format is detected from the
+// first character.
+//
+// The batch boundaries are not recorded in line protocol files, so a batch is formed by consecutive lines of the same
+// host, service and timestamp up to and including the state line, which parse always adds last.
+func readBatches(r io.Reader, fn func(batch *Batch, end int64) error) error {
+	buffered := bufio.NewReaderSize(r, maxBufferSize)
+	var offset int64
+	for {
+		b, err := buffered.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		buffered.ReadByte()
+		offset++
+	}
+	if b, _ := buffered.Peek(1); b[0] == '{' {
+		return readJSONBatches(buffered, offset, fn)
+	}
+	return readLineProtocolBatches(buffered, offset, fn)
+}
+
+func readJSONBatches(r io.Reader, offset int64, fn func(batch *Batch, end int64) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var result checkResult
+		err := decoder.Decode(&result)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := result.lineProtocol()
+		if err != nil {
+			return err
+		}
+		if err := fn(&Batch{Data: data}, offset+decoder.InputOffset()); err != nil {
+			return err
+		}
+	}
+}
+
+func readLineProtocolBatches(r *bufio.Reader, offset int64, fn func(batch *Batch, end int64) error) error {
+	parser := protocol.NewParser(protocol.NewMetricHandler())
+
+	var batch bytes.Buffer
+	var batchKey string
+	var batchEnd int64
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		data := append([]byte(nil), batch.Bytes()...)
+		batch.Reset()
+		return fn(&Batch{Data: data}, batchEnd)
+	}
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(b) > maxBufferSize {
+			return fmt.Errorf("line %d: longer than %d bytes", line, maxBufferSize)
+		}
+		offset += int64(len(b))
+		if text := bytes.TrimSpace(b); len(text) > 0 && text[0] != '#' {
+			metrics, err := parser.Parse(append(text, '\n'))
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			m := metrics[0]
+			key := fmt.Sprintf("%v\x00%v\x00%v", tagValue(m, "host"), tagValue(m, "service"), m.Time().UnixNano())
+			if key != batchKey {
+				if err := flush(); err != nil {
+					return err
+				}
+				batchKey = key
+			}
+			batch.Write(text)
+			batch.WriteByte('\n')
+			batchEnd = offset
+			if m.Name() == "state" {
+				if err := flush(); err != nil {
+					return err
+				}
+				batchKey = ""
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records the published batches; it fails once failAt batches have been published
+type recordingSink struct {
+	mu      sync.Mutex
+	batches []string
+	failAt  int
+}
+
+func (s *recordingSink) Publish(batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failAt > 0 && len(s.batches) >= s.failAt {
+		return errors.New("sink unavailable")
+	}
+	s.batches = append(s.batches, string(batch.Data))
+	return nil
+}
+
+func (s *recordingSink) Health() error { return nil }
+func (s *recordingSink) Close() error  { return nil }
+
+func (s *recordingSink) published() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.batches...)
+}
+
+// recordingSinks are the sinks returned for test-replay://<name> URLs
+var recordingSinks = struct {
+	sync.Mutex
+	sinks map[string]*recordingSink
+}{sinks: map[string]*recordingSink{}}
+
+func init() {
+	registerSink(func(u *url.URL) (Sink, error) {
+		recordingSinks.Lock()
+		defer recordingSinks.Unlock()
+		return recordingSinks.sinks[u.Host], nil
+	}, "test-replay")
+}
+
+// replayFanOut returns a fan-out to the sink, which does not retry failed batches
+func replayFanOut(t *testing.T, sink *recordingSink) *fanOut {
+	recordingSinks.Lock()
+	name := "sink" + strconv.Itoa(len(recordingSinks.sinks))
+	recordingSinks.sinks[name] = sink
+	recordingSinks.Unlock()
+	f, err := newFanOut([]string{"test-replay://" + name + "?queue_retries=0"}, &config{}, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func testCheckResult(t *testing.T, host string, service string, timestamp time.Time) string {
+	b, err := parse(host, service, 0, "OK", variableFlags{"a=xyz"}, "rta=1.2ms;3000;5000;0 pl=0%;80;100;0", timestamp)
+	require.Nil(t, err)
+	return b.String()
+}
+
+func writeReplayFile(t *testing.T, name string, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	require.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+	return file
+}
+
+func TestReadBatchesLineProtocol(t *testing.T) {
+	t1 := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	batches := []string{
+		testCheckResult(t, "a", "ping", t1),
+		testCheckResult(t, "a", "ping", t1.Add(time.Minute)),
+		testCheckResult(t, "b", "ping", t1),
+		"state,host=c,service=ssh value=0i 1\n", // without perfdata
+	}
+
+	var read []string
+	var ends, expectedEnds []int64
+	offset := int64(1)
+	for _, batch := range batches {
+		offset += int64(len(batch))
+		expectedEnds = append(expectedEnds, offset)
+	}
+	err := readBatches(strings.NewReader("\n"+strings.Join(batches, "")), func(batch *Batch, end int64) error {
+		read = append(read, string(batch.Data))
+		ends = append(ends, end)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, batches, read)
+	assert.Equal(t, expectedEnds, ends)
+}
+
+func TestReadBatchesJSON(t *testing.T) {
+	timestamp := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	expected := testCheckResult(t, "a", "ping", timestamp)
+	document, err := encodeJSON(&Batch{Data: []byte(expected)})
+	require.Nil(t, err)
+
+	var read []string
+	var ends []int64
+	err = readBatches(strings.NewReader(string(document)+"\n"+string(document)), func(batch *Batch, end int64) error {
+		read = append(read, string(batch.Data))
+		ends = append(ends, end)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{expected, expected}, read)
+	assert.Equal(t, []int64{int64(len(document)), int64(2*len(document) + 1)}, ends)
+}
+
+func TestReadBatchesInvalidLine(t *testing.T) {
+	err := readBatches(strings.NewReader("state,host=a value=0i 1\nno line protocol\n"), func(*Batch, int64) error { return nil })
+	require.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "line 2: "), err.Error())
+}
+
+func TestReplayFilter(t *testing.T) {
+	t1 := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	var content string
+	for _, host := range []string{"web1", "web2", "db1"} {
+		for _, minute := range []int{0, 10, 20} {
+			content += testCheckResult(t, host, "ping", t1.Add(time.Duration(minute)*time.Minute))
+		}
+		content += testCheckResult(t, host, "ssh", t1)
+	}
+	file := writeReplayFile(t, "naemon.lp", content)
+
+	sink := &recordingSink{}
+	filter := replayFilter{from: t1.Add(5 * time.Minute), to: t1.Add(20 * time.Minute), hosts: []string{"web*"}, services: []string{"ping"}}
+	var out bytes.Buffer
+	r := newReplayer(replayFanOut(t, sink), filter, 0, &replayCheckpoint{Offsets: map[string]int64{}}, &out, time.Hour, time.Second)
+	require.Nil(t, r.replay([]string{file}))
+
+	assert.Equal(t, []string{
+		testCheckResult(t, "web1", "ping", t1.Add(10*time.Minute)),
+		testCheckResult(t, "web2", "ping", t1.Add(10*time.Minute)),
+	}, sink.published())
+	assert.True(t, strings.HasPrefix(out.String(), "Replayed 2 check results (10 filtered) from 1/1 files, "), out.String())
+}
+
+func TestReplayResumesFromCheckpoint(t *testing.T) {
+	t1 := time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC)
+	var content string
+	for i := 0; i < 5; i++ {
+		content += testCheckResult(t, "a", "ping", t1.Add(time.Duration(i)*time.Minute))
+	}
+	file := writeReplayFile(t, "naemon.lp.20211101T030000", "# comment\n"+content)
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	// the sink fails after 3 batches; the progress is recorded after every batch
+	sink := &recordingSink{failAt: 3}
+	checkpoint, err := loadReplayCheckpoint(checkpointPath)
+	require.Nil(t, err)
+	r := newReplayer(replayFanOut(t, sink), replayFilter{}, 0, checkpoint, ioutil.Discard, 0, time.Second)
+	assert.NotNil(t, r.replay([]string{file}))
+	assert.Len(t, sink.published(), 3)
+	b, err := ioutil.ReadFile(checkpointPath)
+	require.Nil(t, err)
+	offset := len("# comment\n") + 3*len(testCheckResult(t, "a", "ping", t1))
+	assert.JSONEq(t, `{"offsets": {"naemon.lp.20211101T030000": `+strconv.Itoa(offset)+`}}`, string(b))
+
+	// the next replay starts with the 4th batch, although the segment has been compressed by the file sink since
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write([]byte("# comment\n" + content))
+	w.Close()
+	require.Nil(t, os.Remove(file))
+	file = writeReplayFile(t, "naemon.lp.20211101T030000.gz", compressed.String())
+	sink.failAt = 0
+	checkpoint, err = loadReplayCheckpoint(checkpointPath)
+	require.Nil(t, err)
+	r = newReplayer(replayFanOut(t, sink), replayFilter{}, 0, checkpoint, ioutil.Discard, time.Hour, time.Second)
+	require.Nil(t, r.replay([]string{file}))
+	require.Len(t, sink.published(), 5)
+	assert.Equal(t, testCheckResult(t, "a", "ping", t1.Add(3*time.Minute)), sink.published()[3])
+
+	// and a completed replay is not repeated
+	r = newReplayer(replayFanOut(t, sink), replayFilter{}, 0, checkpoint, ioutil.Discard, time.Hour, time.Second)
+	require.Nil(t, r.replay([]string{file}))
+	assert.Len(t, sink.published(), 5)
+}
+
+func TestReplayRestartsShorterFile(t *testing.T) {
+	file := writeReplayFile(t, "naemon.lp", "state,host=a,service=ping value=0i 1\n")
+	sink := &recordingSink{}
+	// recorded for the previous file of the same name
+	checkpoint := &replayCheckpoint{Offsets: map[string]int64{"naemon.lp": 1000}}
+	var out bytes.Buffer
+	r := newReplayer(replayFanOut(t, sink), replayFilter{}, 0, checkpoint, &out, time.Hour, time.Second)
+	require.Nil(t, r.replay([]string{file}))
+	assert.Len(t, sink.published(), 1)
+	assert.Contains(t, out.String(), "shorter than recorded in the checkpoint")
+	assert.Equal(t, int64(len("state,host=a,service=ping value=0i 1\n")), checkpoint.Offsets["naemon.lp"])
+}
+
+func TestReplayThroughConfiguredPipeline(t *testing.T) {
+	sink := &recordingSink{}
+	recordingSinks.Lock()
+	recordingSinks.sinks["configured"] = sink
+	recordingSinks.Unlock()
+	configPath := writeReplayFile(t, "config.yaml", "sinks: [test-replay://configured]\ntags: {site: vienna}\n")
+	f, err := newClientFanOut(configPath, []string{"test-replay://ignored"})
+	require.Nil(t, err)
+	defer f.Close()
+
+	file := writeReplayFile(t, "naemon.lp", "state,host=a,service=ping value=0i 1\n")
+	r := newReplayer(f, replayFilter{}, 0, &replayCheckpoint{Offsets: map[string]int64{}}, ioutil.Discard, time.Hour, time.Second)
+	require.Nil(t, r.replay([]string{file}))
+	assert.Equal(t, []string{"state,host=a,service=ping,site=vienna value=0i 1\n"}, sink.published())
+}
+
+func TestReplayRateLimit(t *testing.T) {
+	var content string
+	for i := 0; i < 5; i++ {
+		content += "state,host=a,service=ping value=0i " + strconv.Itoa(i+1) + "\n"
+	}
+	file := writeReplayFile(t, "naemon.lp", content)
+
+	sink := &recordingSink{}
+	r := newReplayer(replayFanOut(t, sink), replayFilter{}, 50, &replayCheckpoint{Offsets: map[string]int64{}}, ioutil.Discard, time.Hour, time.Second)
+	start := time.Now()
+	require.Nil(t, r.replay([]string{file}))
+	assert.Len(t, sink.published(), 5)
+	// 5 publishes at 50/s take at least 4 intervals of 20ms
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(80*time.Millisecond))
+}
+
+func TestReplayInterrupted(t *testing.T) {
+	file := writeReplayFile(t, "naemon.lp", "state,host=a,service=ping value=0i 1\n")
+	r := newReplayer(replayFanOut(t, &recordingSink{}), replayFilter{}, 0, &replayCheckpoint{Offsets: map[string]int64{}}, ioutil.Discard, time.Hour,
+		time.Second)
+	r.stop()
+	assert.Equal(t, errReplayInterrupted, r.replay([]string{file}))
+}
+
+func TestReplayFilesOrdersDirectoryByAge(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"naemon.lp", "naemon.lp.2", "naemon.lp.1"} {
+		file := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(file, nil, 0644))
+		require.Nil(t, os.Chtimes(file, now, now.Add(-time.Duration(i)*time.Hour)))
+	}
+	files, err := replayFiles([]string{dir})
+	require.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "naemon.lp.1"), filepath.Join(dir, "naemon.lp.2"), filepath.Join(dir, "naemon.lp")}, files)
+}
+
+func TestReplayFilesOrdersSegmentsByName(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// the compressed segments were written last, but hold the oldest data
+	for i, name := range []string{"naemon.lp", "naemon.lp.20211101T030000", "naemon.lp.20211101T020000-001.gz", "naemon.lp.20211101T020000.gz"} {
+		file := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(file, nil, 0644))
+		require.Nil(t, os.Chtimes(file, now, now.Add(time.Duration(i)*time.Minute)))
+	}
+	files, err := replayFiles([]string{dir})
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "naemon.lp.20211101T020000.gz"),
+		filepath.Join(dir, "naemon.lp.20211101T020000-001.gz"),
+		filepath.Join(dir, "naemon.lp.20211101T030000"),
+		filepath.Join(dir, "naemon.lp"),
+	}, files)
+}
+
+func TestParseReplayTime(t *testing.T) {
+	ts, err := parseReplayTime("2021-11-01T03:00:00Z")
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC), ts.UTC())
+	ts, err = parseReplayTime("2021-11-01")
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2021, time.November, 1, 0, 0, 0, 0, time.Local), ts)
+	ts, err = parseReplayTime("")
+	require.Nil(t, err)
+	assert.True(t, ts.IsZero())
+	_, err = parseReplayTime("yesterday")
+	assert.NotNil(t, err)
+}
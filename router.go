@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// routeConfig is a routing rule of the configuration file. The lines of every batch are routed individually: the
+// first rule whose match applies to a line decides where it goes. Lines no rule matches go to all sinks.
+type routeConfig struct {
+	Match matchConfig `yaml:"match"`
+	// Sinks are the aliases of the sinks the lines are sent to; empty means all sinks
+	Sinks []string `yaml:"sinks"`
+	// RoutingKey is passed on with the lines, e.g. as routing key of the AMQP messages
+	RoutingKey string `yaml:"routing_key"`
+	// Drop discards the lines
+	Drop bool `yaml:"drop"`
+}
+
+// matchConfig selects lines; patterns are globs, or regular expressions if enclosed in slashes (e.g. "/^web\d+$/").
+// Empty fields match everything, all given fields have to match.
+type matchConfig struct {
+	Measurement string            `yaml:"measurement"`
+	Host        string            `yaml:"host"`
+	Service     string            `yaml:"service"`
+	Tags        map[string]string `yaml:"tags"`
+	// State matches the state of the check result the line belongs to: 0-3 or OK, WARNING, CRITICAL, UNKNOWN
+	State []string `yaml:"state"`
+}
+
+// pattern is a compiled glob or regular expression
+type pattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+// compilePattern compiles a pattern of the configuration; an empty pattern compiles to nil, which matches everything
+func compilePattern(s string) (*pattern, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		regex, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &pattern{regex: regex}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", s, err)
+	}
+	return &pattern{glob: s}, nil
+}
+
+func (p *pattern) match(value string) bool {
+	if p == nil {
+		return true
+	}
+	if p.regex != nil {
+		return p.regex.MatchString(value)
+	}
+	matched, _ := path.Match(p.glob, value)
+	return matched
+}
+
+var stateNames = map[string]int64{"OK": 0, "WARNING": 1, "CRITICAL": 2, "UNKNOWN": 3}
+
+// routeRule is a compiled routeConfig
+type routeRule struct {
+	measurement, host, service *pattern
+	tags                       map[string]*pattern
+	states                     map[int64]bool
+	sinks                      []int // indexes of the sinks; nil means all
+	routingKey                 string
+	drop                       bool
+}
+
+func (r *routeRule) match(m protocol.Metric, state int64) bool {
+	if !r.measurement.match(m.Name()) || !r.host.match(tagValue(m, "host")) || !r.service.match(tagValue(m, "service")) {
+		return false
+	}
+	for tag, p := range r.tags {
+		if !p.match(tagValue(m, tag)) {
+			return false
+		}
+	}
+	return r.states == nil || r.states[state]
+}
+
+// router distributes the lines of batches to the sinks of the fan-out according to the routing rules
+type router struct {
+	rules     []routeRule
+	sinkCount int
+}
+
+// newRouter compiles the routing rules; the sinks of the rules are resolved against the aliases of the fan-out's sinks
+func newRouter(routes []routeConfig, aliases []string) (*router, error) {
+	r := &router{sinkCount: len(aliases)}
+	for i, route := range routes {
+		rule, err := compileRoute(route, aliases)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func compileRoute(route routeConfig, aliases []string) (routeRule, error) {
+	rule := routeRule{routingKey: route.RoutingKey, drop: route.Drop}
+	var err error
+	if rule.measurement, err = compilePattern(route.Match.Measurement); err != nil {
+		return rule, err
+	}
+	if rule.host, err = compilePattern(route.Match.Host); err != nil {
+		return rule, err
+	}
+	if rule.service, err = compilePattern(route.Match.Service); err != nil {
+		return rule, err
+	}
+	for tag, value := range route.Match.Tags {
+		p, err := compilePattern(value)
+		if err != nil {
+			return rule, err
+		}
+		if rule.tags == nil {
+			rule.tags = map[string]*pattern{}
+		}
+		rule.tags[tag] = p
+	}
+	for _, state := range route.Match.State {
+		if rule.states == nil {
+			rule.states = map[int64]bool{}
+		}
+		if value, ok := stateNames[strings.ToUpper(state)]; ok {
+			rule.states[value] = true
+		} else if value, err := strconv.ParseInt(state, 10, 64); err == nil {
+			rule.states[value] = true
+		} else {
+			return rule, fmt.Errorf("invalid state %q", state)
+		}
+	}
+	for _, alias := range route.Sinks {
+		index := -1
+		for i, a := range aliases {
+			if a == alias {
+				index = i
+			}
+		}
+		if index < 0 {
+			return rule, fmt.Errorf("unknown sink %q (configured sinks: %v)", alias, strings.Join(aliases, ", "))
+		}
+		rule.sinks = append(rule.sinks, index)
+	}
+	if rule.drop && (len(rule.sinks) > 0 || rule.routingKey != "") {
+		return rule, fmt.Errorf("a route that drops lines cannot have sinks or a routing key")
+	}
+	return rule, nil
+}
+
+// routedBatch is (a part of) a batch destined for the sink with the given index
+type routedBatch struct {
+	sink  int
+	batch *Batch
+}
+
+// route decides for every line of the batch where it goes. Lines with the same destination are kept together in one
+// batch; if all lines go to the same destination, the batch is passed on as it is.
+func (r *router) route(batch *Batch) ([]routedBatch, error) {
+	if len(r.rules) == 0 {
+		return r.to(nil, batch), nil
+	}
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	state := int64(-1)
+	for _, m := range metrics {
+		if m.Name() == "state" {
+			for _, field := range m.FieldList() {
+				if v, ok := field.Value.(int64); ok && field.Key == "value" {
+					state = v
+				}
+			}
+		}
+	}
+
+	// the key of a line is the index of the rule that matched it, or -1
+	decide := func(m protocol.Metric) string {
+		for i := range r.rules {
+			if r.rules[i].match(m, state) {
+				return strconv.Itoa(i)
+			}
+		}
+		return "-1"
+	}
+	parts, err := splitBatch(batch, decide)
+	if err != nil {
+		return nil, err
+	}
+	var routed []routedBatch
+	for _, part := range parts {
+		var rule *routeRule
+		if i, _ := strconv.Atoi(decide(part.first)); i >= 0 {
+			rule = &r.rules[i]
+		}
+		if rule != nil && rule.drop {
+			continue
+		}
+		partBatch := batch
+		if len(parts) > 1 {
+			partBatch = &Batch{Data: part.data}
+		}
+		if rule != nil && rule.routingKey != "" {
+			partBatch = &Batch{Data: partBatch.Data, RoutingKey: rule.routingKey}
+		}
+		routed = append(routed, r.to(rule, partBatch)...)
+	}
+	return routed, nil
+}
+
+// to addresses the batch to the sinks of the rule, or all sinks without a rule
+func (r *router) to(rule *routeRule, batch *Batch) []routedBatch {
+	var routed []routedBatch
+	if rule == nil || rule.sinks == nil {
+		for i := 0; i < r.sinkCount; i++ {
+			routed = append(routed, routedBatch{sink: i, batch: batch})
+		}
+		return routed
+	}
+	for _, i := range rule.sinks {
+		routed = append(routed, routedBatch{sink: i, batch: batch})
+	}
+	return routed
+}
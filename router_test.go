@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func testRouter(t *testing.T, rules string, aliases ...string) *router {
+	var routes []routeConfig
+	require.Nil(t, yaml.Unmarshal([]byte(rules), &routes))
+	r, err := newRouter(routes, aliases)
+	require.Nil(t, err)
+	return r
+}
+
+// routedData returns the routed lines per sink alias, with the routing key in front of them
+func routedData(t *testing.T, r *router, aliases []string, batch *Batch) map[string][]string {
+	routed, err := r.route(batch)
+	require.Nil(t, err)
+	result := map[string][]string{}
+	for _, rb := range routed {
+		result[aliases[rb.sink]] = append(result[aliases[rb.sink]], rb.batch.RoutingKey+"|"+string(rb.batch.Data))
+	}
+	return result
+}
+
+const routerTestBatch = "metric,host=web1,label=rta,service=ping value=1.2 1\n" +
+	"metric,host=web1,label=pl,service=ping value=0 1\n" +
+	"state,host=web1,service=ping value=2i 1\n"
+
+func TestRouterSplitsLinesByMeasurement(t *testing.T) {
+	aliases := []string{"rabbitmq", "tsdb"}
+	r := testRouter(t, `
+- match: {measurement: state}
+  sinks: [rabbitmq]
+  routing_key: alerts
+- match: {measurement: metric}
+  sinks: [tsdb]
+`, aliases...)
+
+	assert.Equal(t, map[string][]string{
+		"rabbitmq": {"alerts|state,host=web1,service=ping value=2i 1\n"},
+		"tsdb":     {"|metric,host=web1,label=rta,service=ping value=1.2 1\nmetric,host=web1,label=pl,service=ping value=0 1\n"},
+	}, routedData(t, r, aliases, &Batch{Data: []byte(routerTestBatch)}))
+}
+
+func TestRouterSplitBatchesEncodeAsJSON(t *testing.T) {
+	aliases := []string{"rabbitmq", "archive"}
+	r := testRouter(t, `
+- match: {measurement: state}
+  sinks: [rabbitmq]
+- match: {measurement: metric}
+  sinks: [archive]
+`, aliases...)
+
+	routed, err := r.route(&Batch{Data: []byte(routerTestBatch)})
+	require.Nil(t, err)
+	require.Len(t, routed, 2)
+	documents := map[string]string{}
+	for _, rb := range routed {
+		b, err := formatJSON.Encode(rb.batch)
+		require.Nil(t, err, aliases[rb.sink])
+		documents[aliases[rb.sink]] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		"rabbitmq": `{"host":"web1","service":"ping","state":2,"timestamp":"1970-01-01T00:00:00.000000001Z","perfdata":[]}`,
+		"archive":  `{"host":"web1","service":"ping","timestamp":"1970-01-01T00:00:00.000000001Z","perfdata":[{"label":"rta","value":1.2},{"label":"pl","value":0}]}`,
+	}, documents)
+}
+
+func TestRouterMatches(t *testing.T) {
+	aliases := []string{"a", "b"}
+	for _, test := range []struct {
+		name  string
+		rules string
+		a     int // number of lines routed to a
+		b     int
+	}{
+		{"no rules go everywhere", `[]`, 3, 3},
+		{"host glob", `[{match: {host: "web*"}, sinks: [a]}]`, 3, 0},
+		{"host glob mismatch", `[{match: {host: "db*"}, sinks: [a]}]`, 3, 3},
+		{"service regex", `[{match: {service: "/^(ping|ssh)$/"}, sinks: [b]}]`, 0, 3},
+		{"tag", `[{match: {tags: {label: rta}}, sinks: [a]}]`, 3, 2},
+		{"state name", `[{match: {state: [CRITICAL, unknown]}, sinks: [a]}]`, 3, 0},
+		{"state number", `[{match: {state: ["0"]}, sinks: [a]}]`, 3, 3},
+		{"drop", `[{match: {measurement: metric, tags: {label: pl}}, drop: true}]`, 2, 2},
+		{"first rule wins", `[{match: {measurement: state}, sinks: [a]}, {match: {host: web1}, drop: true}]`, 1, 0},
+		{"all conditions have to match", `[{match: {host: web1, service: ssh}, drop: true}]`, 3, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			routed := routedData(t, testRouter(t, test.rules, aliases...), aliases, &Batch{Data: []byte(routerTestBatch)})
+			lines := func(alias string) int {
+				n := 0
+				for _, data := range routed[alias] {
+					for _, c := range data {
+						if c == '\n' {
+							n++
+						}
+					}
+				}
+				return n
+			}
+			assert.Equal(t, test.a, lines("a"))
+			assert.Equal(t, test.b, lines("b"))
+		})
+	}
+}
+
+func TestRouterKeepsUnsplitBatch(t *testing.T) {
+	r := testRouter(t, `[{match: {host: "web*"}, sinks: [a]}]`, "a")
+	batch := &Batch{Data: []byte(routerTestBatch)}
+	routed, err := r.route(batch)
+	require.Nil(t, err)
+	require.Len(t, routed, 1)
+	assert.Same(t, batch, routed[0].batch)
+}
+
+func TestRouterInvalidRules(t *testing.T) {
+	for _, rules := range []string{
+		`[{match: {host: "/[/"}}]`,
+		`[{match: {host: "["}}]`,
+		`[{match: {state: [BROKEN]}}]`,
+		`[{sinks: [unknown]}]`,
+		`[{drop: true, sinks: [a]}]`,
+	} {
+		var routes []routeConfig
+		require.Nil(t, yaml.Unmarshal([]byte(rules), &routes))
+		_, err := newRouter(routes, []string{"a"})
+		assert.NotNil(t, err, rules)
+	}
+}
+
+func TestFanOutRoutesAndReloads(t *testing.T) {
+	sinks := []string{"test://alerts?alias=alerts", "test://tsdb?alias=tsdb"}
+	f, err := newFanOut(sinks, &config{Routes: []routeConfig{
+		{Match: matchConfig{Measurement: "state"}, Sinks: []string{"alerts"}},
+		{Match: matchConfig{Measurement: "metric"}, Sinks: []string{"tsdb"}},
+	}}, nil)
+	require.Nil(t, err)
+	alerts, tsdb := controlledSinkFor("alerts"), controlledSinkFor("tsdb")
+
+	require.Nil(t, f.Publish(&Batch{Data: []byte(routerTestBatch)}))
+	assert.Eventually(t, func() bool { return alerts.count() == 1 && tsdb.count() == 1 }, time.Second, 10*time.Millisecond)
+
+	// invalid rules are rejected, the current ones stay in place
+	assert.NotNil(t, f.configure(sinks, &config{Routes: []routeConfig{{Sinks: []string{"unknown"}}}}))
+	require.Nil(t, f.Publish(&Batch{Data: []byte(routerTestBatch)}))
+	assert.Eventually(t, func() bool { return alerts.count() == 2 && tsdb.count() == 2 }, time.Second, 10*time.Millisecond)
+
+	require.Nil(t, f.configure(sinks, &config{Routes: []routeConfig{{Drop: true}}}))
+	require.Nil(t, f.Publish(&Batch{Data: []byte(routerTestBatch)}))
+	require.Nil(t, f.Close())
+	assert.Equal(t, 2, alerts.count())
+	assert.Equal(t, 2, tsdb.count())
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ocxp-sender.yml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+sinks:
+  - amqp://localhost:5672?alias=rabbitmq
+routes:
+  - match: {measurement: state, state: [WARNING, CRITICAL]}
+    sinks: [rabbitmq]
+    routing_key: alerts
+`), 0644))
+	c, err := loadConfig(path)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"amqp://localhost:5672?alias=rabbitmq"}, c.sinkURLs([]string{"amqp://other"}))
+	assert.Equal(t, []routeConfig{{
+		Match:      matchConfig{Measurement: "state", State: []string{"WARNING", "CRITICAL"}},
+		Sinks:      []string{"rabbitmq"},
+		RoutingKey: "alerts",
+	}}, c.Routes)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("routes:\n  - mtach: {}\n"), 0644))
+	_, err = loadConfig(path)
+	assert.NotNil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(path, nil, 0644))
+	c, err = loadConfig(path)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"amqp://other"}, c.sinkURLs([]string{"amqp://other"}))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// selfMonitoringConfig configures the self-monitoring of the configuration file: the daemon publishes its own metrics
+// (see selfMetrics) periodically as lines of the given measurement to the sinks, through the pipeline like any other
+// batch
+type selfMonitoringConfig struct {
+	// Interval in which the metrics are published; 0 (default) disables publishing them
+	Interval time.Duration `yaml:"interval"`
+	// Measurement of the lines (default ocxp_sender)
+	Measurement string `yaml:"measurement"`
+}
+
+func (c selfMonitoringConfig) measurement() string {
+	if c.Measurement == "" {
+		return "ocxp_sender"
+	}
+	return c.Measurement
+}
+
+// histogram counts observations in buckets, like a Prometheus histogram
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, the last one is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+// histogramSnapshot is the state of a histogram; Counts are cumulative, i.e. Counts[i] is the number of observations
+// less than or equal to Bounds[i], and Count is the total
+type histogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := histogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.bounds)), Sum: h.sum}
+	for i, count := range h.counts {
+		s.Count += count
+		if i < len(h.bounds) {
+			s.Counts[i] = s.Count
+		}
+	}
+	return s
+}
+
+// latencyBounds are the buckets (in seconds) of the publish latency histograms
+var latencyBounds = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// daemonStats are the counters of the data the daemon receives
+type daemonStats struct {
+	started     time.Time
+	connections atomic.Uint64
+	bytes       atomic.Uint64
+	batches     atomic.Uint64
+	lines       atomic.Uint64
+	parseErrors atomic.Uint64
+	batchLines  *histogram
+}
+
+// stats are the counters of the running daemon
+var stats = &daemonStats{
+	started:    time.Now(),
+	batchLines: newHistogram(1, 2, 5, 10, 20, 50, 100, 200, 500, 1000),
+}
+
+// received counts a batch received from a client
+func (s *daemonStats) received(data []byte) {
+	lines := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lines++
+	}
+	s.bytes.Add(uint64(len(data)))
+	s.batches.Add(1)
+	s.lines.Add(uint64(lines))
+	s.batchLines.observe(float64(lines))
+}
+
+// selfMetric is a metric of the self-monitoring
+type selfMetric struct {
+	name string
+	help string
+	// kind is counter, gauge or histogram
+	kind string
+	// sink is the alias of the sink the metric is about, if any
+	sink      string
+	value     float64
+	histogram histogramSnapshot
+}
+
+// selfMetrics returns the metrics of the daemon and the sinks of the fan-out
+func selfMetrics(f *fanOut) []selfMetric {
+	return append(daemonMetrics(f.Offenders(), f.spoolDepth()), sinkMetrics(f.Status())...)
+}
+
+// daemonMetrics returns the metrics of the daemon itself
+func daemonMetrics(offenders []cardinalityOffender, spoolDepth int) []selfMetric {
+	batchLines := stats.batchLines.snapshot()
+	return []selfMetric{
+		{name: "uptime_seconds", help: "Time since the daemon started", kind: "gauge", value: time.Since(stats.started).Seconds()},
+		{name: "connections_accepted", help: "Client connections accepted", kind: "counter", value: float64(stats.connections.Load())},
+		{name: "bytes_received", help: "Bytes received from clients", kind: "counter", value: float64(stats.bytes.Load())},
+		{name: "batches_received", help: "Batches received from clients", kind: "counter", value: float64(stats.batches.Load())},
+		{name: "lines_received", help: "Lines received from clients", kind: "counter", value: float64(stats.lines.Load())},
+		{name: "parse_errors", help: "Batches dropped because they could not be parsed", kind: "counter", value: float64(stats.parseErrors.Load())},
+		{name: "batch_lines", help: "Lines per received batch", kind: "histogram", histogram: batchLines},
+		{name: "cardinality_offenders", help: "Tags of hosts and services that exceed their cardinality limit", kind: "gauge", value: float64(len(offenders))},
+		{name: "spool_depth", help: "Batches in the spool, waiting to be queued again", kind: "gauge", value: float64(spoolDepth)},
+	}
+}
+
+// sinkMetrics returns the metrics of the sinks with the given status
+func sinkMetrics(statuses []sinkStatus) []selfMetric {
+	var metrics []selfMetric
+	for _, status := range statuses {
+		healthy := 0.0
+		if status.Healthy {
+			healthy = 1
+		}
+		metrics = append(metrics,
+			selfMetric{name: "sink_healthy", help: "Whether the sink is able to deliver", kind: "gauge", sink: status.Alias, value: healthy},
+			selfMetric{name: "sink_queued", help: "Batches waiting in the queue of the sink", kind: "gauge", sink: status.Alias, value: float64(status.Queued)},
+			selfMetric{name: "sink_delivered", help: "Batches delivered to the sink", kind: "counter", sink: status.Alias, value: float64(status.Delivered)},
+			selfMetric{name: "sink_failed", help: "Batches that could not be delivered after all retries", kind: "counter", sink: status.Alias, value: float64(status.Failed)},
+			selfMetric{name: "sink_retried", help: "Retries of failed publishes", kind: "counter", sink: status.Alias, value: float64(status.Retried)},
+			selfMetric{name: "sink_dropped", help: "Batches dropped because the queue was full or closing", kind: "counter", sink: status.Alias, value: float64(status.Dropped)},
+			selfMetric{name: "sink_spooled", help: "Batches spooled to disk because they could not be delivered before the daemon stopped", kind: "counter", sink: status.Alias, value: float64(status.Spooled)},
+			selfMetric{name: "sink_filtered", help: "Batches not matching the filter of the sink", kind: "counter", sink: status.Alias, value: float64(status.Filtered)},
+			selfMetric{name: "sink_recoveries", help: "Times the sink delivered again after it had failed", kind: "counter", sink: status.Alias, value: float64(status.Recoveries)},
+			selfMetric{name: "sink_reconnects", help: "Times the sink re-established its connection", kind: "counter", sink: status.Alias, value: float64(status.Reconnects)},
+			selfMetric{name: "sink_publish_latency_seconds", help: "Duration of successful publishes, including retries", kind: "histogram", sink: status.Alias, histogram: status.Latency},
+		)
+	}
+	return metrics
+}
+
+// selfMetricsBatch encodes the metrics as line protocol: one line with the metrics of the daemon, and one line per sink
+// (tagged with sink). Counters are integer fields, histograms are split into <name>_count, <name>_sum and one
+// <name>_le_<bound> field per bucket.
+func selfMetricsBatch(metrics []selfMetric, measurement string, timestamp time.Time) (*Batch, error) {
+	host, _ := os.Hostname()
+	var lines []*Metric
+	bySink := map[string]*Metric{}
+	for _, m := range metrics {
+		line, ok := bySink[m.sink]
+		if !ok {
+			line = &Metric{name: measurement, tags: []*protocol.Tag{{Key: "host", Value: host}}, timestamp: timestamp}
+			if m.sink != "" {
+				line.tags = append(line.tags, &protocol.Tag{Key: "sink", Value: m.sink})
+			}
+			bySink[m.sink] = line
+			lines = append(lines, line)
+		}
+		switch m.kind {
+		case "counter":
+			line.fields = append(line.fields, &protocol.Field{Key: m.name, Value: int64(m.value)})
+		case "gauge":
+			line.fields = append(line.fields, &protocol.Field{Key: m.name, Value: m.value})
+		case "histogram":
+			line.fields = append(line.fields,
+				&protocol.Field{Key: m.name + "_count", Value: int64(m.histogram.Count)},
+				&protocol.Field{Key: m.name + "_sum", Value: m.histogram.Sum})
+			for i, bound := range m.histogram.Bounds {
+				line.fields = append(line.fields, &protocol.Field{
+					Key:   m.name + "_le_" + strconv.FormatFloat(bound, 'g', -1, 64),
+					Value: int64(m.histogram.Counts[i]),
+				})
+			}
+			line.fields = append(line.fields, &protocol.Field{Key: m.name + "_le_inf", Value: int64(m.histogram.Count)})
+		default:
+			return nil, fmt.Errorf("unknown metric kind %v", m.kind)
+		}
+	}
+
+	var b bytes.Buffer
+	encoder := protocol.NewEncoder(&b)
+	for _, line := range lines {
+		if _, err := encoder.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	return &Batch{Data: b.Bytes()}, nil
+}
+
+// publishSelfMetrics publishes the metrics of the daemon to the sinks of the fan-out
+func publishSelfMetrics(f *fanOut, config selfMonitoringConfig) {
+	batch, err := selfMetricsBatch(selfMetrics(f), config.measurement(), time.Now())
+	if err == nil {
+		err = f.Publish(batch)
+	}
+	if err != nil {
+		logger.Warn("Failed to publish self-monitoring metrics", "error", err)
+	}
+}
+
+// selfMonitor publishes the self-monitoring metrics in the configured interval
+type selfMonitor struct {
+	stopChan chan struct{}
+	done     chan struct{}
+}
+
+// startSelfMonitor starts publishing the metrics to the fan-out, unless the interval is 0
+func startSelfMonitor(f *fanOut, config selfMonitoringConfig) *selfMonitor {
+	m := &selfMonitor{}
+	if config.Interval <= 0 {
+		return m
+	}
+	m.stopChan, m.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopChan:
+				return
+			case <-ticker.C:
+				publishSelfMetrics(f, config)
+			}
+		}
+	}()
+	return m
+}
+
+func (m *selfMonitor) stop() {
+	if m.stopChan == nil {
+		return
+	}
+	close(m.stopChan)
+	<-m.done
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 5, 10)
+	for _, v := range []float64{0.5, 1, 3, 7, 20} {
+		h.observe(v)
+	}
+	assert.Equal(t, histogramSnapshot{Bounds: []float64{1, 5, 10}, Counts: []uint64{2, 3, 4}, Sum: 31.5, Count: 5}, h.snapshot())
+}
+
+func TestDaemonStatsReceived(t *testing.T) {
+	s := &daemonStats{batchLines: newHistogram(1, 2, 5)}
+	s.received([]byte("a\nb\n"))
+	s.received([]byte("a\nb\nc"))
+	assert.Equal(t, uint64(2), s.batches.Load())
+	assert.Equal(t, uint64(5), s.lines.Load())
+	assert.Equal(t, uint64(9), s.bytes.Load())
+	assert.Equal(t, []uint64{0, 1, 2}, s.batchLines.snapshot().Counts)
+}
+
+func TestSelfMetricsBatch(t *testing.T) {
+	metrics := []selfMetric{
+		{name: "uptime_seconds", kind: "gauge", value: 1.5},
+		{name: "connections_accepted", kind: "counter", value: 3},
+		{name: "sink_delivered", kind: "counter", sink: "tsdb", value: 2},
+		{name: "sink_publish_latency_seconds", kind: "histogram", sink: "tsdb",
+			histogram: histogramSnapshot{Bounds: []float64{0.01, 0.1}, Counts: []uint64{1, 2}, Sum: 0.07, Count: 2}},
+	}
+	batch, err := selfMetricsBatch(metrics, "ocxp_sender", time.Unix(0, 1))
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(batch.Data), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Regexp(t, `^ocxp_sender,host=\S+ uptime_seconds=1.5,connections_accepted=3i 1$`, lines[0])
+	assert.Regexp(t, `^ocxp_sender,host=\S+,sink=tsdb sink_delivered=2i,sink_publish_latency_seconds_count=2i,`+
+		`sink_publish_latency_seconds_sum=0.07,sink_publish_latency_seconds_le_0.01=1i,`+
+		`sink_publish_latency_seconds_le_0.1=2i,sink_publish_latency_seconds_le_inf=2i 1$`, lines[1])
+}
+
+func TestSelfMetricsBatchAsJSON(t *testing.T) {
+	metrics := []selfMetric{
+		{name: "uptime_seconds", kind: "gauge", value: 1.5},
+		{name: "sink_delivered", kind: "counter", sink: "tsdb", value: 2},
+	}
+	batch, err := selfMetricsBatch(metrics, "ocxp_sender", time.Unix(0, 1))
+	require.Nil(t, err)
+	b, err := formatJSON.Encode(batch)
+	require.Nil(t, err)
+	host, _ := os.Hostname()
+	assert.JSONEq(t, `{"host":"`+host+`","service":"","timestamp":"1970-01-01T00:00:00.000000001Z","perfdata":[],"metrics":[`+
+		`{"measurement":"ocxp_sender","fields":{"uptime_seconds":1.5}},`+
+		`{"measurement":"ocxp_sender","tags":{"sink":"tsdb"},"fields":{"sink_delivered":2}}]}`, string(b))
+
+	// replaying the document restores the lines
+	var result checkResult
+	require.Nil(t, json.Unmarshal(b, &result))
+	lines, err := result.lineProtocol()
+	require.Nil(t, err)
+	assert.Equal(t, "ocxp_sender,host="+host+" uptime_seconds=1.5 1\nocxp_sender,host="+host+",sink=tsdb sink_delivered=2 1\n", string(lines))
+}
+
+func TestSelfMonitorPublishesToFanOut(t *testing.T) {
+	f, err := newFanOut([]string{"test://monitored?alias=monitored"}, &config{}, nil)
+	require.Nil(t, err)
+	sink := controlledSinkFor("monitored")
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	assert.Eventually(t, func() bool { return sink.count() == 1 }, time.Second, 10*time.Millisecond)
+
+	monitor := startSelfMonitor(f, selfMonitoringConfig{Interval: 10 * time.Millisecond, Measurement: "self"})
+	assert.Eventually(t, func() bool { return sink.count() >= 2 }, time.Second, 10*time.Millisecond)
+	monitor.stop()
+	require.Nil(t, f.Close())
+
+	sink.set(func(s *controlledSink) {
+		assert.Contains(t, s.published[1], "self,host=")
+		assert.Contains(t, s.published[1], ",sink=monitored sink_healthy=1,sink_queued=0,sink_delivered=1i,")
+	})
+
+	// disabled
+	startSelfMonitor(f, selfMonitoringConfig{}).stop()
+}
+
+func TestFanOutCountsParseErrors(t *testing.T) {
+	f, err := newFanOut([]string{"test://parse?alias=parse"}, &config{Relabel: []relabelConfig{{Action: "labeldrop"}}}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+	before := stats.parseErrors.Load()
+	assert.Nil(t, f.Publish(&Batch{Data: []byte("not line protocol\n")}))
+	assert.Equal(t, before+1, stats.parseErrors.Load())
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// Batch is the unit of data that is handed over to a Sink. It holds the complete payload a single client has sent to
+// the daemon, i.e. the Influx Line Protocol lines of one check result.
+type Batch struct {
+	Data []byte
+	// RoutingKey is set by the routing rules; sinks that support it (AMQP) use it to address the data
+	RoutingKey string
+
+	parseOnce sync.Once
+	metrics   []protocol.Metric
+	parseErr  error
+}
+
+// Metrics returns the parsed lines of the batch; parsing happens on first use, as most sinks just forward Data
+func (b *Batch) Metrics() ([]protocol.Metric, error) {
+	b.parseOnce.Do(func() {
+		b.metrics, b.parseErr = protocol.NewParser(protocol.NewMetricHandler()).Parse(b.Data)
+	})
+	return b.metrics, b.parseErr
+}
+
+// Tag returns the value of a tag of the batch's first line, which is shared by all lines (e.g. host and service), or
+// an empty string if the tag is not present
+func (b *Batch) Tag(key string) string {
+	metrics, err := b.Metrics()
+	if err != nil || len(metrics) == 0 {
+		return ""
+	}
+	return tagValue(metrics[0], key)
+}
+
+// batchPart is a subset of the lines of a batch that share the same key, e.g. the same topic
+type batchPart struct {
+	first protocol.Metric // first line of the part, to derive e.g. the topic from
+	data  []byte          // line protocol of all lines of the part
+}
+
+// splitBatch groups the lines of a batch by the key the given function returns for each line; the parts are returned
+// in the order of their first appearance
+func splitBatch(batch *Batch, key func(m protocol.Metric) string) ([]*batchPart, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	var parts []*batchPart
+	index := map[string]*batchPart{}
+	for _, m := range metrics {
+		k := key(m)
+		part, ok := index[k]
+		if !ok {
+			part = &batchPart{first: m}
+			index[k] = part
+			parts = append(parts, part)
+		}
+		var b bytes.Buffer
+		if _, err := protocol.NewEncoder(&b).Encode(m); err != nil {
+			return nil, err
+		}
+		part.data = append(part.data, b.Bytes()...)
+	}
+	return parts, nil
+}
+
+// rewriteBatch passes every line of the batch through the given function, which returns the line to keep in its place
+// or false to drop it. It returns nil if all lines were dropped.
+func rewriteBatch(batch *Batch, rewrite func(m protocol.Metric) (protocol.Metric, bool)) (*Batch, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	encoder := protocol.NewEncoder(&b)
+	for _, m := range metrics {
+		rewritten, keep := rewrite(m)
+		if !keep {
+			continue
+		}
+		if _, err := encoder.Encode(rewritten); err != nil {
+			return nil, err
+		}
+	}
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	return &Batch{Data: b.Bytes(), RoutingKey: batch.RoutingKey}, nil
+}
+
+var regexTemplatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// renderTemplate fills the placeholders of a template (e.g. a topic) with the measurement name ({measurement}) and
+// the tag values ({<tag>}) of a line. sanitize removes characters with a special meaning for the destination from the
+// values, missing values are rendered as "_".
+func renderTemplate(template string, m protocol.Metric, sanitize func(string) string) string {
+	return regexTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value := m.Name()
+		if name != "measurement" {
+			value = tagValue(m, name)
+		}
+		if value == "" {
+			return "_"
+		}
+		return sanitize(value)
+	})
+}
+
+func tagValue(m protocol.Metric, key string) string {
+	for _, tag := range m.TagList() {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// Sink is an output transport of the daemon (e.g. AMQP). Implementations must be safe for concurrent use, because the
+// daemon publishes from one goroutine per incoming client.
+type Sink interface {
+	// Publish delivers the batch to the sink's destination; it returns once the destination has accepted the batch.
+	Publish(batch *Batch) error
+	// Health reports whether the sink is currently able to deliver; nil means healthy.
+	Health() error
+	// Close releases all resources held by the sink. Publishing to a closed sink fails.
+	Close() error
+}
+
+// Flusher is implemented by sinks that buffer data instead of delivering it right away (e.g. to send it in bulk);
+// Flush delivers what is buffered without waiting for the sink's own interval, and returns once it is delivered.
+type Flusher interface {
+	Flush() error
+}
+
+// Reconnector is implemented by sinks that re-establish a lost connection by themselves (e.g. after a restart of the
+// broker); Reconnects returns how often they have done so.
+type Reconnector interface {
+	Reconnects() uint64
+}
+
+// AsyncSink is implemented by sinks that deliver the data of many batches together (see batcher). PublishAsync takes
+// the batch over and returns without waiting for its delivery, so that the daemon can hand over the next batches;
+// done is called once with the result of the delivery. If PublishAsync fails, the batch was not taken over and done
+// is not called.
+type AsyncSink interface {
+	PublishAsync(batch *Batch, done func(error)) error
+}
+
+// handOver publishes the batch with PublishAsync if the sink supports it, otherwise with Publish; done is called with
+// the result of the delivery, unless handOver fails
+func handOver(sink Sink, batch *Batch, done func(error)) error {
+	if async, ok := sink.(AsyncSink); ok {
+		return async.PublishAsync(batch, done)
+	}
+	if err := sink.Publish(batch); err != nil {
+		return err
+	}
+	done(nil)
+	return nil
+}
+
+// sinkFactory creates a sink from its URL. The URL scheme has already been used to pick the factory.
+type sinkFactory func(u *url.URL) (Sink, error)
+
+var sinkFactories = map[string]sinkFactory{}
+
+// registerSink makes a sink implementation available for the given URL scheme(s); it is meant to be called from init().
+func registerSink(factory sinkFactory, schemes ...string) {
+	for _, scheme := range schemes {
+		if _, exists := sinkFactories[scheme]; exists {
+			panic(fmt.Sprintf("sink for scheme %v registered twice", scheme))
+		}
+		sinkFactories[scheme] = factory
+	}
+}
+
+// newSink creates the sink that is responsible for the scheme of the given URL
+func newSink(rawURL string) (Sink, error) {
+	factory, u, err := lookupSinkFactory(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return factory(u)
+}
+
+// lookupSinkFactory parses the URL and returns the factory of the sink responsible for its scheme
+func lookupSinkFactory(rawURL string) (sinkFactory, *url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid sink URL: %w", err)
+	}
+	factory, ok := sinkFactories[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported sink URL scheme %q (supported: %v)", u.Scheme, strings.Join(sinkSchemes(), ", "))
+	}
+	return factory, u, nil
+}
+
+// lazySink creates its sink in the background instead of right away, so that the daemon starts even if the backend
+// is unavailable. Until the sink is created, publishes try again (and fail if it still cannot be created) and Health
+// reports why it is not connected.
+type lazySink struct {
+	alias string
+	url   *url.URL
+	// factory creates the sink
+	factory sinkFactory
+
+	// attempt serializes the attempts to create the sink
+	attempt sync.Mutex
+	mu      sync.Mutex
+	sink    Sink
+	err     error
+}
+
+// newLazySink checks the scheme of the URL and starts creating the sink in the background
+func newLazySink(alias string, rawURL string) (*lazySink, error) {
+	factory, u, err := lookupSinkFactory(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &lazySink{alias: alias, url: u, factory: factory}
+	go s.get()
+	return s, nil
+}
+
+// get returns the sink, creating it if that has not succeeded yet
+func (s *lazySink) get() (Sink, error) {
+	s.attempt.Lock()
+	defer s.attempt.Unlock()
+	s.mu.Lock()
+	sink, lastErr := s.sink, s.err
+	s.mu.Unlock()
+	if sink != nil {
+		return sink, nil
+	}
+
+	sink, err := s.factory(s.url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// every attempt fails the same way while the backend is down
+		if lastErr == nil || lastErr.Error() != err.Error() {
+			logger.Warn("Failed to connect sink, trying again with the next batch", "sink", s.alias, "error", err)
+		}
+		s.err = err
+		return nil, err
+	}
+	if lastErr != nil {
+		logger.Info("Connected sink", "sink", s.alias)
+	}
+	s.sink, s.err = sink, nil
+	return sink, nil
+}
+
+// connected reports whether the sink has been created
+func (s *lazySink) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink != nil
+}
+
+func (s *lazySink) Publish(batch *Batch) error {
+	sink, err := s.get()
+	if err != nil {
+		return err
+	}
+	return sink.Publish(batch)
+}
+
+func (s *lazySink) PublishAsync(batch *Batch, done func(error)) error {
+	sink, err := s.get()
+	if err != nil {
+		return err
+	}
+	return handOver(sink, batch, done)
+}
+
+func (s *lazySink) Health() error {
+	s.mu.Lock()
+	sink, err := s.sink, s.err
+	s.mu.Unlock()
+	switch {
+	case sink != nil:
+		return sink.Health()
+	case err != nil:
+		return fmt.Errorf("not connected: %w", err)
+	default:
+		return errors.New("connecting")
+	}
+}
+
+func (s *lazySink) Reconnects() uint64 {
+	s.mu.Lock()
+	sink := s.sink
+	s.mu.Unlock()
+	if reconnector, ok := sink.(Reconnector); ok {
+		return reconnector.Reconnects()
+	}
+	return 0
+}
+
+func (s *lazySink) Flush() error {
+	s.mu.Lock()
+	sink := s.sink
+	s.mu.Unlock()
+	if flusher, ok := sink.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close waits for a running attempt to create the sink, and closes the sink if it was created
+func (s *lazySink) Close() error {
+	s.attempt.Lock()
+	defer s.attempt.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sink == nil {
+		return nil
+	}
+	return s.sink.Close()
+}
+
+func sinkSchemes() []string {
+	schemes := make([]string, 0, len(sinkFactories))
+	for scheme := range sinkFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// sinkOptions gives typed access to the query parameters of a sink URL, which carry the sink specific settings. The
+// first conversion error is remembered and reported by Err.
+type sinkOptions struct {
+	values url.Values
+	err    error
+}
+
+func newSinkOptions(u *url.URL) *sinkOptions {
+	return &sinkOptions{values: u.Query()}
+}
+
+func (o *sinkOptions) String(name string, def string) string {
+	if v := o.values.Get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (o *sinkOptions) Bool(name string, def bool) bool {
+	v := o.values.Get(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		o.fail(name, err)
+	}
+	return b
+}
+
+func (o *sinkOptions) Int(name string, def int) int {
+	v := o.values.Get(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		o.fail(name, err)
+	}
+	return i
+}
+
+func (o *sinkOptions) Duration(name string, def time.Duration) time.Duration {
+	v := o.values.Get(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		o.fail(name, err)
+	}
+	return d
+}
+
+// Size parses a number of bytes, optionally with the suffix KB, MB or GB (powers of 1024)
+func (o *sinkOptions) Size(name string, def int64) int64 {
+	v := strings.ToUpper(o.values.Get(name))
+	if v == "" {
+		return def
+	}
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(v, suffix) {
+			v, multiplier = strings.TrimSuffix(v, suffix), m
+			break
+		}
+	}
+	size, err := strconv.ParseInt(strings.TrimSuffix(v, "B"), 10, 64)
+	if err != nil {
+		o.fail(name, err)
+	}
+	return size * multiplier
+}
+
+// Format returns the payload format selected with the format option
+func (o *sinkOptions) Format(def payloadFormat) payloadFormat {
+	f, err := parseFormat(o.String("format", string(def)))
+	if err != nil {
+		o.fail("format", err)
+		return def
+	}
+	return f
+}
+
+func (o *sinkOptions) fail(name string, err error) {
+	if o.err == nil {
+		o.err = fmt.Errorf("invalid value for sink option %v: %w", name, err)
+	}
+}
+
+func (o *sinkOptions) Err() error {
+	return o.err
+}
+
+// TLSConfig builds a TLS client configuration from the options ca (CA certificate file), cert and key (client
+// certificate and key files) and insecure_skip_verify
+func (o *sinkOptions) TLSConfig() *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: o.Bool("insecure_skip_verify", false)}
+	if ca := o.String("ca", ""); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			o.fail("ca", err)
+			return config
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			o.fail("ca", errors.New("no certificates found"))
+		}
+	}
+	if cert := o.String("cert", ""); cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, o.String("key", ""))
+		if err != nil {
+			o.fail("cert", err)
+			return config
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func init() {
+	registerSink(newAMQPSink, "amqp", "amqps")
+}
+
+// amqpConnection and amqpChannel are the parts of *amqp.Connection and *amqp.Channel the sink uses
+type amqpConnection interface {
+	IsClosed() bool
+	Close() error
+}
+
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpSink publishes each batch as a single message to an exchange, using the routing key set by the routing rules.
+// With publisher confirms, Publish returns once the broker has taken responsibility for the message.
+//
+// options:
+//
+//	format           payload format: lineprotocol (default) or json; sets the content type of the messages accordingly
+//	exchange         name of the exchange (default ExchangeName)
+//	exchange_type    type the exchange is declared with if it does not exist: fanout (default), direct, topic or headers
+//	confirm          whether to use publisher confirms (default true)
+//	confirm_timeout  how long to wait for the confirm of a message (default 10s)
+type amqpSink struct {
+	connection amqpConnection
+	channel    amqpChannel
+	format     payloadFormat
+	exchange   string
+
+	// confirms is nil without publisher confirms
+	confirms *amqpConfirms
+}
+
+// amqpConfirms matches the confirms of the broker to the published messages. The broker confirms the messages of a
+// channel by their delivery tag, which counts the published messages from 1, so the publishes have to be serialized.
+type amqpConfirms struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	sequence uint64
+	pending  map[uint64]chan bool
+	closed   bool
+}
+
+func newAMQPConfirms(confirmations <-chan amqp.Confirmation, timeout time.Duration) *amqpConfirms {
+	c := &amqpConfirms{timeout: timeout, pending: map[uint64]chan bool{}}
+	go func() {
+		for confirmation := range confirmations {
+			c.mu.Lock()
+			done := c.pending[confirmation.DeliveryTag]
+			delete(c.pending, confirmation.DeliveryTag)
+			c.mu.Unlock()
+			if done != nil {
+				done <- confirmation.Ack
+			}
+		}
+		// the channel is closed, the outstanding messages will not be confirmed anymore
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.closed = true
+		for tag, done := range c.pending {
+			delete(c.pending, tag)
+			close(done)
+		}
+	}()
+	return c
+}
+
+// publish publishes a message with the given function and waits for its confirm
+func (c *amqpConfirms) publish(publish func() error) error {
+	done := make(chan bool, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if err := publish(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.sequence++
+	tag := c.sequence
+	c.pending[tag] = done
+	c.mu.Unlock()
+
+	select {
+	case ack, ok := <-done:
+		if !ok {
+			return errors.New("channel closed before the broker confirmed the message")
+		}
+		if !ack {
+			return errors.New("broker rejected the message")
+		}
+		return nil
+	case <-time.After(c.timeout):
+		c.mu.Lock()
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		return fmt.Errorf("broker did not confirm the message within %v", c.timeout)
+	}
+}
+
+func newAMQPSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	format := options.Format(formatLineProtocol)
+	exchange := options.String("exchange", ExchangeName)
+	exchangeType := options.String("exchange_type", amqp.ExchangeFanout)
+	confirm := options.Bool("confirm", true)
+	confirmTimeout := options.Duration("confirm_timeout", 10*time.Second)
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+
+	// the query holds the options of the sink, which are of no concern for the AMQP server
+	dialURL := *u
+	dialURL.RawQuery = ""
+	connection, err := amqp.Dial(dialURL.String())
+	if err != nil {
+		return nil, err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = channel.ExchangeDeclare(
+		exchange,     // name
+		exchangeType, // type
+		true,         // durable
+		false,        // auto-deleted
+		false,        // internal
+		false,        // no-wait
+		nil,          // arguments
+	)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	s := &amqpSink{connection: connection, channel: channel, format: format, exchange: exchange}
+	if confirm {
+		if err := channel.Confirm(false); err != nil {
+			connection.Close()
+			return nil, err
+		}
+		s.confirms = newAMQPConfirms(channel.NotifyPublish(make(chan amqp.Confirmation, 100)), confirmTimeout)
+	}
+	return s, nil
+}
+
+func (s *amqpSink) Publish(batch *Batch) error {
+	body, err := s.format.Encode(batch)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: we assume that amqp.Channel and its publish method are thread safe and one channel can be used in multiple goroutines
+	// the documentation is not 100% clear on this, but there seems to be a proper lock/mutex in place:
+	// https://github.com/streadway/amqp/blob/master/channel.go#L1331
+	publish := func() error {
+		return s.channel.Publish(
+			s.exchange,       // exchange
+			batch.RoutingKey, // routing key
+			false,            // mandatory
+			false,            // immediate
+			amqp.Publishing{
+				ContentType:  s.format.ContentType(),
+				Body:         body,
+				DeliveryMode: 2,
+			})
+	}
+	if s.confirms == nil {
+		return publish()
+	}
+	return s.confirms.publish(publish)
+}
+
+func (s *amqpSink) Health() error {
+	if s.connection.IsClosed() {
+		return errors.New("AMQP connection is closed")
+	}
+	return nil
+}
+
+func (s *amqpSink) Close() error {
+	s.channel.Close()
+	return s.connection.Close()
+}
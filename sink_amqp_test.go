@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAMQP stands in for both the AMQP connection and its channel
+type fakeAMQP struct {
+	mu        sync.Mutex
+	closed    bool
+	published []amqp.Publishing
+	keys      []string // exchange/routing key of the published messages
+}
+
+func (f *fakeAMQP) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return amqp.ErrClosed
+	}
+	f.published = append(f.published, msg)
+	f.keys = append(f.keys, exchange+"/"+key)
+	return nil
+}
+
+func (f *fakeAMQP) IsClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeAMQP) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeAMQP) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.published)
+}
+
+func TestAMQPSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		fake := &fakeAMQP{}
+		return &sinkUnderTest{
+			sink:        &amqpSink{connection: fake, channel: fake, format: formatLineProtocol, exchange: ExchangeName},
+			delivered:   fake.count,
+			stopBackend: func() { fake.Close() },
+		}
+	})
+}
+
+func TestAMQPSinkJSON(t *testing.T) {
+	fake := &fakeAMQP{}
+	s := &amqpSink{connection: fake, channel: fake, format: formatJSON, exchange: ExchangeName}
+
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+	require.Len(t, fake.published, 1)
+	assert.Equal(t, "application/json", fake.published[0].ContentType)
+	assert.Equal(t, `{"host":"abc.com","service":"ping","state":0,"timestamp":"1970-01-01T00:00:00.000000001Z","perfdata":[]}`, string(fake.published[0].Body))
+}
+
+func TestAMQPSinkRoutingKey(t *testing.T) {
+	fake := &fakeAMQP{}
+	s := &amqpSink{connection: fake, channel: fake, format: formatLineProtocol, exchange: "checks"}
+
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n"), RoutingKey: "alerts"}))
+	require.Len(t, fake.keys, 1)
+	assert.Equal(t, "checks/alerts", fake.keys[0])
+}
+
+func TestAMQPSinkConfirms(t *testing.T) {
+	fake := &fakeAMQP{}
+	confirmations := make(chan amqp.Confirmation)
+	s := &amqpSink{connection: fake, channel: fake, format: formatLineProtocol, exchange: ExchangeName,
+		confirms: newAMQPConfirms(confirmations, 100*time.Millisecond)}
+	batch := &Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}
+
+	published := make(chan error)
+	// the broker confirms a message only after it is published
+	go func() { published <- s.Publish(batch) }()
+	assert.Eventually(t, func() bool { return fake.count() == 1 }, time.Second, time.Millisecond)
+	confirmations <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	assert.Nil(t, <-published)
+
+	go func() { published <- s.Publish(batch) }()
+	assert.Eventually(t, func() bool { return fake.count() == 2 }, time.Second, time.Millisecond)
+	confirmations <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	assert.EqualError(t, <-published, "broker rejected the message")
+
+	assert.EqualError(t, s.Publish(batch), "broker did not confirm the message within 100ms")
+
+	go func() { published <- s.Publish(batch) }()
+	assert.Eventually(t, func() bool { return fake.count() == 4 }, time.Second, time.Millisecond)
+	close(confirmations)
+	assert.EqualError(t, <-published, "channel closed before the broker confirmed the message")
+	assert.Equal(t, amqp.ErrClosed, s.Publish(batch))
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSink(newFileSink, "file")
+}
+
+// fileSegmentTimeFormat is the timestamp that rotated segments get appended to their name; it sorts chronologically
+const fileSegmentTimeFormat = "20060102T150405"
+
+// regexFileSegment matches the names of rotated segments: <file>.<timestamp>, with a counter if several segments were
+// rotated within the same second, and with .gz if compressed
+var regexFileSegment = regexp.MustCompile(`^(.+)\.(\d{8}T\d{6})(?:-(\d{3,}))?(?:\.gz)?$`)
+
+// fileSegment is a rotated segment of a file
+type fileSegment struct {
+	path    string
+	file    string
+	rotated time.Time
+	counter int
+}
+
+// parseFileSegment parses the name of a rotated segment; ok is false for other files
+func parseFileSegment(path string) (segment fileSegment, ok bool) {
+	match := regexFileSegment.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return fileSegment{}, false
+	}
+	rotated, err := time.ParseInLocation(fileSegmentTimeFormat, match[2], time.Local)
+	if err != nil {
+		return fileSegment{}, false
+	}
+	counter := 0
+	if match[3] != "" {
+		counter, _ = strconv.Atoi(match[3])
+	}
+	return fileSegment{path: path, file: filepath.Join(filepath.Dir(path), match[1]), rotated: rotated, counter: counter}, true
+}
+
+// before reports whether the segment was rotated before the other one
+func (s fileSegment) before(other fileSegment) bool {
+	if !s.rotated.Equal(other.rotated) {
+		return s.rotated.Before(other.rotated)
+	}
+	return s.counter < other.counter
+}
+
+// fileSink appends the batches to a local file, as line protocol or as one JSON document per line. The file is
+// rotated by size and/or age: the current file is renamed to <file>.<timestamp> (and gzip-compressed in the
+// background to <file>.<timestamp>.gz) and a new file is started. Old segments are removed according to max_files and
+// max_age. Rotation is checked whenever a batch is written.
+//
+// URL format: file:///path/to/file?options
+//
+// options:
+//
+//	format       lineprotocol (default) or json
+//	max_size     rotate once the file has reached this size, e.g. 100MB (default 0, no size based rotation)
+//	rotate       rotate once the file is older than this, e.g. 24h (default 0, no time based rotation)
+//	compress     gzip-compress rotated segments (default false)
+//	max_files    number of rotated segments to keep (default 0, all)
+//	max_age      remove rotated segments older than this (default 0, keep)
+//	sync         fsync the file after every batch (default false)
+type fileSink struct {
+	path     string
+	format   payloadFormat
+	maxSize  int64
+	rotate   time.Duration
+	compress bool
+	maxFiles int
+	maxAge   time.Duration
+	sync     bool
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// housekeeping tracks the background cleanups after rotations, housekeepingMu serializes them
+	housekeeping   sync.WaitGroup
+	housekeepingMu sync.Mutex
+}
+
+func newFileSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	s := &fileSink{
+		path:     u.Path,
+		format:   options.Format(formatLineProtocol),
+		maxSize:  options.Size("max_size", 0),
+		rotate:   options.Duration("rotate", 0),
+		compress: options.Bool("compress", false),
+		maxFiles: options.Int("max_files", 0),
+		maxAge:   options.Duration("max_age", 0),
+		sync:     options.Bool("sync", false),
+	}
+	if s.path == "" || strings.HasSuffix(s.path, "/") {
+		return nil, errors.New("file sink requires a file path, e.g. file:///var/spool/ocxp-sender/naemon.lp")
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens (or creates) the current file for appending; s.mu must be held
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	s.openedAt = time.Now()
+	if s.size > 0 {
+		// a file of a previous daemon is continued; its creation time is not portably available, so its age is
+		// counted from the last write
+		s.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+// needsRotation tells whether the current file has to be rotated before n more bytes are written; s.mu must be held
+func (s *fileSink) needsRotation(n int, now time.Time) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.maxSize > 0 && s.size+int64(n) > s.maxSize {
+		return true
+	}
+	return s.rotate > 0 && now.Sub(s.openedAt) >= s.rotate
+}
+
+// rotateFile renames the current file to a segment and opens a new one; s.mu must be held
+func (s *fileSink) rotateFile(now time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	segment := s.path + "." + now.Format(fileSegmentTimeFormat)
+	for i := 1; fileExists(segment) || fileExists(segment+".gz"); i++ {
+		segment = fmt.Sprintf("%v.%v-%03d", s.path, now.Format(fileSegmentTimeFormat), i)
+	}
+	if err := os.Rename(s.path, segment); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	s.housekeeping.Add(1)
+	go func() {
+		defer s.housekeeping.Done()
+		s.cleanUp(time.Now())
+	}()
+	return nil
+}
+
+// cleanUp compresses the rotated segments and enforces max_files and max_age. It works on all segments, so it does
+// not matter if the cleanups of several rotations run in a different order.
+func (s *fileSink) cleanUp(now time.Time) {
+	s.housekeepingMu.Lock()
+	defer s.housekeepingMu.Unlock()
+
+	if s.compress {
+		segments, err := s.segments()
+		if err != nil {
+			return
+		}
+		for _, segment := range segments {
+			if strings.HasSuffix(segment, ".gz") {
+				continue
+			}
+			if err := compressFile(segment); err != nil {
+				logger.Warn("Failed to compress rotated file", "path", segment, "error", err)
+			}
+		}
+	}
+	s.removeOldSegments(now)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compressFile gzips a file to <path>.gz and removes the original
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".gz.tmp") // only exists if something went wrong
+	w := gzip.NewWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".gz.tmp", path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// segments returns the rotated segments of the file, oldest first. Only names generated by rotateFile count, other
+// files next to it are left alone.
+func (s *fileSink) segments() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return nil, err
+	}
+	var found []fileSegment
+	for _, entry := range entries {
+		segment, ok := parseFileSegment(filepath.Join(filepath.Dir(s.path), entry.Name()))
+		if ok && segment.file == filepath.Clean(s.path) && entry.Type().IsRegular() {
+			found = append(found, segment)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].before(found[j]) })
+	segments := make([]string, len(found))
+	for i, segment := range found {
+		segments[i] = segment.path
+	}
+	return segments, nil
+}
+
+// removeOldSegments enforces max_files and max_age
+func (s *fileSink) removeOldSegments(now time.Time) {
+	segments, err := s.segments()
+	if err != nil {
+		return
+	}
+	for i, segment := range segments {
+		remove := s.maxFiles > 0 && len(segments)-i > s.maxFiles
+		if !remove && s.maxAge > 0 {
+			info, err := os.Stat(segment)
+			remove = err == nil && now.Sub(info.ModTime()) > s.maxAge
+		}
+		if remove {
+			os.Remove(segment)
+		}
+	}
+}
+
+func (s *fileSink) Publish(batch *Batch) error {
+	payload, err := s.format.Encode(batch)
+	if err != nil {
+		return err
+	}
+	if len(payload) == 0 || payload[len(payload)-1] != '\n' {
+		payload = append(payload[:len(payload):len(payload)], '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("file sink is closed")
+	}
+	now := time.Now()
+	if s.needsRotation(len(payload), now) {
+		if err := s.rotateFile(now); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(payload)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.sync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// Flush writes the data the operating system has buffered to the disk
+func (s *fileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+// Health reports whether the directory of the file is still there
+func (s *fileSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("file sink is closed")
+	}
+	_, err := os.Stat(filepath.Dir(s.path))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.file.Close()
+	s.mu.Unlock()
+	s.housekeeping.Wait()
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLines(t *testing.T, path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.Nil(t, err)
+	if strings.HasSuffix(path, ".gz") {
+		reader, err := gzip.NewReader(strings.NewReader(string(b)))
+		require.Nil(t, err)
+		b, err = ioutil.ReadAll(reader)
+		require.Nil(t, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestFileSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		dir := filepath.Join(t.TempDir(), "spool")
+		require.Nil(t, os.Mkdir(dir, 0755))
+		path := filepath.Join(dir, "naemon.lp")
+		s, err := newSink("file://" + path)
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink: s,
+			delivered: func() int {
+				n := 0
+				for _, line := range readLines(t, path) {
+					if strings.HasPrefix(line, "state,") {
+						n++
+					}
+				}
+				return n
+			},
+			stopBackend: func() { os.RemoveAll(dir) },
+		}
+	})
+}
+
+func TestFileSinkJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "naemon.json")
+	s, err := newSink("file://" + path + "?format=json")
+	require.Nil(t, err)
+
+	data := []byte("state,host=abc.com,service=ping value=0i 1\n")
+	require.Nil(t, s.Publish(&Batch{Data: data}))
+	require.Nil(t, s.Publish(&Batch{Data: data}))
+	require.Nil(t, s.Close())
+
+	document := `{"host":"abc.com","service":"ping","state":0,"timestamp":"1970-01-01T00:00:00.000000001Z","perfdata":[]}`
+	assert.Equal(t, []string{document, document}, readLines(t, path))
+}
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "naemon.lp")
+	line := "state,host=abc.com,service=ping value=0i 1\n"
+	// room for two lines per file
+	s, err := newSink("file://" + path + "?max_size=" + strconv.Itoa(2*len(line)) + "&compress=true&max_files=2")
+	require.Nil(t, err)
+
+	for i := 0; i < 7; i++ {
+		require.Nil(t, s.Publish(&Batch{Data: []byte(line)}))
+	}
+	require.Nil(t, s.Close())
+
+	assert.Len(t, readLines(t, path), 1)
+	segments, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	// 3 segments were rotated, the oldest one was removed
+	require.Len(t, segments, 2)
+	for _, segment := range segments {
+		assert.True(t, strings.HasSuffix(segment, ".gz"), segment)
+		assert.Len(t, readLines(t, segment), 2)
+	}
+}
+
+func TestFileSinkKeepsUnrelatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checks")
+	unrelated := []string{path + ".foo", path + ".conf", path + ".20260101T000000.bak", path + "-old.20260101T000000"}
+	for _, name := range unrelated {
+		require.Nil(t, ioutil.WriteFile(name, []byte("keep\n"), 0644))
+	}
+	line := "state,host=abc.com,service=ping value=0i 1\n"
+	s, err := newSink("file://" + path + "?max_size=" + strconv.Itoa(len(line)) + "&compress=true&max_files=1")
+	require.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		require.Nil(t, s.Publish(&Batch{Data: []byte(line)}))
+	}
+	require.Nil(t, s.Close())
+
+	for _, name := range unrelated {
+		data, err := ioutil.ReadFile(name)
+		require.Nil(t, err, name)
+		assert.Equal(t, "keep\n", string(data))
+	}
+	segments, err := filepath.Glob(path + ".2*.gz")
+	require.Nil(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestFileSegmentOrder(t *testing.T) {
+	names := []string{"a.lp.20260102T000000.gz", "a.lp.20260101T000000-002", "a.lp.20260101T000000.gz", "a.lp.20260101T000000-010.gz"}
+	var segments []fileSegment
+	for _, name := range names {
+		segment, ok := parseFileSegment(name)
+		require.True(t, ok, name)
+		assert.Equal(t, "a.lp", segment.file)
+		segments = append(segments, segment)
+	}
+	assert.True(t, segments[2].before(segments[1]))
+	assert.True(t, segments[1].before(segments[3]))
+	assert.True(t, segments[3].before(segments[0]))
+	_, ok := parseFileSegment("a.lp.conf")
+	assert.False(t, ok)
+	_, ok = parseFileSegment("a.lp.20260101T000000.gz.tmp")
+	assert.False(t, ok)
+}
+
+func TestFileSinkRotatesByTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "naemon.lp")
+	s, err := newSink("file://" + path + "?rotate=50ms")
+	require.Nil(t, err)
+	defer s.Close()
+
+	line := []byte("state,host=abc.com,service=ping value=0i 1\n")
+	require.Nil(t, s.Publish(&Batch{Data: line}))
+	require.Nil(t, s.Publish(&Batch{Data: line}))
+	time.Sleep(60 * time.Millisecond)
+	require.Nil(t, s.Publish(&Batch{Data: line}))
+
+	assert.Len(t, readLines(t, path), 1)
+	segments, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	require.Len(t, segments, 1)
+	assert.Len(t, readLines(t, segments[0]), 2)
+}
+
+func TestFileSinkContinuesExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "naemon.lp")
+	require.Nil(t, ioutil.WriteFile(path, []byte("state,host=a,service=b value=0i 1\n"), 0644))
+	s, err := newSink("file://" + path)
+	require.Nil(t, err)
+	require.Nil(t, s.Publish(&Batch{Data: []byte("state,host=a,service=b value=1i 2\n")}))
+	require.Nil(t, s.Close())
+	assert.Len(t, readLines(t, path), 2)
+}
+
+func TestFileSinkInvalidOptions(t *testing.T) {
+	_, err := newSink("file:///tmp/")
+	assert.NotNil(t, err)
+	_, err = newSink("file:///tmp/x.lp?max_size=lots")
+	assert.NotNil(t, err)
+}
+
+func TestSinkOptionsSize(t *testing.T) {
+	for value, expected := range map[string]int64{"": 7, "100": 100, "100B": 100, "2KB": 2048, "1mb": 1 << 20, "3GB": 3 << 30} {
+		options := &sinkOptions{values: map[string][]string{"size": {value}}}
+		assert.Equal(t, expected, options.Size("size", 7), value)
+		assert.Nil(t, options.Err())
+	}
+}
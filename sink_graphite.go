@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+func init() {
+	registerSink(newGraphiteSink, "graphite")
+}
+
+// graphiteSink writes the data to Graphite (carbon) over TCP, using the plaintext or the pickle protocol. The
+// connection is established on the first publish and re-established whenever carbon closes it or a write fails.
+//
+// Every field of a "metric" line (value, warn, crit, min, max) becomes a metric path built from the template, the
+// "state" line becomes a metric built from state_template. With tagged=true, the metrics are sent as Graphite 1.1
+// tagged series instead: the path is followed by all tags of the line (host, service, label, uom and the variables).
+//
+// URL format: graphite://host:port?options (carbon listens on 2003 for plaintext, 2004 for pickle)
+//
+// options:
+//
+//	template        template of the perfdata paths; {field}, {measurement} and {<tag>} are replaced by the values
+//	                of the line, characters other than letters, digits, _ and - are replaced by _
+//	                (default "naemon.{host}.{service}.{label}.{field}", with tagged=true "naemon.{label}.{field}")
+//	state_template  template of the state paths (default "naemon.{host}.{service}.state", with tagged=true
+//	                "naemon.state")
+//	tagged          send Graphite 1.1 tagged series (default false)
+//	protocol        plaintext (default) or pickle
+//	timeout         timeout for connecting and writing (default 10s)
+type graphiteSink struct {
+	address       string
+	template      string
+	stateTemplate string
+	tagged        bool
+	pickle        bool
+	timeout       time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+	// connected is set once the first connection was established, every later one counts as reconnect
+	connected  bool
+	reconnects atomic.Uint64
+}
+
+func newGraphiteSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	s := &graphiteSink{
+		address: u.Host,
+		tagged:  options.Bool("tagged", false),
+		timeout: options.Duration("timeout", 10*time.Second),
+	}
+	if s.tagged {
+		s.template = options.String("template", "naemon.{label}.{field}")
+		s.stateTemplate = options.String("state_template", "naemon.state")
+	} else {
+		s.template = options.String("template", "naemon.{host}.{service}.{label}.{field}")
+		s.stateTemplate = options.String("state_template", "naemon.{host}.{service}.state")
+	}
+	switch p := options.String("protocol", "plaintext"); p {
+	case "plaintext":
+	case "pickle":
+		s.pickle = true
+	default:
+		return nil, fmt.Errorf("unsupported Graphite protocol %v", p)
+	}
+	if u.Port() == "" {
+		return nil, errors.New("Graphite sink requires a port")
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// graphiteSample is a single value of a metric path
+type graphiteSample struct {
+	path      string
+	value     float64
+	timestamp int64 // seconds
+}
+
+var regexInvalidGraphitePathChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// sanitizeGraphitePathNode replaces the characters that would split a value into several nodes of a metric path or
+// are not safe in a path
+func sanitizeGraphitePathNode(value string) string {
+	return regexInvalidGraphitePathChars.ReplaceAllString(value, "_")
+}
+
+var graphiteTagNameReplacer = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_", "~", "_")
+var graphiteTagValueReplacer = strings.NewReplacer(";", "_", " ", "_", "~", "_")
+
+// graphiteTags renders the tags of a line in the Graphite 1.1 format ";name=value" sorted by name; empty values are
+// not allowed by Graphite and skipped
+func graphiteTags(m protocol.Metric) string {
+	tags := make([]string, 0, len(m.TagList()))
+	for _, tag := range m.TagList() {
+		if tag.Value == "" {
+			continue
+		}
+		tags = append(tags, ";"+graphiteTagNameReplacer.Replace(tag.Key)+"="+graphiteTagValueReplacer.Replace(tag.Value))
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, "")
+}
+
+// samples maps the lines of a batch to Graphite samples
+func (s *graphiteSink) samples(batch *Batch) ([]graphiteSample, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	var samples []graphiteSample
+	for _, m := range metrics {
+		template := s.template
+		if m.Name() == "state" {
+			template = s.stateTemplate
+		}
+		var tags string
+		if s.tagged {
+			tags = graphiteTags(m)
+		}
+		for _, field := range m.FieldList() {
+			value, ok := numericValue(field.Value)
+			if !ok {
+				continue // e.g. the output of the state
+			}
+			path := strings.ReplaceAll(template, "{field}", sanitizeGraphitePathNode(field.Key))
+			path = renderTemplate(path, m, sanitizeGraphitePathNode)
+			samples = append(samples, graphiteSample{path: path + tags, value: value, timestamp: m.Time().Unix()})
+		}
+	}
+	return samples, nil
+}
+
+// encodePlaintext encodes the samples as "path value timestamp" lines
+func encodePlaintext(samples []graphiteSample) []byte {
+	var b bytes.Buffer
+	for _, sample := range samples {
+		b.WriteString(sample.path)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(sample.value, 'f', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(sample.timestamp, 10))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// encodePickle encodes the samples as list of (path, (timestamp, value)) tuples in pickle protocol 2, prefixed with
+// the 4 byte length header carbon expects
+func encodePickle(samples []graphiteSample) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x80, 2}) // PROTO 2
+	b.WriteByte(']')         // EMPTY_LIST
+	b.WriteByte('(')         // MARK
+	for _, sample := range samples {
+		b.WriteByte('X') // BINUNICODE
+		binary.Write(&b, binary.LittleEndian, uint32(len(sample.path)))
+		b.WriteString(sample.path)
+		if sample.timestamp >= math.MinInt32 && sample.timestamp <= math.MaxInt32 {
+			b.WriteByte('J') // BININT
+			binary.Write(&b, binary.LittleEndian, int32(sample.timestamp))
+		} else {
+			b.WriteByte('G') // BINFLOAT
+			binary.Write(&b, binary.BigEndian, float64(sample.timestamp))
+		}
+		b.WriteByte('G') // BINFLOAT
+		binary.Write(&b, binary.BigEndian, sample.value)
+		b.WriteByte(0x86) // TUPLE2 (timestamp, value)
+		b.WriteByte(0x86) // TUPLE2 (path, (timestamp, value))
+	}
+	b.WriteByte('e') // APPENDS
+	b.WriteByte('.') // STOP
+
+	payload := make([]byte, 4, 4+b.Len())
+	binary.BigEndian.PutUint32(payload, uint32(b.Len()))
+	return append(payload, b.Bytes()...)
+}
+
+// connect returns the current connection or establishes a new one; s.mu must be held
+func (s *graphiteSink) connect() (net.Conn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	if s.connected {
+		s.reconnects.Add(1)
+	}
+	s.connected = true
+	go s.watch(conn)
+	return conn, nil
+}
+
+// watch drops the connection as soon as carbon closes it, which would otherwise only be noticed by the write after
+// next and lose the data of the next write
+func (s *graphiteSink) watch(conn net.Conn) {
+	io.Copy(ioutil.Discard, conn) // carbon does not send anything, so this returns once the connection is gone
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnect(conn)
+}
+
+// disconnect closes the connection if it is still the current one; s.mu must be held
+func (s *graphiteSink) disconnect(conn net.Conn) {
+	conn.Close()
+	if s.conn == conn {
+		s.conn = nil
+	}
+}
+
+func (s *graphiteSink) Publish(batch *Batch) error {
+	samples, err := s.samples(batch)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	payload := encodePlaintext(samples)
+	if s.pickle {
+		payload = encodePickle(samples)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("Graphite sink is closed")
+	}
+	// a failed write is retried once on a new connection
+	for attempt := 0; ; attempt++ {
+		conn, err := s.connect()
+		if err != nil {
+			return err
+		}
+		conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		_, err = conn.Write(payload)
+		if err == nil {
+			return nil
+		}
+		s.disconnect(conn)
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// Health reports whether carbon is reachable, reconnecting if the connection was lost
+func (s *graphiteSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("Graphite sink is closed")
+	}
+	_, err := s.connect()
+	return err
+}
+
+func (s *graphiteSink) Reconnects() uint64 {
+	return s.reconnects.Load()
+}
+
+func (s *graphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.disconnect(s.conn)
+	}
+	return nil
+}
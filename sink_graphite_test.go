@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCarbon accepts plaintext connections and records the received lines
+type fakeCarbon struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+	lines []string
+}
+
+func newFakeCarbon(t *testing.T) *fakeCarbon {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	f := &fakeCarbon{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					f.mu.Lock()
+					f.lines = append(f.lines, scanner.Text())
+					f.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(f.stop)
+	return f
+}
+
+func (f *fakeCarbon) url(query string) string {
+	return "graphite://" + f.listener.Addr().String() + query
+}
+
+// dropConnections closes all accepted connections, as carbon does when it restarts
+func (f *fakeCarbon) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeCarbon) stop() {
+	f.listener.Close()
+	f.dropConnections()
+}
+
+func (f *fakeCarbon) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.lines...)
+}
+
+// states counts the received state lines, i.e. the delivered batches
+func (f *fakeCarbon) states() int {
+	n := 0
+	for _, line := range f.received() {
+		if strings.Contains(line, ".state ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGraphiteSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		fake := newFakeCarbon(t)
+		s, err := newSink(fake.url(""))
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink:        s,
+			delivered:   fake.states,
+			stopBackend: fake.stop,
+		}
+	})
+}
+
+const graphiteTestData = "metric,host=abc.com,label=/boot,service=disk\\ usage,uom=MB,my-var=x value=68.5,warn=88,crit=93 1635735600000000000\n" +
+	"state,host=abc.com,service=disk\\ usage,my-var=x value=1i,output=\"WARNING\" 1635735600000000000\n"
+
+func TestGraphiteSinkPaths(t *testing.T) {
+	fake := newFakeCarbon(t)
+	s, err := newSink(fake.url(""))
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Publish(&Batch{Data: []byte(graphiteTestData)}))
+	assert.Eventually(t, func() bool { return len(fake.received()) == 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"naemon.abc_com.disk_usage._boot.value 68.5 1635735600",
+		"naemon.abc_com.disk_usage._boot.warn 88 1635735600",
+		"naemon.abc_com.disk_usage._boot.crit 93 1635735600",
+		"naemon.abc_com.disk_usage.state 1 1635735600",
+	}, fake.received())
+}
+
+func TestGraphiteSinkTagged(t *testing.T) {
+	fake := newFakeCarbon(t)
+	s, err := newSink(fake.url("?tagged=true"))
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Publish(&Batch{Data: []byte(graphiteTestData)}))
+	assert.Eventually(t, func() bool { return len(fake.received()) == 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"naemon._boot.value;host=abc.com;label=/boot;my-var=x;service=disk_usage;uom=MB 68.5 1635735600",
+		"naemon._boot.warn;host=abc.com;label=/boot;my-var=x;service=disk_usage;uom=MB 88 1635735600",
+		"naemon._boot.crit;host=abc.com;label=/boot;my-var=x;service=disk_usage;uom=MB 93 1635735600",
+		"naemon.state;host=abc.com;my-var=x;service=disk_usage 1 1635735600",
+	}, fake.received())
+}
+
+func TestGraphiteSinkReconnects(t *testing.T) {
+	fake := newFakeCarbon(t)
+	s, err := newSink(fake.url(""))
+	require.Nil(t, err)
+	defer s.Close()
+
+	data := []byte("state,host=h,service=s value=0i 1000000000\n")
+	require.Nil(t, s.Publish(&Batch{Data: data}))
+	assert.Eventually(t, func() bool { return len(fake.received()) == 1 }, time.Second, 10*time.Millisecond)
+
+	fake.dropConnections()
+	// give the sink the chance to notice, as it would between two check results
+	time.Sleep(50 * time.Millisecond)
+	require.Nil(t, s.Publish(&Batch{Data: data}))
+	assert.Eventually(t, func() bool { return len(fake.received()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), s.(Reconnector).Reconnects())
+}
+
+func TestGraphiteSinkPickle(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	s, err := newSink("graphite://" + listener.Addr().String() + "?protocol=pickle")
+	require.Nil(t, err)
+	defer s.Close()
+	require.Nil(t, s.Publish(&Batch{Data: []byte("state,host=h,service=s value=2i 1000000000\n")}))
+
+	// [("naemon.h.s.state", (1, 2.0))]
+	expected := []byte{0, 0, 0, 43, 0x80, 2, ']', '(', 'X', 16, 0, 0, 0}
+	expected = append(expected, "naemon.h.s.state"...)
+	expected = append(expected, 'J', 1, 0, 0, 0, 'G', 0x40, 0, 0, 0, 0, 0, 0, 0, 0x86, 0x86, 'e', '.')
+	assert.Equal(t, expected, <-received)
+}
+
+func TestGraphiteSinkInvalidOptions(t *testing.T) {
+	_, err := newSink("graphite://localhost:2003?protocol=udp")
+	assert.NotNil(t, err)
+	_, err = newSink("graphite://localhost")
+	assert.NotNil(t, err)
+}
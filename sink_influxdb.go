@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+)
+
+func init() {
+	registerSink(newInfluxDBSink, "influxdb", "influxdbs")
+}
+
+// influxDBSink writes batches directly to the HTTP write API of InfluxDB, without a message queue in between.
+//
+// URL format: influxdb[s]://[user:password@]host:port[/path-prefix]?options
+//
+// options:
+//
+//	version         2 (default; /api/v2/write) or 1 (/write)
+//	org, bucket     organization and bucket (version 2); the token is taken from "token" or the INFLUX_TOKEN env variable
+//	db, rp          database and retention policy (version 1); credentials are taken from the URL user info and
+//	                sent as basic auth
+//	gzip            gzip-compress the request body (default false)
+//	timeout         timeout per request (default 10s)
+//	max_retries     how often a write is retried on 429 and 5xx responses (default 0, as the queue of the daemon
+//	                retries failed publishes, see queue_retries)
+//	retry_interval  initial backoff between retries, doubled with every retry (default 1s); a Retry-After header
+//	                of the server takes precedence
+type influxDBSink struct {
+	poster   *httpPoster
+	writeURL string
+	pingURL  string
+	gzip     bool
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newInfluxDBSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	version := options.Int("version", 2)
+	s := &influxDBSink{
+		poster: newHTTPPoster(options, 0),
+		gzip:   options.Bool("gzip", false),
+	}
+
+	base := url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "influxdbs" {
+		base.Scheme = "https"
+	}
+
+	write := base
+	params := url.Values{}
+	params.Set("precision", "ns")
+	switch version {
+	case 1:
+		write.Path += "/write"
+		params.Set("db", options.String("db", ""))
+		if rp := options.String("rp", ""); rp != "" {
+			params.Set("rp", rp)
+		}
+		if params.Get("db") == "" {
+			return nil, errors.New("InfluxDB v1 sink requires the db option")
+		}
+		// as basic auth rather than u and p in the query, which ends up in the logs of proxies
+		if u.User != nil {
+			password, _ := u.User.Password()
+			credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			s.poster.header.Set("Authorization", "Basic "+credentials)
+		}
+	case 2:
+		write.Path += "/api/v2/write"
+		params.Set("org", options.String("org", ""))
+		params.Set("bucket", options.String("bucket", ""))
+		if params.Get("org") == "" || params.Get("bucket") == "" {
+			return nil, errors.New("InfluxDB v2 sink requires the org and bucket options")
+		}
+		token := options.String("token", os.Getenv("INFLUX_TOKEN"))
+		if token != "" {
+			s.poster.header.Set("Authorization", "Token "+token)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB version %v", version)
+	}
+	if options.Format(formatLineProtocol) != formatLineProtocol {
+		return nil, errors.New("InfluxDB sink only supports the lineprotocol format")
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	write.RawQuery = params.Encode()
+	s.writeURL = write.String()
+
+	ping := base
+	ping.Path += "/ping"
+	s.pingURL = ping.String()
+
+	s.poster.header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.gzip {
+		s.poster.header.Set("Content-Encoding", "gzip")
+	}
+	return s, nil
+}
+
+func (s *influxDBSink) Publish(batch *Batch) error {
+	// the lock is not held while posting, so that Close does not wait for the retries
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return errors.New("InfluxDB sink is closed")
+	}
+
+	body := batch.Data
+	if s.gzip {
+		var err error
+		if body, err = gzipBytes(batch.Data); err != nil {
+			return err
+		}
+	}
+
+	return s.poster.post(s.writeURL, body)
+}
+
+func (s *influxDBSink) Health() error {
+	// the lock is not held while pinging, so that a slow server does not hold up Close
+	s.mu.RLock()
+	poster, closed := s.poster, s.closed
+	s.mu.RUnlock()
+	if closed {
+		return errors.New("InfluxDB sink is closed")
+	}
+	return poster.ping(s.pingURL)
+}
+
+func (s *influxDBSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.poster.close()
+	return nil
+}
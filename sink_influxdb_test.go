@@ -0,0 +1,207 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeInfluxDB records write requests; failures holds the status codes returned for the next requests
+type fakeInfluxDB struct {
+	mu         sync.Mutex
+	requests   []*http.Request
+	bodies     []string
+	failures   []int
+	retryAfter string
+}
+
+func (f *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(strings.NewReader(string(body)))
+		if err == nil {
+			body, _ = ioutil.ReadAll(reader)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	if len(f.failures) > 0 {
+		status := f.failures[0]
+		f.failures = f.failures[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		w.WriteHeader(status)
+		return
+	}
+	f.bodies = append(f.bodies, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeInfluxDB) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.bodies)
+}
+
+func newTestInfluxDBSink(t *testing.T, server *httptest.Server, query string) Sink {
+	s, err := newSink(strings.Replace(server.URL, "http://", "influxdb://", 1) + query)
+	require.Nil(t, err)
+	return s
+}
+
+func TestInfluxDBSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		fake := &fakeInfluxDB{}
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+		return &sinkUnderTest{
+			sink:        newTestInfluxDBSink(t, server, "?org=o&bucket=b&token=secret"),
+			delivered:   fake.count,
+			stopBackend: server.Close,
+		}
+	})
+}
+
+func TestInfluxDBSinkV2Write(t *testing.T) {
+	fake := &fakeInfluxDB{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&token=secret&gzip=true")
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}))
+	require.Len(t, fake.requests, 1)
+	r := fake.requests[0]
+	assert.Equal(t, "/api/v2/write", r.URL.Path)
+	assert.Equal(t, "o", r.URL.Query().Get("org"))
+	assert.Equal(t, "b", r.URL.Query().Get("bucket"))
+	assert.Equal(t, "ns", r.URL.Query().Get("precision"))
+	assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+	assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"state,host=h value=0i 1\n"}, fake.bodies)
+}
+
+func TestInfluxDBSinkV1Write(t *testing.T) {
+	fake := &fakeInfluxDB{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s, err := newSink(strings.Replace(server.URL, "http://", "influxdb://user:pass@", 1) + "?version=1&db=naemon&rp=autogen")
+	require.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}))
+	require.Len(t, fake.requests, 1)
+	r := fake.requests[0]
+	assert.Equal(t, "/write", r.URL.Path)
+	assert.Equal(t, "naemon", r.URL.Query().Get("db"))
+	assert.Equal(t, "autogen", r.URL.Query().Get("rp"))
+	user, password, ok := r.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pass", password)
+	assert.False(t, r.URL.Query().Has("u"))
+	assert.False(t, r.URL.Query().Has("p"))
+}
+
+func TestInfluxDBSinkMissingOptions(t *testing.T) {
+	_, err := newSink("influxdb://localhost:8086?org=o")
+	assert.NotNil(t, err)
+	_, err = newSink("influxdb://localhost:8086?version=1")
+	assert.NotNil(t, err)
+	_, err = newSink("influxdb://localhost:8086?org=o&bucket=b&gzip=maybe")
+	assert.NotNil(t, err)
+}
+
+func TestInfluxDBSinkRetries(t *testing.T) {
+	fake := &fakeInfluxDB{failures: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&retry_interval=1ms&max_retries=2")
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}))
+	assert.Len(t, fake.requests, 3)
+	assert.Equal(t, 1, fake.count())
+}
+
+func TestInfluxDBSinkLeavesRetriesToTheQueue(t *testing.T) {
+	fake := &fakeInfluxDB{failures: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&retry_interval=1ms")
+	defer s.Close()
+
+	assert.NotNil(t, s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}))
+	assert.Len(t, fake.requests, 1)
+}
+
+func TestInfluxDBSinkGivesUp(t *testing.T) {
+	fake := &fakeInfluxDB{failures: []int{500, 500, 500}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&retry_interval=1ms&max_retries=2")
+	defer s.Close()
+
+	assert.NotNil(t, s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}))
+	assert.Len(t, fake.requests, 3)
+}
+
+func TestInfluxDBSinkNoRetryOnClientError(t *testing.T) {
+	fake := &fakeInfluxDB{failures: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&retry_interval=1ms")
+	defer s.Close()
+
+	assert.NotNil(t, s.Publish(&Batch{Data: []byte("garbage")}))
+	assert.Len(t, fake.requests, 1)
+}
+
+func TestInfluxDBSinkClosesWhileRetrying(t *testing.T) {
+	fake := &fakeInfluxDB{failures: []int{500, 500}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&retry_interval=1s&max_retries=1")
+
+	published := make(chan error)
+	go func() { published <- s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}) }()
+	assert.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.requests) == 1
+	}, time.Second, time.Millisecond)
+
+	// the retry is not sent after the sink was closed
+	start := time.Now()
+	require.Nil(t, s.Close())
+	assert.NotNil(t, <-published)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Len(t, fake.requests, 1)
+}
+
+func TestInfluxDBSinkHonoursRetryAfter(t *testing.T) {
+	fake := &fakeInfluxDB{failures: []int{http.StatusTooManyRequests}, retryAfter: "1"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestInfluxDBSink(t, server, "?org=o&bucket=b&retry_interval=1ms&max_retries=1")
+	defer s.Close()
+
+	start := time.Now()
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=h value=0i 1\n")}))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+func init() {
+	registerSink(newKafkaSink, "kafka")
+}
+
+// kafkaSink produces each batch as a single message (the line protocol payload) to a Kafka topic.
+//
+// URL format: kafka://broker1:9092[,broker2:9092...]?options
+//
+// options:
+//
+//	topic        topic to produce to (default "naemon")
+//	key          tag whose value is used as partition key, so e.g. all metrics of a host stay ordered (default
+//	             "host"); set to an empty value to distribute the messages randomly
+//	acks         required acks: none, leader or all (default all)
+//	compression  none, gzip, snappy, lz4 or zstd (default none)
+//	idempotent   enable the idempotent producer, requires acks=all (default false)
+//	version      Kafka version of the brokers (default: sarama's default version)
+//	client_id    client id reported to the brokers (default "ocxp-sender")
+//	format       payload format: lineprotocol (default) or json
+type kafkaSink struct {
+	client   sarama.Client
+	producer sarama.SyncProducer
+	topic    string
+	key      string
+	format   payloadFormat
+
+	mu     sync.RWMutex
+	closed bool
+	// sending counts the publishes in flight, which Close waits for before it closes the producer
+	sending sync.WaitGroup
+
+	// the result of the last metadata refresh, see Health
+	healthMu   sync.Mutex
+	healthErr  error
+	checked    time.Time
+	refreshing bool
+}
+
+// kafkaHealthInterval is the minimum age of the last metadata refresh before Health starts a new one
+const kafkaHealthInterval = time.Second
+
+func newKafkaSink(u *url.URL) (Sink, error) {
+	config, err := kafkaConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	options := newSinkOptions(u)
+	topic := options.String("topic", ExchangeName)
+	format := options.Format(formatLineProtocol)
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	s, err := newKafkaSinkWithConfig(strings.Split(u.Host, ","), topic, kafkaKey(u), config)
+	if err != nil {
+		return nil, err
+	}
+	s.format = format
+	return s, nil
+}
+
+// kafkaKey returns the key option, which, unlike the other options, may explicitly be set to an empty value
+func kafkaKey(u *url.URL) string {
+	if values, ok := u.Query()["key"]; ok {
+		return values[0]
+	}
+	return "host"
+}
+
+// kafkaConfig translates the URL options into a producer configuration
+func kafkaConfig(u *url.URL) (*sarama.Config, error) {
+	options := newSinkOptions(u)
+	config := sarama.NewConfig()
+	config.ClientID = options.String("client_id", "ocxp-sender")
+	config.Producer.Return.Successes = true // required by the sync producer
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+
+	switch acks := options.String("acks", "all"); acks {
+	case "none", "0":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "leader", "1":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all", "-1":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("unsupported Kafka acks level %q", acks)
+	}
+
+	compression := options.String("compression", "none")
+	if err := config.Producer.Compression.UnmarshalText([]byte(compression)); err != nil {
+		return nil, fmt.Errorf("unsupported Kafka compression %q", compression)
+	}
+
+	if version := options.String("version", ""); version != "" {
+		v, err := sarama.ParseKafkaVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = v
+	}
+
+	if options.Bool("idempotent", false) {
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	return config, config.Validate()
+}
+
+func newKafkaSinkWithConfig(brokers []string, topic string, key string, config *sarama.Config) (*kafkaSink, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	// the client has just fetched the metadata
+	return &kafkaSink{client: client, producer: producer, topic: topic, key: key, format: formatLineProtocol, checked: time.Now()}, nil
+}
+
+func (s *kafkaSink) Publish(batch *Batch) error {
+	// the lock is not held while sending, so that Health and Close do not wait for the brokers
+	s.mu.RLock()
+	producer, closed := s.producer, s.closed
+	if !closed {
+		s.sending.Add(1)
+	}
+	s.mu.RUnlock()
+	if closed {
+		return errors.New("Kafka sink is closed")
+	}
+	defer s.sending.Done()
+
+	value, err := s.format.Encode(batch)
+	if err != nil {
+		return err
+	}
+	message := &sarama.ProducerMessage{
+		Topic: s.topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	if s.key != "" {
+		if key := batch.Tag(s.key); key != "" {
+			message.Key = sarama.StringEncoder(key)
+		}
+	}
+	if _, _, err = producer.SendMessage(message); err != nil {
+		// the brokers may be gone, which the next Health should know
+		s.refreshMetadata()
+	}
+	return err
+}
+
+// Health returns the result of the last metadata refresh, without waiting for the brokers: if that result is older
+// than kafkaHealthInterval, a new refresh is started in the background for the next call
+func (s *kafkaSink) Health() error {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return errors.New("Kafka sink is closed")
+	}
+	s.healthMu.Lock()
+	err, checked := s.healthErr, s.checked
+	s.healthMu.Unlock()
+	if time.Since(checked) >= kafkaHealthInterval {
+		s.refreshMetadata()
+	}
+	return err
+}
+
+// refreshMetadata refreshes the metadata of the topic in the background, unless that is already running, and keeps
+// the result for Health
+func (s *kafkaSink) refreshMetadata() {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if s.refreshing {
+		return
+	}
+	s.refreshing = true
+	go func() {
+		err := s.client.RefreshMetadata(s.topic)
+		s.healthMu.Lock()
+		defer s.healthMu.Unlock()
+		s.healthErr, s.checked, s.refreshing = err, time.Now(), false
+	}()
+}
+
+func (s *kafkaSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	// sending to a closed producer would panic
+	s.sending.Wait()
+	err := s.producer.Close()
+	s.client.Close()
+	return err
+}
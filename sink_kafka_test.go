@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeKafkaBroker starts an in-process broker that is the leader of the given topic and accepts everything
+func newFakeKafkaBroker(t *testing.T, topic string) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t).SetApiKeys([]sarama.ApiVersionsResponseKey{
+			{ApiKey: 0, MinVersion: 0, MaxVersion: 3},  // Produce
+			{ApiKey: 3, MinVersion: 0, MaxVersion: 4},  // Metadata
+			{ApiKey: 18, MinVersion: 0, MaxVersion: 3}, // ApiVersions
+			{ApiKey: 22, MinVersion: 0, MaxVersion: 0}, // InitProducerID
+		}),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"InitProducerIDRequest": sarama.NewMockInitProducerIDResponse(t),
+		"ProduceRequest":        sarama.NewMockProduceResponse(t),
+	})
+	return broker
+}
+
+func countProduceRequests(broker *sarama.MockBroker) int {
+	count := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestKafkaSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		broker := newFakeKafkaBroker(t, "naemon")
+		u, _ := url.Parse("kafka://" + broker.Addr() + "?idempotent=true&compression=snappy&version=0.11.0.0")
+		config, err := kafkaConfig(u)
+		require.Nil(t, err)
+		config.Metadata.Retry.Max = 0
+		config.Producer.Flush.MaxMessages = 1 // one request per message, so that the broker history can be counted
+		s, err := newKafkaSinkWithConfig([]string{broker.Addr()}, "naemon", "host", config)
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink:        s,
+			delivered:   func() int { return countProduceRequests(broker) },
+			stopBackend: broker.Close,
+		}
+	})
+}
+
+func TestKafkaSinkHealthDoesNotWaitForBrokers(t *testing.T) {
+	broker := newFakeKafkaBroker(t, "naemon")
+	u, _ := url.Parse("kafka://" + broker.Addr())
+	config, err := kafkaConfig(u)
+	require.Nil(t, err)
+	s, err := newKafkaSinkWithConfig([]string{broker.Addr()}, "naemon", "host", config)
+	require.Nil(t, err)
+	defer s.Close()
+
+	// with the default retries, a metadata refresh takes a while to fail
+	broker.Close()
+	start := time.Now()
+	assert.Nil(t, s.Health())
+	assert.Nil(t, s.Health())
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Eventually(t, func() bool { return s.Health() != nil }, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestKafkaSinkPartitionKey(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+	s := &kafkaSink{producer: producer, topic: "naemon", key: "host"}
+
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		assert.Equal(t, "naemon", m.Topic)
+		assert.Equal(t, sarama.StringEncoder("abc.com"), m.Key)
+		assert.Equal(t, sarama.ByteEncoder("state,host=abc.com,service=ping value=0i 1\n"), m.Value)
+		return nil
+	})
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+}
+
+func TestKafkaConfig(t *testing.T) {
+	u, _ := url.Parse("kafka://a:9092,b:9092?acks=leader&compression=lz4")
+	config, err := kafkaConfig(u)
+	require.Nil(t, err)
+	assert.Equal(t, sarama.WaitForLocal, config.Producer.RequiredAcks)
+	assert.Equal(t, sarama.CompressionLZ4, config.Producer.Compression)
+	assert.Equal(t, "host", kafkaKey(u))
+
+	u, _ = url.Parse("kafka://a:9092?key=")
+	assert.Equal(t, "", kafkaKey(u))
+
+	// the idempotent producer requires acks from all in-sync replicas
+	u, _ = url.Parse("kafka://a:9092?idempotent=true&acks=leader")
+	_, err = kafkaConfig(u)
+	assert.NotNil(t, err)
+
+	u, _ = url.Parse("kafka://a:9092?compression=brotli")
+	_, err = kafkaConfig(u)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	protocol "github.com/influxdata/line-protocol"
+)
+
+func init() {
+	registerSink(newMQTTSink, "mqtt", "mqtts")
+}
+
+// mqttSink publishes batches to an MQTT broker (MQTT 3.1, 3.1.1 and 5). mqtts:// connects with TLS.
+//
+// URL format: mqtt[s]://[user:password@]host:port?options
+//
+// options:
+//
+//	topic          topic template; {measurement} and {<tag>} (e.g. {host}, {service}) are replaced by the values
+//	               of the line (default "naemon/{host}/{service}")
+//	qos            0, 1 or 2 (default 1)
+//	retain_state   publish the state lines as retained messages, so that subscribers immediately get the last
+//	               state (default false)
+//	format         payload format: lineprotocol (default) or json (one check result document per batch)
+//	client_id      client id (default "ocxp-sender-<hostname>")
+//	clean_session  start without a persistent session (default false, i.e. the broker keeps the session)
+//	store          directory to persist in-flight messages in, so QoS 1/2 messages survive a restart
+//	version        protocol version: 3 (MQTT 3.1), 4 (MQTT 3.1.1, default) or 5 (MQTT 5)
+//	timeout        how long to wait for the broker to acknowledge a connect or publish (default 10s)
+//	ca, cert, key, insecure_skip_verify  TLS settings (mqtts only)
+type mqttSink struct {
+	client      mqttClient
+	topic       string
+	qos         byte
+	retainState bool
+	format      payloadFormat
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newMQTTSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	qos := options.Int("qos", 1)
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("unsupported MQTT QoS %v", qos)
+	}
+	s := &mqttSink{
+		topic:       options.String("topic", "naemon/{host}/{service}"),
+		qos:         byte(qos),
+		retainState: options.Bool("retain_state", false),
+		format:      options.Format(formatLineProtocol),
+	}
+
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch version := options.Int("version", 4); version {
+	case 3, 4:
+		s.client, err = newMQTT3Client(u, options, uint(version))
+	case 5:
+		s.client, err = newMQTT5Client(u, options)
+	default:
+		err = fmt.Errorf("unsupported MQTT version %v", version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// mqttClient is the connection of the sink to the broker
+type mqttClient interface {
+	// publish publishes the messages and waits until the broker has acknowledged them (as far as the QoS requires)
+	publish(messages []*mqttMessage, qos byte) error
+	connected() bool
+	// reconnects returns how often the connection was re-established
+	reconnects() uint64
+	disconnect()
+}
+
+// mqtt3Client connects with MQTT 3.1 or 3.1.1, using paho.mqtt.golang
+type mqtt3Client struct {
+	client  mqtt.Client
+	timeout time.Duration
+	// connects counts the connections, the first one and the automatic reconnects
+	connects atomic.Uint64
+}
+
+func newMQTT3Client(u *url.URL, options *sinkOptions, version uint) (*mqtt3Client, error) {
+	c := &mqtt3Client{timeout: options.Duration("timeout", 10*time.Second)}
+	clientOptions := mqtt.NewClientOptions().
+		SetClientID(options.String("client_id", defaultMQTTClientID())).
+		SetCleanSession(options.Bool("clean_session", false)).
+		SetProtocolVersion(version).
+		SetConnectTimeout(c.timeout).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(func(mqtt.Client) { c.connects.Add(1) })
+	if u.Scheme == "mqtts" {
+		clientOptions.AddBroker("ssl://" + u.Host)
+		clientOptions.SetTLSConfig(options.TLSConfig())
+	} else {
+		clientOptions.AddBroker("tcp://" + u.Host)
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		clientOptions.SetUsername(u.User.Username())
+		clientOptions.SetPassword(password)
+	}
+	if store := options.String("store", ""); store != "" {
+		clientOptions.SetStore(mqtt.NewFileStore(store))
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+
+	c.client = mqtt.NewClient(clientOptions)
+	if err := c.wait(c.client.Connect()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *mqtt3Client) publish(messages []*mqttMessage, qos byte) error {
+	tokens := make([]mqtt.Token, 0, len(messages))
+	for _, msg := range messages {
+		tokens = append(tokens, c.client.Publish(msg.topic, qos, msg.retained, msg.payload))
+	}
+	for _, token := range tokens {
+		if err := c.wait(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait waits for a token to complete within the configured timeout
+func (c *mqtt3Client) wait(token mqtt.Token) error {
+	if !token.WaitTimeout(c.timeout) {
+		return errMQTTTimeout
+	}
+	return token.Error()
+}
+
+func (c *mqtt3Client) connected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqtt3Client) reconnects() uint64 {
+	return max(c.connects.Load(), 1) - 1
+}
+
+func (c *mqtt3Client) disconnect() {
+	c.client.Disconnect(250)
+}
+
+var errMQTTTimeout = errors.New("timeout while waiting for the MQTT broker")
+
+func defaultMQTTClientID() string {
+	hostname, _ := os.Hostname()
+	return "ocxp-sender-" + hostname
+}
+
+// mqttMessage is a single MQTT message to publish
+type mqttMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+// messages splits a batch into messages: lines are grouped by their topic, and state lines are kept apart if they
+// are to be retained. In JSON format, the whole batch is one document published to the topic of its first line.
+func (s *mqttSink) messages(batch *Batch) ([]*mqttMessage, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+
+	if s.format == formatJSON {
+		payload, err := s.format.Encode(batch)
+		if err != nil {
+			return nil, err
+		}
+		// the document is only retained if it carries the state, which a batch split by routing rules may not
+		return []*mqttMessage{{topic: s.renderTopic(metrics[0]), retained: slices.ContainsFunc(metrics, s.retained), payload: payload}}, nil
+	}
+
+	parts, err := splitBatch(batch, func(m protocol.Metric) string {
+		key := s.renderTopic(m)
+		if s.retained(m) {
+			key += "\x00retained"
+		}
+		return key
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*mqttMessage, 0, len(parts))
+	for _, part := range parts {
+		messages = append(messages, &mqttMessage{topic: s.renderTopic(part.first), retained: s.retained(part.first), payload: part.data})
+	}
+	return messages, nil
+}
+
+// topicLevelReplacer removes characters from tag values that have a special meaning in MQTT topics
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+func (s *mqttSink) renderTopic(m protocol.Metric) string {
+	return renderTemplate(s.topic, m, topicLevelReplacer.Replace)
+}
+
+func (s *mqttSink) retained(m protocol.Metric) bool {
+	return s.retainState && m.Name() == "state"
+}
+
+func (s *mqttSink) Publish(batch *Batch) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("MQTT sink is closed")
+	}
+
+	messages, err := s.messages(batch)
+	if err != nil {
+		return err
+	}
+	return s.client.publish(messages, s.qos)
+}
+
+func (s *mqttSink) Reconnects() uint64 {
+	return s.client.reconnects()
+}
+
+func (s *mqttSink) Health() error {
+	if !s.client.connected() {
+		return errors.New("MQTT connection is not open")
+	}
+	return nil
+}
+
+func (s *mqttSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.client.disconnect()
+	}
+	return nil
+}
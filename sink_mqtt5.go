@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+)
+
+// mqtt5Client connects with MQTT 5, using paho.golang. It takes the same options as mqtt3Client: without
+// clean_session, the session never expires on the broker, like a persistent session of MQTT 3.1.1.
+type mqtt5Client struct {
+	manager *autopaho.ConnectionManager
+	timeout time.Duration
+	up      atomic.Bool
+	// connects counts the connections, the first one and the automatic reconnects
+	connects atomic.Uint64
+}
+
+func newMQTT5Client(u *url.URL, options *sinkOptions) (*mqtt5Client, error) {
+	c := &mqtt5Client{timeout: options.Duration("timeout", 10*time.Second)}
+	broker := &url.URL{Scheme: "mqtt", Host: u.Host}
+	config := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{broker},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: options.Bool("clean_session", false),
+		ConnectTimeout:                c.timeout,
+		OnConnectionUp:                func(*autopaho.ConnectionManager, *paho.Connack) { c.connects.Add(1); c.up.Store(true) },
+		OnConnectionDown:              func() bool { c.up.Store(false); return true },
+		ClientConfig:                  paho.ClientConfig{ClientID: options.String("client_id", defaultMQTTClientID())},
+	}
+	if !config.CleanStartOnInitialConnection {
+		config.SessionExpiryInterval = math.MaxUint32
+	}
+	if u.Scheme == "mqtts" {
+		broker.Scheme = "mqtts"
+		config.TlsCfg = options.TLSConfig()
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		config.ConnectUsername = u.User.Username()
+		config.ConnectPassword = []byte(password)
+	}
+	if store := options.String("store", ""); store != "" {
+		clientStore, err := file.New(store, "client-", ".pkt")
+		if err != nil {
+			return nil, err
+		}
+		serverStore, err := file.New(store, "server-", ".pkt")
+		if err != nil {
+			return nil, err
+		}
+		config.Session = state.New(clientStore, serverStore)
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+
+	// the first connection attempt must succeed, later ones are retried in the background
+	connectErrors := make(chan error, 1)
+	config.OnConnectError = func(err error) {
+		select {
+		case connectErrors <- err:
+		default:
+		}
+	}
+	var err error
+	if c.manager, err = autopaho.NewConnection(context.Background(), config); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	connected := make(chan error, 1)
+	go func() { connected <- c.manager.AwaitConnection(ctx) }()
+	select {
+	case err = <-connected:
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errMQTTTimeout
+		}
+	case err = <-connectErrors:
+		err = fmt.Errorf("failed to connect to the MQTT broker: %w", err)
+	}
+	if err != nil {
+		c.disconnect()
+		return nil, err
+	}
+	return c, nil
+}
+
+// publish publishes the messages concurrently, like mqtt3Client does
+func (c *mqtt5Client) publish(messages []*mqttMessage, qos byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	errs := make(chan error, len(messages))
+	for _, msg := range messages {
+		go func() {
+			_, err := c.manager.Publish(ctx, &paho.Publish{Topic: msg.topic, QoS: qos, Retain: msg.retained, Payload: msg.payload})
+			errs <- err
+		}()
+	}
+	var firstErr error
+	for range messages {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if errors.Is(firstErr, context.DeadlineExceeded) {
+		return errMQTTTimeout
+	}
+	return firstErr
+}
+
+func (c *mqtt5Client) connected() bool {
+	return c.up.Load()
+}
+
+func (c *mqtt5Client) reconnects() uint64 {
+	return max(c.connects.Load(), 1) - 1
+}
+
+func (c *mqtt5Client) disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	c.manager.Disconnect(ctx)
+}
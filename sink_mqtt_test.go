@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMQTTBroker is an in-process MQTT broker that records every message published below naemon/
+type fakeMQTTBroker struct {
+	server    *mochi.Server
+	address   string
+	closeOnce sync.Once
+	mu        sync.Mutex
+	received  []packets.Packet
+}
+
+func newFakeMQTTBroker(t *testing.T) *fakeMQTTBroker {
+	b := &fakeMQTTBroker{server: mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})}
+	require.Nil(t, b.server.AddHook(new(auth.AllowHook), nil))
+	listener := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	require.Nil(t, b.server.AddListener(listener))
+	b.address = listener.Address()
+	require.Nil(t, b.server.Serve())
+	require.Nil(t, b.server.Subscribe("naemon/#", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.received = append(b.received, pk)
+	}))
+	return b
+}
+
+func (b *fakeMQTTBroker) close() {
+	b.closeOnce.Do(func() { b.server.Close() })
+}
+
+func (b *fakeMQTTBroker) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.received)
+}
+
+func (b *fakeMQTTBroker) messages() []packets.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]packets.Packet(nil), b.received...)
+}
+
+func TestMQTTSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		broker := newFakeMQTTBroker(t)
+		t.Cleanup(broker.close)
+		s, err := newSink("mqtt://" + broker.address + "?client_id=conformance&timeout=1s")
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink:        s,
+			delivered:   broker.count,
+			stopBackend: broker.close,
+		}
+	})
+}
+
+func TestMQTT5SinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		broker := newFakeMQTTBroker(t)
+		t.Cleanup(broker.close)
+		s, err := newSink("mqtt://" + broker.address + "?client_id=conformance&timeout=1s&version=5")
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink:        s,
+			delivered:   broker.count,
+			stopBackend: broker.close,
+		}
+	})
+}
+
+func TestMQTTSinkTopicsAndRetain(t *testing.T) {
+	for _, version := range []string{"4", "5"} {
+		t.Run("version "+version, func(t *testing.T) {
+			testMQTTSinkTopicsAndRetain(t, version)
+		})
+	}
+}
+
+func testMQTTSinkTopicsAndRetain(t *testing.T, version string) {
+	broker := newFakeMQTTBroker(t)
+	defer broker.close()
+	s, err := newSink("mqtt://" + broker.address + "?topic=naemon/{host}/{service}/{measurement}&qos=2&retain_state=true&version=" + version)
+	require.Nil(t, err)
+	defer s.Close()
+
+	data := "metric,host=abc.com,label=rta,service=CI/Alive value=1.238 1\nmetric,host=abc.com,label=pl,service=CI/Alive value=0 1\nstate,host=abc.com,service=CI/Alive value=0i 1\n"
+	require.Nil(t, s.Publish(&Batch{Data: []byte(data)}))
+	require.Eventually(t, func() bool { return broker.count() == 2 }, time.Second, 10*time.Millisecond)
+
+	messages := broker.messages()
+	sort.Slice(messages, func(i, j int) bool { return messages[i].TopicName < messages[j].TopicName })
+	assert.Equal(t, "naemon/abc.com/CI_Alive/metric", messages[0].TopicName)
+	assert.Equal(t, "metric,host=abc.com,label=rta,service=CI/Alive value=1.238 1\nmetric,host=abc.com,label=pl,service=CI/Alive value=0 1\n", string(messages[0].Payload))
+	assert.False(t, messages[0].FixedHeader.Retain)
+	assert.Equal(t, "naemon/abc.com/CI_Alive/state", messages[1].TopicName)
+	assert.Equal(t, "state,host=abc.com,service=CI/Alive value=0i 1\n", string(messages[1].Payload))
+	assert.True(t, messages[1].FixedHeader.Retain)
+}
+
+func TestMQTT5SinkStore(t *testing.T) {
+	broker := newFakeMQTTBroker(t)
+	defer broker.close()
+	s, err := newSink("mqtt://" + broker.address + "?version=5&qos=1&store=" + t.TempDir())
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+	require.Eventually(t, func() bool { return broker.count() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMQTTSinkJSON(t *testing.T) {
+	broker := newFakeMQTTBroker(t)
+	defer broker.close()
+	s, err := newSink("mqtt://" + broker.address + "?format=json")
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Publish(&Batch{Data: []byte("metric,host=abc.com,label=rta,service=ping,uom=ms value=1.238,warn=3000 1\nstate,host=abc.com,service=ping value=0i,output=\"OK\" 1\n")}))
+	require.Eventually(t, func() bool { return broker.count() == 1 }, time.Second, 10*time.Millisecond)
+
+	message := broker.messages()[0]
+	assert.Equal(t, "naemon/abc.com/ping", message.TopicName)
+	var result checkResult
+	require.Nil(t, json.Unmarshal(message.Payload, &result))
+	assert.Equal(t, "abc.com", result.Host)
+	assert.Equal(t, "OK", result.Output)
+	require.Len(t, result.PerfData, 1)
+	assert.Equal(t, "rta", result.PerfData[0].Label)
+	assert.Equal(t, 3000.0, *result.PerfData[0].Warn)
+}
+
+func TestMQTTSinkJSONRetainsOnlyState(t *testing.T) {
+	broker := newFakeMQTTBroker(t)
+	defer broker.close()
+	s, err := newSink("mqtt://" + broker.address + "?format=json&retain_state=true&qos=1")
+	require.Nil(t, err)
+	defer s.Close()
+
+	// e.g. the metric lines that a routing rule split off the state line
+	require.Nil(t, s.Publish(&Batch{Data: []byte("metric,host=abc.com,label=rta,service=ping,uom=ms value=1.238 1\n")}))
+	require.Nil(t, s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i,output=\"OK\" 1\n")}))
+	require.Eventually(t, func() bool { return broker.count() == 2 }, time.Second, 10*time.Millisecond)
+
+	messages := broker.messages()
+	assert.False(t, messages[0].FixedHeader.Retain)
+	assert.True(t, messages[1].FixedHeader.Retain)
+}
+
+func TestMQTTSinkInvalidOptions(t *testing.T) {
+	_, err := newSink("mqtt://localhost:1883?qos=3")
+	assert.NotNil(t, err)
+	// would wrap around to QoS 2 as a byte
+	_, err = newSink("mqtt://localhost:1883?qos=258")
+	assert.EqualError(t, err, "unsupported MQTT QoS 258")
+	_, err = newSink("mqtt://localhost:1883?qos=-1")
+	assert.NotNil(t, err)
+	_, err = newSink("mqtt://localhost:1883?format=xml")
+	assert.NotNil(t, err)
+	_, err = newSink("mqtt://localhost:1883?version=6")
+	assert.EqualError(t, err, "unsupported MQTT version 6")
+}
+
+func TestMQTT5SinkConnectFails(t *testing.T) {
+	broker := newFakeMQTTBroker(t)
+	address := broker.address
+	broker.close()
+	_, err := newSink("mqtt://" + address + "?version=5&timeout=5s")
+	assert.ErrorContains(t, err, "failed to connect to the MQTT broker")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func init() {
+	registerSink(newNATSSink, "nats")
+}
+
+// natsSink publishes batches to NATS subjects over a single long-lived connection, optionally with JetStream
+// acknowledgements.
+//
+// URL format: nats://[user:password@|token@]host:port[,host:port...]?options
+//
+// options:
+//
+//	subject    subject template; {measurement} and {<tag>} are replaced by the values of the line, lines with
+//	           the same subject are published as one message (default "naemon.{host}.{service}")
+//	jetstream  publish to JetStream and wait for the ack of the stream (default false); every message carries a
+//	           Nats-Msg-Id derived from its content, so that retried batches are dropped as duplicates
+//	format     payload format: lineprotocol (default) or json (one check result document per batch, published to
+//	           the subject of its first line)
+//	timeout    how long to wait for the server to confirm a publish (default 10s)
+//	creds      credentials file (JWT and NKey seed)
+//	tls        connect with TLS (default false); ca, cert, key and insecure_skip_verify configure it
+type natsSink struct {
+	connection *nats.Conn
+	jetStream  jetstream.JetStream
+	subject    string
+	format     payloadFormat
+	timeout    time.Duration
+}
+
+func newNATSSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	s := &natsSink{
+		subject: options.String("subject", "naemon.{host}.{service}"),
+		format:  options.Format(formatLineProtocol),
+		timeout: options.Duration("timeout", 10*time.Second),
+	}
+	useJetStream := options.Bool("jetstream", false)
+
+	natsOptions := []nats.Option{
+		nats.Name("ocxp-sender"),
+		nats.Timeout(s.timeout),
+		nats.MaxReconnects(-1),
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			natsOptions = append(natsOptions, nats.UserInfo(u.User.Username(), password))
+		} else {
+			natsOptions = append(natsOptions, nats.Token(u.User.Username()))
+		}
+	}
+	if creds := options.String("creds", ""); creds != "" {
+		natsOptions = append(natsOptions, nats.UserCredentials(creds))
+	}
+	if options.Bool("tls", false) {
+		natsOptions = append(natsOptions, nats.Secure(options.TLSConfig()))
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+
+	// nats.Connect accepts a comma separated list of server URLs
+	servers := strings.Split(u.Host, ",")
+	for i, server := range servers {
+		servers[i] = "nats://" + server
+	}
+	connection, err := nats.Connect(strings.Join(servers, ","), natsOptions...)
+	if err != nil {
+		return nil, err
+	}
+	s.connection = connection
+	if useJetStream {
+		s.jetStream, err = jetstream.New(connection)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// subjectTokenReplacer removes characters from tag values that have a special meaning in NATS subjects
+var subjectTokenReplacer = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+
+func (s *natsSink) renderSubject(m protocol.Metric) string {
+	return renderTemplate(s.subject, m, subjectTokenReplacer.Replace)
+}
+
+func (s *natsSink) Publish(batch *Batch) error {
+	var parts []*batchPart
+	var err error
+	if s.format == formatJSON {
+		parts, err = s.jsonParts(batch)
+	} else {
+		parts, err = splitBatch(batch, s.renderSubject)
+	}
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		subject := s.renderSubject(part.first)
+		if s.jetStream != nil {
+			err = s.publishJetStream(subject, part.data)
+		} else {
+			err = s.connection.Publish(subject, part.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.jetStream == nil {
+		// make sure the server has received everything before reporting success
+		return s.connection.FlushTimeout(s.timeout)
+	}
+	return nil
+}
+
+func (s *natsSink) Reconnects() uint64 {
+	return s.connection.Stats().Reconnects
+}
+
+// jsonParts returns the batch as a single JSON document
+func (s *natsSink) jsonParts(batch *Batch) ([]*batchPart, error) {
+	metrics, err := batch.Metrics()
+	if err != nil || len(metrics) == 0 {
+		return nil, err
+	}
+	data, err := s.format.Encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	return []*batchPart{{first: metrics[0], data: data}}, nil
+}
+
+func (s *natsSink) publishJetStream(subject string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err := s.jetStream.Publish(ctx, subject, data, jetstream.WithMsgID(messageID(subject, data)))
+	return err
+}
+
+// messageID derives a deduplication id from a message's content, so that a retried publish gets the same id
+func messageID(subject string, data []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(subject))
+	hash.Write([]byte{0})
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (s *natsSink) Health() error {
+	if !s.connection.IsConnected() {
+		return errors.New("NATS connection is " + s.connection.Status().String())
+	}
+	return nil
+}
+
+func (s *natsSink) Close() error {
+	s.connection.Close()
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestNATSServer(t *testing.T) *server.Server {
+	options := natsserver.DefaultTestOptions
+	options.Port = -1
+	options.JetStream = true
+	options.StoreDir = t.TempDir()
+	s := natsserver.RunServer(&options)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// subscribeNATS counts the messages published below naemon.
+func subscribeNATS(t *testing.T, s *server.Server) func() int {
+	connection, err := nats.Connect(s.ClientURL())
+	require.Nil(t, err)
+	t.Cleanup(connection.Close)
+	var mu sync.Mutex
+	count := 0
+	_, err = connection.Subscribe("naemon.>", func(msg *nats.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+	})
+	require.Nil(t, err)
+	require.Nil(t, connection.Flush())
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+}
+
+func TestNATSSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		s := newTestNATSServer(t)
+		count := subscribeNATS(t, s)
+		sink, err := newSink("nats://" + s.Addr().String() + "?timeout=1s")
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink:        sink,
+			delivered:   count,
+			stopBackend: s.Shutdown,
+		}
+	})
+}
+
+func TestNATSSinkSubjects(t *testing.T) {
+	s := newTestNATSServer(t)
+	connection, err := nats.Connect(s.ClientURL())
+	require.Nil(t, err)
+	defer connection.Close()
+	subscription, err := connection.SubscribeSync("naemon.>")
+	require.Nil(t, err)
+	require.Nil(t, connection.Flush())
+
+	sink, err := newSink("nats://" + s.Addr().String() + "?subject=naemon.{host}.{measurement}")
+	require.Nil(t, err)
+	defer sink.Close()
+	require.Nil(t, sink.Publish(&Batch{Data: []byte("metric,host=abc.com,label=rta value=1 1\nstate,host=abc.com value=0i 1\n")}))
+
+	msg, err := subscription.NextMsg(time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "naemon.abc_com.metric", msg.Subject)
+	assert.Equal(t, "metric,host=abc.com,label=rta value=1 1\n", string(msg.Data))
+	msg, err = subscription.NextMsg(time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, "naemon.abc_com.state", msg.Subject)
+}
+
+func TestNATSSinkJetStreamDeduplicates(t *testing.T) {
+	s := newTestNATSServer(t)
+	connection, err := nats.Connect(s.ClientURL())
+	require.Nil(t, err)
+	defer connection.Close()
+	js, err := jetstream.New(connection)
+	require.Nil(t, err)
+	stream, err := js.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:       "NAEMON",
+		Subjects:   []string{"naemon.>"},
+		Duplicates: time.Minute,
+	})
+	require.Nil(t, err)
+
+	sink, err := newSink("nats://" + s.Addr().String() + "?jetstream=true")
+	require.Nil(t, err)
+	defer sink.Close()
+
+	batch := &Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}
+	require.Nil(t, sink.Publish(batch))
+	require.Nil(t, sink.Publish(batch)) // a retry of the same batch
+	require.Nil(t, sink.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 2\n")}))
+
+	info, err := stream.Info(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), info.State.Msgs)
+}
+
+func TestNATSSinkJetStreamWithoutStream(t *testing.T) {
+	s := newTestNATSServer(t)
+	sink, err := newSink("nats://" + s.Addr().String() + "?jetstream=true&timeout=500ms")
+	require.Nil(t, err)
+	defer sink.Close()
+
+	// without a stream for the subject, there is no ack, which must not be reported as success
+	assert.NotNil(t, sink.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+}
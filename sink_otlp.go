@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	registerSink(newOTLPSink, "otlp", "otlps")
+}
+
+// otlpSink exports the data as OpenTelemetry metrics using OTLP/HTTP with protobuf encoding. The daemon collects the
+// data points of many batches and sends them in one request.
+//
+// Every "metric" line becomes a Gauge data point of the metric named after the name template, with the uom as unit;
+// its warn, crit, min and max fields become data points of sibling metrics with the suffixes .warn, .crit, .min and
+// .max. The "state" line becomes a data point of the state_name metric. The host is reported as the host.name
+// resource attribute, all other tags (service, label and the variables) as data point attributes.
+//
+// URL format: otlp[s]://host:port/path?options (otlps uses HTTPS, the path defaults to /v1/metrics)
+//
+// options:
+//
+//	name            name template of the perfdata metrics; {measurement} and {<tag>} are replaced by the values of
+//	                the line (default "naemon.{service}.{label}")
+//	state_name      name of the state metric (default "naemon.state")
+//	headers         additional request headers, e.g. for authentication: "key1=value1,key2=value2"
+//	gzip            gzip-compress the request body (default false)
+//	max_points      maximum number of data points per request (default 500)
+//	flush_interval  how long data points are collected before a request is sent (default 1s)
+//	timeout, max_retries, retry_interval  see httpPoster
+type otlpSink struct {
+	poster    *httpPoster
+	exportURL string
+	name      string
+	stateName string
+	gzip      bool
+	batcher   *batcher[otlpPoint]
+}
+
+func newOTLPSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	s := &otlpSink{
+		poster:    newHTTPPoster(options, 3),
+		name:      options.String("name", "naemon.{service}.{label}"),
+		stateName: options.String("state_name", "naemon.state"),
+		gzip:      options.Bool("gzip", false),
+	}
+	s.batcher = newBatcher(options.Int("max_points", 500), options.Duration("flush_interval", time.Second), s.export, s.poster.retryWait)
+
+	export := url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "otlps" {
+		export.Scheme = "https"
+	}
+	if export.Path == "" {
+		export.Path = "/v1/metrics"
+	}
+	s.exportURL = export.String()
+
+	s.poster.header.Set("Content-Type", "application/x-protobuf")
+	s.poster.header.Set("User-Agent", "ocxp-sender")
+	if s.gzip {
+		s.poster.header.Set("Content-Encoding", "gzip")
+	}
+	if headers := options.String("headers", ""); headers != "" {
+		for _, header := range strings.Split(headers, ",") {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return nil, fmt.Errorf("invalid value for sink option headers: %q is not in the form key=value", header)
+			}
+			s.poster.header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// otlpPoint is a single Gauge data point together with the metric and resource it belongs to
+type otlpPoint struct {
+	host       string
+	name       string
+	unit       string
+	attributes []label // sorted by name
+	value      float64
+	timestamp  int64 // nanoseconds
+}
+
+var regexInvalidInstrumentNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.\-/]`)
+
+// sanitizeInstrumentName replaces the characters that are not allowed in OpenTelemetry instrument names
+func sanitizeInstrumentName(name string) string {
+	return regexInvalidInstrumentNameChars.ReplaceAllString(name, "_")
+}
+
+// otlpUnits maps the units of measurement of the Naemon plugin API to UCUM units, as recommended by OpenTelemetry
+var otlpUnits = map[string]string{
+	"B":  "By",
+	"KB": "kBy",
+	"MB": "MBy",
+	"GB": "GBy",
+	"TB": "TBy",
+	"c":  "1",
+}
+
+func otlpUnit(uom string) string {
+	if unit, ok := otlpUnits[uom]; ok {
+		return unit
+	}
+	return uom
+}
+
+// points maps the lines of a batch to data points
+func (s *otlpSink) points(batch *Batch) ([]otlpPoint, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	var points []otlpPoint
+	for _, m := range metrics {
+		var name string
+		switch m.Name() {
+		case "metric":
+			name = sanitizeInstrumentName(renderTemplate(s.name, m, sanitizeInstrumentName))
+		case "state":
+			name = s.stateName
+		default:
+			name = sanitizeInstrumentName(m.Name())
+		}
+		unit := otlpUnit(tagValue(m, "uom"))
+		attributes := otlpAttributes(m)
+		for _, field := range m.FieldList() {
+			value, ok := numericValue(field.Value)
+			if !ok {
+				continue // e.g. the output of the state
+			}
+			metricName := name
+			if field.Key != "value" {
+				metricName += "." + sanitizeInstrumentName(field.Key)
+			}
+			points = append(points, otlpPoint{
+				host:       tagValue(m, "host"),
+				name:       metricName,
+				unit:       unit,
+				attributes: attributes,
+				value:      value,
+				timestamp:  m.Time().UnixNano(),
+			})
+		}
+	}
+	return points, nil
+}
+
+// otlpAttributes returns the tags of a line as data point attributes sorted by name, except for host (a resource
+// attribute) and uom (the unit)
+func otlpAttributes(m protocol.Metric) []label {
+	attributes := make([]label, 0, len(m.TagList()))
+	for _, tag := range m.TagList() {
+		if tag.Key == "host" || tag.Key == "uom" {
+			continue
+		}
+		attributes = append(attributes, label{name: tag.Key, value: tag.Value})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].name < attributes[j].name })
+	return attributes
+}
+
+// encodeExportRequest encodes the data points as ExportMetricsServiceRequest protobuf message, with one
+// ResourceMetrics per host and one Metric per name and unit; the order of the points is kept
+func encodeExportRequest(points []otlpPoint) []byte {
+	type metricKey struct{ name, unit string }
+	var hosts []string
+	metricsByHost := map[string][]metricKey{}
+	pointsByMetric := map[string]map[metricKey][]otlpPoint{}
+	for _, p := range points {
+		if _, ok := pointsByMetric[p.host]; !ok {
+			hosts = append(hosts, p.host)
+			pointsByMetric[p.host] = map[metricKey][]otlpPoint{}
+		}
+		key := metricKey{p.name, p.unit}
+		if _, ok := pointsByMetric[p.host][key]; !ok {
+			metricsByHost[p.host] = append(metricsByHost[p.host], key)
+		}
+		pointsByMetric[p.host][key] = append(pointsByMetric[p.host][key], p)
+	}
+
+	var request []byte
+	for _, host := range hosts {
+		var resource []byte
+		if host != "" {
+			resource = appendKeyValue(resource, 1, "host.name", host)
+		}
+
+		var scopeMetrics []byte
+		scopeMetrics = protowire.AppendTag(scopeMetrics, 1, protowire.BytesType)
+		scopeMetrics = protowire.AppendBytes(scopeMetrics, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "ocxp-sender"))
+		for _, key := range metricsByHost[host] {
+			var gauge []byte
+			for _, p := range pointsByMetric[host][key] {
+				var dataPoint []byte
+				dataPoint = protowire.AppendTag(dataPoint, 3, protowire.Fixed64Type)
+				dataPoint = protowire.AppendFixed64(dataPoint, uint64(p.timestamp))
+				dataPoint = protowire.AppendTag(dataPoint, 4, protowire.Fixed64Type)
+				dataPoint = protowire.AppendFixed64(dataPoint, math.Float64bits(p.value))
+				for _, a := range p.attributes {
+					dataPoint = appendKeyValue(dataPoint, 7, a.name, a.value)
+				}
+				gauge = protowire.AppendTag(gauge, 1, protowire.BytesType)
+				gauge = protowire.AppendBytes(gauge, dataPoint)
+			}
+			var metric []byte
+			metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+			metric = protowire.AppendString(metric, key.name)
+			if key.unit != "" {
+				metric = protowire.AppendTag(metric, 3, protowire.BytesType)
+				metric = protowire.AppendString(metric, key.unit)
+			}
+			metric = protowire.AppendTag(metric, 5, protowire.BytesType)
+			metric = protowire.AppendBytes(metric, gauge)
+
+			scopeMetrics = protowire.AppendTag(scopeMetrics, 2, protowire.BytesType)
+			scopeMetrics = protowire.AppendBytes(scopeMetrics, metric)
+		}
+
+		var resourceMetrics []byte
+		resourceMetrics = protowire.AppendTag(resourceMetrics, 1, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, resource)
+		resourceMetrics = protowire.AppendTag(resourceMetrics, 2, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, scopeMetrics)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, resourceMetrics)
+	}
+	return request
+}
+
+// appendKeyValue appends a KeyValue attribute with a string value as field num
+func appendKeyValue(b []byte, num protowire.Number, key string, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+
+	var keyValue []byte
+	keyValue = protowire.AppendTag(keyValue, 1, protowire.BytesType)
+	keyValue = protowire.AppendString(keyValue, key)
+	keyValue = protowire.AppendTag(keyValue, 2, protowire.BytesType)
+	keyValue = protowire.AppendBytes(keyValue, anyValue)
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, keyValue)
+}
+
+// export sends one request; the batcher retries it
+func (s *otlpSink) export(points []otlpPoint) (time.Duration, error) {
+	body := encodeExportRequest(points)
+	if s.gzip {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return -1, err
+		}
+	}
+	return s.poster.postOnce(s.exportURL, body)
+}
+
+func (s *otlpSink) Publish(batch *Batch) error {
+	points, err := s.points(batch)
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	return s.batcher.add(points...)
+}
+
+// PublishAsync queues the data points of the batch for the next flush and returns without waiting for it
+func (s *otlpSink) PublishAsync(batch *Batch, done func(error)) error {
+	points, err := s.points(batch)
+	if err != nil {
+		return err
+	}
+	return s.batcher.enqueue(done, points...)
+}
+
+// Flush exports the pending data points without waiting for the flush interval
+func (s *otlpSink) Flush() error {
+	return s.batcher.flushNow()
+}
+
+func (s *otlpSink) Health() error {
+	if s.batcher.isClosed() {
+		return errors.New("OTLP sink is closed")
+	}
+	return s.poster.probe(s.exportURL)
+}
+
+func (s *otlpSink) Close() error {
+	s.batcher.close()
+	s.poster.close()
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a decoded protobuf field; bytes holds length-delimited values, number fixed and varint values
+type protoField struct {
+	num    protowire.Number
+	bytes  []byte
+	number uint64
+}
+
+func decodeProto(t *testing.T, b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		field := protoField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			field.number, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			field.number, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		require.True(t, n > 0)
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// fakeOTLPCollector decodes export requests into one "resource | name [unit] {attributes} value@timestamp" string per
+// data point
+type fakeOTLPCollector struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests []*http.Request
+	points   []string
+}
+
+func (f *fakeOTLPCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(strings.NewReader(string(body)))
+		require.Nil(f.t, err)
+		body, _ = ioutil.ReadAll(reader)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	for _, resourceMetrics := range decodeProto(f.t, body) {
+		var resource string
+		for _, field := range decodeProto(f.t, resourceMetrics.bytes) {
+			switch field.num {
+			case 1:
+				resource = strings.Join(f.attributes(field.bytes, 1), ",")
+			case 2:
+				for _, scopeField := range decodeProto(f.t, field.bytes) {
+					if scopeField.num == 2 {
+						f.metric(resource, scopeField.bytes)
+					}
+				}
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeOTLPCollector) metric(resource string, metric []byte) {
+	var name, unit string
+	var dataPoints [][]byte
+	for _, field := range decodeProto(f.t, metric) {
+		switch field.num {
+		case 1:
+			name = string(field.bytes)
+		case 3:
+			unit = string(field.bytes)
+		case 5:
+			for _, gaugeField := range decodeProto(f.t, field.bytes) {
+				dataPoints = append(dataPoints, gaugeField.bytes)
+			}
+		}
+	}
+	for _, dataPoint := range dataPoints {
+		var value float64
+		var timestamp uint64
+		for _, field := range decodeProto(f.t, dataPoint) {
+			switch field.num {
+			case 3:
+				timestamp = field.number
+			case 4:
+				value = math.Float64frombits(field.number)
+			}
+		}
+		f.points = append(f.points, resource+" | "+name+" ["+unit+"] {"+strings.Join(f.attributes(dataPoint, 7), ",")+"} "+
+			strconv.FormatFloat(value, 'g', -1, 64)+"@"+strconv.FormatUint(timestamp, 10))
+	}
+}
+
+// attributes decodes the KeyValue fields num of a message as key=value strings
+func (f *fakeOTLPCollector) attributes(message []byte, num protowire.Number) []string {
+	var attributes []string
+	for _, field := range decodeProto(f.t, message) {
+		if field.num != num {
+			continue
+		}
+		keyValue := decodeProto(f.t, field.bytes)
+		attributes = append(attributes, string(keyValue[0].bytes)+"="+string(decodeProto(f.t, keyValue[1].bytes)[0].bytes))
+	}
+	return attributes
+}
+
+// states counts the received state data points, i.e. the delivered batches, as the sink merges batches into requests
+func (f *fakeOTLPCollector) states() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, point := range f.points {
+		if strings.Contains(point, " | naemon.state ") {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestOTLPSink(t *testing.T, server *httptest.Server, pathAndQuery string) Sink {
+	s, err := newSink(strings.Replace(server.URL, "http://", "otlp://", 1) + pathAndQuery)
+	require.Nil(t, err)
+	return s
+}
+
+func TestOTLPSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		fake := &fakeOTLPCollector{t: t}
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+		return &sinkUnderTest{
+			sink:        newTestOTLPSink(t, server, "?flush_interval=10ms"),
+			delivered:   fake.states,
+			stopBackend: server.Close,
+		}
+	})
+}
+
+func TestOTLPSinkMapping(t *testing.T) {
+	fake := &fakeOTLPCollector{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestOTLPSink(t, server, "?flush_interval=10ms&gzip=true&headers=Authorization=Bearer%20secret,X-Scope-OrgID=naemon")
+	defer s.Close()
+
+	data := "metric,host=abc.com,label=/boot,service=disk\\ usage,uom=MB,my-var=x value=68,warn=88,max=98 1635735600000000000\n" +
+		"metric,host=abc.com,label=/,service=disk\\ usage,uom=MB,my-var=x value=2643 1635735600000000000\n" +
+		"state,host=abc.com,service=disk\\ usage,my-var=x value=1i,output=\"WARNING\" 1635735600000000000\n"
+	require.Nil(t, s.Publish(&Batch{Data: []byte(data)}))
+
+	require.Len(t, fake.requests, 1)
+	r := fake.requests[0]
+	assert.Equal(t, "/v1/metrics", r.URL.Path)
+	assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+	assert.Equal(t, "naemon", r.Header.Get("X-Scope-OrgID"))
+	assert.Equal(t, []string{
+		"host.name=abc.com | naemon.disk_usage./boot [MBy] {label=/boot,my-var=x,service=disk usage} 68@1635735600000000000",
+		"host.name=abc.com | naemon.disk_usage./boot.warn [MBy] {label=/boot,my-var=x,service=disk usage} 88@1635735600000000000",
+		"host.name=abc.com | naemon.disk_usage./boot.max [MBy] {label=/boot,my-var=x,service=disk usage} 98@1635735600000000000",
+		"host.name=abc.com | naemon.disk_usage./ [MBy] {label=/,my-var=x,service=disk usage} 2643@1635735600000000000",
+		"host.name=abc.com | naemon.state [] {my-var=x,service=disk usage} 1@1635735600000000000",
+	}, fake.points)
+}
+
+func TestOTLPSinkGroupsByHostAndMetric(t *testing.T) {
+	fake := &fakeOTLPCollector{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := newTestOTLPSink(t, server, "/otlp/v1/metrics?flush_interval=1h&max_points=4")
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for _, host := range []string{"a", "b", "a", "b"} {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=" + host + ",service=ping value=0i 1\n")}))
+		}(host)
+	}
+	wg.Wait()
+
+	require.Len(t, fake.requests, 1)
+	assert.Equal(t, "/otlp/v1/metrics", fake.requests[0].URL.Path)
+	assert.Len(t, fake.points, 4)
+	// the points of a host follow each other, as they are sent as one ResourceMetrics
+	assert.Equal(t, strings.Split(fake.points[0], " ")[0], strings.Split(fake.points[1], " ")[0])
+	assert.Equal(t, strings.Split(fake.points[2], " ")[0], strings.Split(fake.points[3], " ")[0])
+}
+
+func TestOTLPSinkInvalidHeaders(t *testing.T) {
+	_, err := newSink("otlp://localhost:4318?headers=nonsense")
+	assert.NotNil(t, err)
+}
+
+func TestOTLPUnit(t *testing.T) {
+	assert.Equal(t, "By", otlpUnit("B"))
+	assert.Equal(t, "1", otlpUnit("c"))
+	assert.Equal(t, "ms", otlpUnit("ms"))
+	assert.Equal(t, "%", otlpUnit("%"))
+	assert.Equal(t, "", otlpUnit(""))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	protocol "github.com/influxdata/line-protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	registerSink(newPrometheusSink, "prometheus", "prometheuss")
+}
+
+// prometheusSink pushes the data to Prometheus (or Mimir, VictoriaMetrics, ...) using the remote write protocol.
+// The daemon collects the series of many batches and sends them in one request.
+//
+// Every "metric" line becomes a series named after the name template, its warn, crit, min and max fields become
+// sibling series with the suffixes _warn, _crit, _min and _max. The "state" line becomes a gauge named state_name.
+// All tags become labels, with their names sanitized to valid Prometheus label names.
+//
+// URL format: prometheus[s]://[user:password@]host:port/path?options (prometheuss uses HTTPS, the path defaults to
+// /api/v1/write)
+//
+// options:
+//
+//	name            name template of the perfdata series; {measurement} and {<tag>} are replaced by the values of
+//	                the line (default "naemon_{service}_{label}")
+//	state_name      name of the state series (default "naemon_state")
+//	token           bearer token
+//	max_samples     maximum number of samples per request (default 500)
+//	flush_interval  how long samples are collected before a request is sent (default 1s)
+//	timeout, max_retries, retry_interval  see httpPoster
+type prometheusSink struct {
+	poster    *httpPoster
+	writeURL  string
+	name      string
+	stateName string
+	batcher   *batcher[timeSeries]
+}
+
+func newPrometheusSink(u *url.URL) (Sink, error) {
+	options := newSinkOptions(u)
+	s := &prometheusSink{
+		poster:    newHTTPPoster(options, 3),
+		name:      options.String("name", "naemon_{service}_{label}"),
+		stateName: options.String("state_name", "naemon_state"),
+	}
+	s.batcher = newBatcher(options.Int("max_samples", 500), options.Duration("flush_interval", time.Second), s.write, s.poster.retryWait)
+
+	write := url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "prometheuss" {
+		write.Scheme = "https"
+	}
+	if write.Path == "" {
+		write.Path = "/api/v1/write"
+	}
+	s.writeURL = write.String()
+
+	s.poster.header.Set("Content-Type", "application/x-protobuf")
+	s.poster.header.Set("Content-Encoding", "snappy")
+	s.poster.header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	s.poster.header.Set("User-Agent", "ocxp-sender")
+	if token := options.String("token", ""); token != "" {
+		s.poster.header.Set("Authorization", "Bearer "+token)
+	} else if u.User != nil {
+		password, _ := u.User.Password()
+		s.poster.header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password)))
+	}
+	if err := options.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// timeSeries is a single sample of a series
+type timeSeries struct {
+	labels    []label // sorted by name, including __name__
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+var regexInvalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+var regexInvalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeMetricName turns a string into a valid Prometheus metric name
+func sanitizeMetricName(name string) string {
+	name = regexInvalidMetricNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// sanitizeMetricNamePart replaces invalid characters in a value that becomes part of a metric name
+func sanitizeMetricNamePart(value string) string {
+	return regexInvalidMetricNameChars.ReplaceAllString(value, "_")
+}
+
+// sanitizeLabelName turns a string into a valid Prometheus label name
+func sanitizeLabelName(name string) string {
+	name = regexInvalidLabelNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// series maps the lines of a batch to samples
+func (s *prometheusSink) series(batch *Batch) ([]timeSeries, error) {
+	metrics, err := batch.Metrics()
+	if err != nil {
+		return nil, err
+	}
+	var series []timeSeries
+	for _, m := range metrics {
+		var name string
+		switch m.Name() {
+		case "metric":
+			name = sanitizeMetricName(renderTemplate(s.name, m, sanitizeMetricNamePart))
+		case "state":
+			name = sanitizeMetricName(s.stateName)
+		default:
+			name = sanitizeMetricName(m.Name())
+		}
+		labels := seriesLabels(m)
+		for _, field := range m.FieldList() {
+			value, ok := numericValue(field.Value)
+			if !ok {
+				continue // e.g. the output of the state
+			}
+			seriesName := name
+			if field.Key != "value" {
+				seriesName += "_" + sanitizeMetricName(field.Key)
+			}
+			series = append(series, timeSeries{
+				labels:    withName(labels, seriesName),
+				value:     value,
+				timestamp: m.Time().UnixNano() / int64(time.Millisecond),
+			})
+		}
+	}
+	return series, nil
+}
+
+// seriesLabels returns the tags of a line as labels sorted by name; if sanitizing makes names collide, the first one
+// wins
+func seriesLabels(m protocol.Metric) []label {
+	labels := make([]label, 0, len(m.TagList()))
+	seen := map[string]bool{}
+	for _, tag := range m.TagList() {
+		name := sanitizeLabelName(tag.Key)
+		if seen[name] || name == "__name__" {
+			continue
+		}
+		seen[name] = true
+		labels = append(labels, label{name: name, value: tag.Value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// withName returns a copy of the sorted labels with the __name__ label added, which sorts first
+func withName(labels []label, name string) []label {
+	return append([]label{{name: "__name__", value: name}}, labels...)
+}
+
+func numericValue(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// encodeWriteRequest encodes the samples as prometheus.WriteRequest protobuf message
+func encodeWriteRequest(series []timeSeries) []byte {
+	var request []byte
+	for _, ts := range series {
+		var encoded []byte
+		for _, l := range ts.labels {
+			var labelBytes []byte
+			labelBytes = protowire.AppendTag(labelBytes, 1, protowire.BytesType)
+			labelBytes = protowire.AppendString(labelBytes, l.name)
+			labelBytes = protowire.AppendTag(labelBytes, 2, protowire.BytesType)
+			labelBytes = protowire.AppendString(labelBytes, l.value)
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendBytes(encoded, labelBytes)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(ts.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts.timestamp))
+		encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encoded)
+	}
+	return request
+}
+
+// write sends one request; the batcher retries it
+func (s *prometheusSink) write(series []timeSeries) (time.Duration, error) {
+	return s.poster.postOnce(s.writeURL, snappy.Encode(nil, encodeWriteRequest(series)))
+}
+
+func (s *prometheusSink) Publish(batch *Batch) error {
+	series, err := s.series(batch)
+	if err != nil {
+		return err
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	return s.batcher.add(series...)
+}
+
+// PublishAsync queues the samples of the batch for the next flush and returns without waiting for it
+func (s *prometheusSink) PublishAsync(batch *Batch, done func(error)) error {
+	series, err := s.series(batch)
+	if err != nil {
+		return err
+	}
+	return s.batcher.enqueue(done, series...)
+}
+
+// Flush sends the pending samples without waiting for the flush interval
+func (s *prometheusSink) Flush() error {
+	return s.batcher.flushNow()
+}
+
+func (s *prometheusSink) Health() error {
+	if s.batcher.isClosed() {
+		return errors.New("Prometheus sink is closed")
+	}
+	return s.poster.probe(s.writeURL)
+}
+
+func (s *prometheusSink) Close() error {
+	s.batcher.close()
+	s.poster.close()
+	return nil
+}
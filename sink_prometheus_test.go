@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeRemoteWriteReceiver decodes remote write requests into one "name{label=value,...} value@timestamp" string per
+// sample
+type fakeRemoteWriteReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests int
+	samples  []string
+}
+
+func (f *fakeRemoteWriteReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	assert.Equal(f.t, "snappy", r.Header.Get("Content-Encoding"))
+	assert.Equal(f.t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	assert.Equal(f.t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+	compressed, _ := ioutil.ReadAll(r.Body)
+	body, err := snappy.Decode(nil, compressed)
+	require.Nil(f.t, err)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	forEachField(f.t, body, func(num protowire.Number, timeSeries []byte) {
+		var name string
+		var labels []string
+		var sample string
+		forEachField(f.t, timeSeries, func(num protowire.Number, b []byte) {
+			switch num {
+			case 1: // label
+				var l [2]string
+				forEachField(f.t, b, func(num protowire.Number, v []byte) { l[num-1] = string(v) })
+				if l[0] == "__name__" {
+					name = l[1]
+				} else {
+					labels = append(labels, l[0]+"="+l[1])
+				}
+			case 2: // sample
+				value, n := protowire.ConsumeFixed64(b[1:])
+				timestamp, _ := protowire.ConsumeVarint(b[1+n+1:])
+				sample = strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64) + "@" + strconv.FormatInt(int64(timestamp), 10)
+			}
+		})
+		f.samples = append(f.samples, name+"{"+strings.Join(labels, ",")+"} "+sample)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forEachField calls fn with the payload of every length-delimited field of a protobuf message
+func forEachField(t *testing.T, b []byte, fn func(num protowire.Number, v []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		require.Equal(t, protowire.BytesType, typ)
+		v, n := protowire.ConsumeBytes(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		fn(num, v)
+	}
+}
+
+func (f *fakeRemoteWriteReceiver) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// states counts the received state samples, i.e. the delivered batches, as the sink merges batches into requests
+func (f *fakeRemoteWriteReceiver) states() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, sample := range f.samples {
+		if strings.HasPrefix(sample, "naemon_state{") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPrometheusSinkConformance(t *testing.T) {
+	testSinkConformance(t, func(t *testing.T) *sinkUnderTest {
+		fake := &fakeRemoteWriteReceiver{t: t}
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+		s, err := newSink(strings.Replace(server.URL, "http://", "prometheus://", 1) + "?flush_interval=10ms")
+		require.Nil(t, err)
+		return &sinkUnderTest{
+			sink:        s,
+			delivered:   fake.states,
+			stopBackend: server.Close,
+		}
+	})
+}
+
+func TestPrometheusSinkMapping(t *testing.T) {
+	fake := &fakeRemoteWriteReceiver{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s, err := newSink(strings.Replace(server.URL, "http://", "prometheus://", 1) + "/push?flush_interval=10ms")
+	require.Nil(t, err)
+	defer s.Close()
+
+	data := "metric,host=abc.com,label=/boot,service=disk\\ usage,uom=MB,my-var=x value=68,warn=88,crit=93,min=0,max=98 1635735600000000000\n" +
+		"state,host=abc.com,service=disk\\ usage,my-var=x value=1i,output=\"WARNING\" 1635735600000000000\n"
+	require.Nil(t, s.Publish(&Batch{Data: []byte(data)}))
+
+	labels := "{host=abc.com,label=/boot,my_var=x,service=disk usage,uom=MB}"
+	assert.Equal(t, []string{
+		"naemon_disk_usage__boot" + labels + " 68@1635735600000",
+		"naemon_disk_usage__boot_warn" + labels + " 88@1635735600000",
+		"naemon_disk_usage__boot_crit" + labels + " 93@1635735600000",
+		"naemon_disk_usage__boot_min" + labels + " 0@1635735600000",
+		"naemon_disk_usage__boot_max" + labels + " 98@1635735600000",
+		"naemon_state{host=abc.com,my_var=x,service=disk usage} 1@1635735600000",
+	}, fake.samples)
+}
+
+func TestPrometheusSinkBatchesInDaemon(t *testing.T) {
+	fake := &fakeRemoteWriteReceiver{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s, err := newSink(strings.Replace(server.URL, "http://", "prometheus://", 1) + "?flush_interval=1h&max_samples=10")
+	require.Nil(t, err)
+	defer s.Close()
+
+	// ten batches with one sample each fill exactly one request
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fake.count())
+	assert.Len(t, fake.samples, 10)
+}
+
+func TestPrometheusSinkFlush(t *testing.T) {
+	fake := &fakeRemoteWriteReceiver{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s, err := newSink(strings.Replace(server.URL, "http://", "prometheus://", 1) + "?flush_interval=1h")
+	require.Nil(t, err)
+	defer s.Close()
+
+	// nothing to flush
+	require.Nil(t, s.(Flusher).Flush())
+	published := make(chan error)
+	go func() { published <- s.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}) }()
+	batcher := s.(*prometheusSink).batcher
+	assert.Eventually(t, func() bool {
+		batcher.mu.Lock()
+		defer batcher.mu.Unlock()
+		return len(batcher.pending) == 1
+	}, time.Second, time.Millisecond)
+
+	// the flush returns once the sample was sent
+	require.Nil(t, s.(Flusher).Flush())
+	assert.Equal(t, 1, fake.count())
+	assert.Nil(t, <-published)
+}
+
+func TestFanOutFlushWaitsForBufferedData(t *testing.T) {
+	fake := &fakeRemoteWriteReceiver{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	f, err := newFanOut([]string{strings.Replace(server.URL, "http://", "prometheus://", 1) + "?flush_interval=1h"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, f.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+	}
+	require.Nil(t, f.Flush(time.Second))
+	assert.Equal(t, 3, fake.states())
+}
+
+func TestFanOutDeliversManyBatchesPerFlushInterval(t *testing.T) {
+	fake := &fakeRemoteWriteReceiver{t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	f, err := newFanOut([]string{strings.Replace(server.URL, "http://", "prometheus://", 1) + "?flush_interval=200ms"}, &config{}, nil)
+	require.Nil(t, err)
+	defer f.Close()
+
+	// the queue's worker hands the batches over without waiting for the flush, so they share the first request
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		require.Nil(t, f.Publish(&Batch{Data: []byte("state,host=abc.com,service=ping value=0i 1\n")}))
+	}
+	assert.Eventually(t, func() bool { return f.Status()[0].Delivered == 10 }, time.Second, time.Millisecond)
+	assert.Less(t, time.Since(start), 600*time.Millisecond)
+	assert.Equal(t, 10, fake.states())
+	assert.LessOrEqual(t, fake.count(), 2)
+}
+
+func TestSanitizeNames(t *testing.T) {
+	assert.Equal(t, "naemon_disk__", sanitizeMetricName("naemon_disk-/"))
+	assert.Equal(t, "_1min", sanitizeMetricName("1min"))
+	assert.Equal(t, "a:b", sanitizeMetricName("a:b"))
+	assert.Equal(t, "a_b", sanitizeLabelName("a:b"))
+	assert.Equal(t, "_0x", sanitizeLabelName("0x"))
+}
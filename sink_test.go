@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sinkUnderTest bundles a sink with the stand-in backend it delivers to
+type sinkUnderTest struct {
+	sink Sink
+	// delivered returns the number of messages the backend has received so far
+	delivered func() int
+	// stopBackend makes the backend unavailable; optional
+	stopBackend func()
+}
+
+// testSinkConformance is the conformance suite every Sink implementation has to pass. setup is called once per
+// sub-test and has to return a fresh sink connected to a fresh backend.
+func testSinkConformance(t *testing.T, setup func(t *testing.T) *sinkUnderTest) {
+	batch := func(t *testing.T) *Batch {
+		b, err := parse("host", "service", 1, "WARNING", variableFlags{"a=xyz"}, "/=2643MB;5948;5958;0;5968 /boot=68MB;88;93;0;98", time.Date(2021, time.November, 1, 3, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		return &Batch{Data: b.Bytes()}
+	}
+
+	t.Run("Publish", func(t *testing.T) {
+		s := setup(t)
+		defer s.sink.Close()
+
+		assert.Nil(t, s.sink.Publish(batch(t)))
+		assert.Eventually(t, func() bool { return s.delivered() >= 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("ConcurrentPublish", func(t *testing.T) {
+		s := setup(t)
+		defer s.sink.Close()
+
+		const n = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- s.sink.Publish(batch(t))
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.Nil(t, err)
+		}
+		assert.Eventually(t, func() bool { return s.delivered() >= n }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		s := setup(t)
+		defer s.sink.Close()
+
+		assert.Nil(t, s.sink.Health())
+		if s.stopBackend == nil {
+			t.Skip("sink under test cannot stop its backend")
+		}
+		s.stopBackend()
+		assert.Eventually(t, func() bool { return s.sink.Health() != nil }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("PublishAfterClose", func(t *testing.T) {
+		s := setup(t)
+
+		assert.Nil(t, s.sink.Close())
+		assert.NotNil(t, s.sink.Publish(batch(t)))
+	})
+}
+
+func TestNewSinkUnsupportedScheme(t *testing.T) {
+	_, err := newSink("carrier-pigeon://localhost")
+	assert.NotNil(t, err)
+}
+
+func TestLazySink(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	backend := &controlledSink{}
+	s := &lazySink{alias: "lazy", factory: func(u *url.URL) (Sink, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return backend, nil
+	}}
+	assert.EqualError(t, s.Health(), "connecting")
+
+	// every publish tries to connect again
+	assert.EqualError(t, s.Publish(&Batch{Data: []byte("a")}), "connection refused")
+	assert.EqualError(t, s.Health(), "not connected: connection refused")
+	assert.False(t, s.connected())
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	assert.Nil(t, s.Publish(&Batch{Data: []byte("b")}))
+	assert.True(t, s.connected())
+	assert.Nil(t, s.Health())
+	assert.Nil(t, s.Close())
+	assert.Equal(t, []string{"b"}, backend.published)
+	assert.True(t, backend.closed)
+
+	_, err := newLazySink("lazy", "carrier-pigeon://localhost")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// spawnOptions are the settings of a client for spawning the daemon
+type spawnOptions struct {
+	// args are the arguments of the daemon, after the binary
+	args []string
+	// logPath is the log file of the daemon (--log-file), which also gets its output; syslog or empty if there is none
+	logPath string
+	// lockPath is locked while a client spawns the daemon, so that only one of them does
+	lockPath string
+	// timeout is how long the client waits for the daemon
+	timeout time.Duration
+}
+
+// defaultSpawnLockPath is the lock file of the clients spawning the daemon
+var defaultSpawnLockPath = filepath.Join(os.TempDir(), "ocxp-sender.spawn.lock")
+
+// deliverToDaemon hands the data over to the daemon listening on the address; if there is none, it spawns the daemon
+// and waits until it accepts the data, at most for the timeout of the options. Once data has been written, it is not
+// sent again (see errPartiallySent).
+func deliverToDaemon(address string, data []byte, options spawnOptions) error {
+	err := sendToDaemon(address, data)
+	if err == nil || errors.Is(err, errPartiallySent) {
+		return err
+	}
+	logger.Info("Trying to spawn daemon")
+	deadline := time.Now().Add(options.timeout)
+
+	// wait until this client may spawn the daemon, or another one has spawned it
+	var lock *os.File
+	for backoff := newSpawnBackoff(); ; {
+		if err = sendToDaemon(address, data); err == nil || errors.Is(err, errPartiallySent) {
+			return err
+		}
+		lock, err = tryLock(options.lockPath)
+		if err != nil {
+			return err
+		}
+		if lock != nil {
+			break
+		}
+		if !backoff.wait(deadline) {
+			return fmt.Errorf("another client is spawning the daemon, which did not start within %v", options.timeout)
+		}
+	}
+	defer lock.Close()
+
+	// the daemon may have become ready right before the lock was released
+	if err = sendToDaemon(address, data); err == nil || errors.Is(err, errPartiallySent) {
+		return err
+	}
+	spawnErr := spawnDaemon(options, deadline)
+	if spawnErr != nil {
+		// maybe another process has taken the port meanwhile, e.g. a daemon started by systemd
+		logger.Warn("Failed to spawn daemon", "error", spawnErr)
+	}
+	for backoff := newSpawnBackoff(); ; {
+		if err = sendToDaemon(address, data); err == nil || errors.Is(err, errPartiallySent) {
+			return err
+		}
+		if !backoff.wait(deadline) {
+			break
+		}
+	}
+	if spawnErr != nil {
+		return spawnErr
+	}
+	return err
+}
+
+// errPartiallySent is wrapped by the errors of sendToDaemon once data has been written: the daemon may have received
+// some of it, so the data is neither sent again nor handed to a fallback, which would deliver that part twice
+var errPartiallySent = errors.New("the daemon may have received part of the data")
+
+// sendToDaemon writes the data to the daemon
+func sendToDaemon(address string, data []byte) error {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	n, err := conn.Write(data)
+	if err == nil {
+		err = conn.Close()
+	}
+	if err != nil && n > 0 {
+		return fmt.Errorf("%w (%d of %d bytes written): %v", errPartiallySent, n, len(data), err)
+	}
+	return err
+}
+
+// tryLock takes the lock on the file without waiting; it returns nil if another process holds it. Closing the file
+// releases the lock.
+func tryLock(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lock %v: %w", path, err)
+	}
+	return file, nil
+}
+
+// spawnDaemon starts the daemon as a process of its own and waits until it reports that it accepts data. The daemon
+// gets the write end of a pipe as file descriptor 3 (--ready-fd), on which it writes "ready" and which it closes; if it
+// exits before, the pipe is closed without it.
+func spawnDaemon(options spawnOptions, deadline time.Time) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to lookup binary: %w", err)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	// the output of the daemon, e.g. a panic, goes to its log file
+	logFile, logHint := devNull, "the log of the daemon"
+	if options.logPath != "" && options.logPath != "syslog" {
+		if logFile, err = os.OpenFile(options.logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		defer logFile.Close()
+		logHint = options.logPath
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	args := append([]string{binary}, options.args...)
+	args = append(args, "--ready-fd", "3")
+	process, err := os.StartProcess(binary, args, &os.ProcAttr{
+		Files: []*os.File{devNull, logFile, logFile, readyWriter},
+		// the daemon must not get the signals meant for the process group of the client
+		Sys: &syscall.SysProcAttr{Setsid: true},
+	})
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	// the daemon outlives the client, nobody waits for it
+	process.Release()
+
+	readyReader.SetReadDeadline(deadline)
+	line, err := bufio.NewReader(readyReader).ReadString('\n')
+	switch {
+	case strings.TrimSpace(line) == "ready":
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("daemon did not get ready in time, see %v", logHint)
+	default:
+		return fmt.Errorf("daemon exited before it got ready, see %v", logHint)
+	}
+}
+
+// signalReady tells the client that spawned the daemon that it accepts data, see spawnDaemon
+func signalReady(fd int) {
+	if fd <= 0 {
+		return
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	if _, err := fmt.Fprintln(file, "ready"); err != nil {
+		logger.Warn("Failed to signal readiness", "error", err)
+	}
+}
+
+// spawnBackoff is the wait of a client between attempts to reach the daemon
+type spawnBackoff struct {
+	next time.Duration
+}
+
+func newSpawnBackoff() *spawnBackoff {
+	return &spawnBackoff{next: 10 * time.Millisecond}
+}
+
+// wait waits before the next attempt; it returns false if the deadline has passed
+func (b *spawnBackoff) wait(deadline time.Time) bool {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
+	}
+	time.Sleep(min(b.next, remaining))
+	b.next = min(2*b.next, 500*time.Millisecond)
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSpawnedDaemonHelper is the daemon spawned by TestDeliverToDaemonSpawns: the test binary started again, which
+// receives one batch and writes it to a file
+func TestSpawnedDaemonHelper(t *testing.T) {
+	address := os.Getenv("OCXP_SPAWN_TEST_ADDRESS")
+	if address == "" {
+		t.Skip("only run as spawned daemon")
+	}
+	if os.Getenv("OCXP_SPAWN_TEST_FAIL") != "" {
+		os.Exit(1)
+	}
+	// the slow start of a daemon, e.g. connecting to the broker
+	time.Sleep(200 * time.Millisecond)
+	listener, err := net.Listen("tcp", address)
+	require.Nil(t, err)
+	signalReady(3)
+	conn, err := listener.Accept()
+	require.Nil(t, err)
+	data, err := io.ReadAll(conn)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(os.Getenv("OCXP_SPAWN_TEST_OUTPUT"), data, 0644))
+}
+
+func spawnTestOptions(t *testing.T) (string, spawnOptions) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+	dir := t.TempDir()
+	t.Setenv("OCXP_SPAWN_TEST_ADDRESS", address)
+	t.Setenv("OCXP_SPAWN_TEST_OUTPUT", filepath.Join(dir, "received"))
+	return address, spawnOptions{
+		// the arguments appended by spawnDaemon must not reach the flags of the test binary
+		args:     []string{"-test.run=^TestSpawnedDaemonHelper$", "--"},
+		logPath:  filepath.Join(dir, "daemon.log"),
+		lockPath: filepath.Join(dir, "spawn.lock"),
+		timeout:  10 * time.Second,
+	}
+}
+
+func TestDeliverToDaemonSpawns(t *testing.T) {
+	address, options := spawnTestOptions(t)
+
+	require.Nil(t, deliverToDaemon(address, []byte("state,host=h value=0i 1\n"), options))
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(os.Getenv("OCXP_SPAWN_TEST_OUTPUT"))
+		return string(data) == "state,host=h value=0i 1\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDeliverToDaemonSpawnFails(t *testing.T) {
+	address, options := spawnTestOptions(t)
+	t.Setenv("OCXP_SPAWN_TEST_FAIL", "1")
+	options.timeout = time.Second
+
+	err := deliverToDaemon(address, []byte("state,host=h value=0i 1\n"), options)
+	assert.EqualError(t, err, "daemon exited before it got ready, see "+options.logPath)
+}
+
+func TestDeliverToDaemonWaitsForOtherSpawner(t *testing.T) {
+	address, options := spawnTestOptions(t)
+	options.timeout = 200 * time.Millisecond
+
+	// another client holds the lock, but its daemon does not start
+	lock, err := tryLock(options.lockPath)
+	require.Nil(t, err)
+	require.NotNil(t, lock)
+	other, err := tryLock(options.lockPath)
+	require.Nil(t, err)
+	assert.Nil(t, other)
+
+	err = deliverToDaemon(address, []byte("state,host=h value=0i 1\n"), options)
+	assert.EqualError(t, err, "another client is spawning the daemon, which did not start within 200ms")
+
+	// the daemon of the other client starts
+	listener, err := net.Listen("tcp", address)
+	require.Nil(t, err)
+	defer listener.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			data, _ := io.ReadAll(conn)
+			received <- string(data)
+		}
+	}()
+	options.timeout = time.Second
+	require.Nil(t, deliverToDaemon(address, []byte("state,host=h value=0i 1\n"), options))
+	assert.Equal(t, "state,host=h value=0i 1\n", <-received)
+	lock.Close()
+}
+
+func TestSendToDaemonPartially(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// the daemon dies after it has read some of the data
+		conn.Read(make([]byte, 1))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+
+	err = sendToDaemon(listener.Addr().String(), make([]byte, 64<<20))
+	assert.ErrorIs(t, err, errPartiallySent)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool keeps batches on disk that the daemon could not deliver before it stopped, so that they are delivered when it
+// starts again. Every sink has its own directory (<dir>/sinks/<alias>), because the batches have already passed the
+// pipeline and must only go to the sink they were queued for. Each batch is a file of line protocol; a routing key is
+// stored in a leading comment line.
+//
+// <dir>/incoming is the drop directory of the clients: they write the data there if the daemon is unavailable (see
+// fallBack), and the daemon passes it through the pipeline like the data of any other client.
+type spool struct {
+	dir string
+
+	mu       sync.Mutex
+	sequence int
+}
+
+const spoolRoutingKeyPrefix = "# routing_key "
+
+func openSpool(dir string) (*spool, error) {
+	for _, sub := range []string{"sinks", "incoming"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &spool{dir: dir}, nil
+}
+
+func (s *spool) sinkDir(alias string) string {
+	return filepath.Join(s.dir, "sinks", url.QueryEscape(alias))
+}
+
+func (s *spool) incomingDir() string {
+	return filepath.Join(s.dir, "incoming")
+}
+
+// write stores a batch for the sink
+func (s *spool) write(alias string, batch *Batch) error {
+	return s.writeTo(s.sinkDir(alias), batch)
+}
+
+// drop stores the data of a client for the daemon
+func (s *spool) drop(data []byte) error {
+	return s.writeTo(s.incomingDir(), &Batch{Data: data})
+}
+
+// writeTo stores a batch in the directory; the file appears atomically, so a reader never sees it half-written. The
+// name starts with the time, and contains the process ID to be unique across clients.
+func (s *spool) writeTo(dir string, batch *Batch) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sequence++
+	name := fmt.Sprintf("%020d-%d-%06d.lp", time.Now().UnixNano(), os.Getpid(), s.sequence)
+	s.mu.Unlock()
+
+	var b bytes.Buffer
+	if batch.RoutingKey != "" {
+		b.WriteString(spoolRoutingKeyPrefix + batch.RoutingKey + "\n")
+	}
+	b.Write(batch.Data)
+	tmp := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// take removes up to max batches of the sink from the spool and returns them, oldest first; the others stay in the
+// spool for a later take
+func (s *spool) take(alias string, max int) ([]*Batch, error) {
+	return s.takeFrom(s.sinkDir(alias), max)
+}
+
+// takeDropped removes up to max batches of the data dropped by clients from the spool and returns them, oldest first;
+// the others stay in the spool for a later take
+func (s *spool) takeDropped(max int) ([]*Batch, error) {
+	return s.takeFrom(s.incomingDir(), max)
+}
+
+func (s *spool) takeFrom(dir string, max int) ([]*Batch, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	names, err := spooledNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > max {
+		names = names[:max]
+	}
+
+	var batches []*Batch
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return batches, err
+		}
+		batch := &Batch{Data: data}
+		if strings.HasPrefix(string(data), spoolRoutingKeyPrefix) {
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line, batch.Data = data[:i], data[i+1:]
+			}
+			batch.RoutingKey = strings.TrimPrefix(string(line), spoolRoutingKeyPrefix)
+		}
+		batches = append(batches, batch)
+		if err := os.Remove(path); err != nil {
+			return batches, err
+		}
+	}
+	return batches, nil
+}
+
+// spooledNames returns the names of the batch files in the directory, oldest first; files that are still being
+// written are left out
+func spooledNames(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".lp") && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// depth returns the number of batches in the spool, those of all sinks and those dropped by clients
+func (s *spool) depth() (int, error) {
+	sinks, err := ioutil.ReadDir(filepath.Join(s.dir, "sinks"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	dirs := []string{s.incomingDir()}
+	for _, sink := range sinks {
+		if sink.IsDir() {
+			dirs = append(dirs, filepath.Join(s.dir, "sinks", sink.Name()))
+		}
+	}
+	depth := 0
+	for _, dir := range dirs {
+		names, err := spooledNames(dir)
+		if err != nil {
+			return depth, err
+		}
+		depth += len(names)
+	}
+	return depth, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	s, err := openSpool(t.TempDir())
+	require.Nil(t, err)
+	require.Nil(t, s.write("amqp://localhost:5672", &Batch{Data: []byte("state,host=a value=0i 1\n"), RoutingKey: "alerts"}))
+	require.Nil(t, s.write("amqp://localhost:5672", &Batch{Data: []byte("state,host=b value=0i 1\n")}))
+	require.Nil(t, s.write("tsdb", &Batch{Data: []byte("state,host=c value=0i 1\n")}))
+	require.Nil(t, s.drop([]byte("state,host=d value=0i 1\n")))
+	depth, err := s.depth()
+	require.Nil(t, err)
+	assert.Equal(t, 4, depth)
+
+	batches, err := s.take("amqp://localhost:5672", 1)
+	require.Nil(t, err)
+	assert.Equal(t, []*Batch{{Data: []byte("state,host=a value=0i 1\n"), RoutingKey: "alerts"}}, batches)
+	// the batches beyond the maximum stay in the spool
+	batches, err = s.take("amqp://localhost:5672", 10)
+	require.Nil(t, err)
+	assert.Equal(t, []*Batch{{Data: []byte("state,host=b value=0i 1\n")}}, batches)
+
+	// taken batches are gone
+	batches, err = s.take("amqp://localhost:5672", 10)
+	require.Nil(t, err)
+	assert.Empty(t, batches)
+	batches, err = s.take("unknown", 10)
+	require.Nil(t, err)
+	assert.Empty(t, batches)
+	depth, err = s.depth()
+	require.Nil(t, err)
+	assert.Equal(t, 2, depth)
+}
+
+func TestFanOutSpoolsAndRequeues(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir)
+	require.Nil(t, err)
+	f, err := newFanOut([]string{"test://spooling?alias=spooling&queue_retries=0"}, &config{}, nil)
+	require.Nil(t, err)
+	require.Nil(t, f.useSpool(s))
+	sink := controlledSinkFor("spooling")
+	blocked := make(chan struct{})
+	sink.set(func(s *controlledSink) { s.blocked = blocked })
+
+	// the first batch is being published when the fan-out is closed, the second one is still queued
+	require.Nil(t, f.Publish(testBatch("web1", "ping")))
+	require.Nil(t, f.Publish(testBatch("web2", "ping")))
+	closed := make(chan error)
+	go func() { closed <- f.Close() }()
+	q := f.pipeline.Load().queues[0]
+	assert.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.closing
+	}, time.Second, time.Millisecond)
+	sink.set(func(s *controlledSink) { s.failing = true })
+	close(blocked)
+	require.Nil(t, <-closed)
+	assert.Equal(t, uint64(2), f.Status()[0].Spooled)
+	assert.Equal(t, uint64(0), f.Status()[0].Failed)
+
+	// the next run delivers the spooled batches
+	f, err = newFanOut([]string{"test://spooling?alias=spooling"}, &config{}, nil)
+	require.Nil(t, err)
+	require.Nil(t, f.useSpool(s))
+	sink = controlledSinkFor("spooling")
+	require.Nil(t, f.Close())
+	status := f.Status()[0]
+	assert.Equal(t, uint64(0), status.Failed)
+	assert.Equal(t, int(status.Delivered), sink.count())
+}
+
+func TestFanOutRequeuesWhatFitsIntoTheQueue(t *testing.T) {
+	s, err := openSpool(t.TempDir())
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, s.write("requeue", testBatch("web"+strconv.Itoa(i), "ping")))
+	}
+	f, err := newFanOut([]string{"test://requeue?alias=requeue&queue_size=2"}, &config{}, nil)
+	require.Nil(t, err)
+	sink := controlledSinkFor("requeue")
+	blocked := make(chan struct{})
+	sink.set(func(s *controlledSink) { s.blocked = blocked })
+
+	require.Nil(t, f.useSpool(s))
+	spooled, err := os.ReadDir(s.sinkDir("requeue"))
+	require.Nil(t, err)
+	assert.Len(t, spooled, 3)
+	close(blocked)
+	assert.Eventually(t, func() bool { return sink.count() == 2 }, time.Second, time.Millisecond)
+
+	// the rest is taken as the queue has room again
+	assert.Eventually(t, func() bool {
+		f.takeSpooled()
+		return sink.count() == 5
+	}, time.Second, 10*time.Millisecond)
+	require.Nil(t, f.Close())
+	assert.Equal(t, uint64(0), f.Status()[0].Dropped)
+	sink.set(func(s *controlledSink) {
+		for i, published := range s.published {
+			assert.Equal(t, string(testBatch("web"+strconv.Itoa(i), "ping").Data), published)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// serveCommand implements "ocxp-sender serve": the daemon in the foreground, as a service of systemd (or any other
+// supervisor). Unlike the lazily spawned daemon (-d), it has no inactivity timeout by default and speaks the systemd
+// protocols: it notifies systemd when it is ready, reloading and stopping, pings the watchdog and takes the listening
+// socket from systemd if the service is socket activated.
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	options := daemonOptions{}
+	flags.StringVar(&options.listenAddress, "listen", DaemonAddress, "address the daemon receives the check results on; with socket activation, the socket passed by systemd is used instead")
+	flags.StringArrayVarP(&options.sinkURLs, "url", "u", []string{"amqp://localhost:5672"}, "URL of the sink to send the data to (multiple allowed)")
+	flags.StringVarP(&options.configPath, "config", "c", "", "configuration file of the daemon")
+	flags.StringVar(&options.httpAddress, "http", "", "address to serve health checks, metrics and profiling on over HTTP; disabled if empty")
+	flags.StringVar(&options.controlAddress, "control", ControlAddress, "address of the control channel; disabled if empty")
+	flags.StringVar(&options.spoolDir, "spool-dir", "", "directory for the batches that could not be delivered before the daemon stopped")
+	flags.DurationVar(&options.shutdownTimeout, "shutdown-timeout", 15*time.Second, "how long the stopping daemon waits for clients and deliveries")
+	flags.DurationVar(&options.inactivityTimeout, "inactivity-timeout", 0, "stop after receiving no data for this long; 0 disables it")
+	var logging logOptions
+	addLogFlags(flags, &logging, "", "file the daemon logs to, or syslog; stderr (e.g. the journal) if empty")
+	flags.SetNormalizeFunc(normalizeFlagName)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [flags]\n\nRuns the daemon in the foreground, e.g. as systemd service.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	closer, err := setupLogging(logging)
+	failOnError(err, "Failed to setup logging")
+	defer closer.Close()
+	runDaemon(options)
+}
+
+// sdNotify sends a state (e.g. "READY=1") to systemd, see sd_notify(3); without NOTIFY_SOCKET it does nothing
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// an abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval in which the watchdog of systemd has to be pinged (half of WatchdogSec, as
+// recommended by sd_watchdog_enabled(3)), or 0 if the watchdog is not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdListenFDsStart is the first file descriptor passed by systemd with socket activation
+const sdListenFDsStart = 3
+
+// sdListeners returns the sockets passed by systemd with socket activation, see sd_listen_fds(3). The variables are
+// removed from the environment, so that processes started by the daemon do not take the sockets for theirs.
+func sdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	var listeners []net.Listener
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listen returns the socket passed by systemd for the address, or listens on the address itself. A single passed
+// socket is used whatever its address is, so that the socket unit alone decides where the daemon listens.
+func listen(address string) (net.Listener, error) {
+	listeners, err := sdListeners()
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	var activated net.Listener
+	for _, l := range listeners {
+		if activated == nil && l.Addr().String() == address {
+			activated = l
+			continue
+		}
+		l.Close()
+	}
+	if activated != nil {
+		return activated, nil
+	}
+	if len(listeners) > 0 {
+		return nil, fmt.Errorf("none of the %d sockets passed by systemd listens on %v", len(listeners), address)
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.Nil(t, sdNotify("READY=1"))
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.Nil(t, err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	require.Nil(t, sdNotify("READY=1\nSTATUS=ok"))
+	b := make([]byte, 100)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	require.Nil(t, err)
+	assert.Equal(t, "READY=1\nSTATUS=ok", string(b[:n]))
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, sdNotify("READY=1"))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 15*time.Second, sdWatchdogInterval())
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 15*time.Second, sdWatchdogInterval())
+
+	// the watchdog is meant for another process
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+}
+
+func TestListenWithoutSocketActivation(t *testing.T) {
+	// sockets passed to another process are ignored, and the variables are removed
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listener, err := listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	assert.Equal(t, "127.0.0.1", listener.Addr().(*net.TCPAddr).IP.String())
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok)
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "many")
+	_, err = listen("127.0.0.1:0")
+	assert.NotNil(t, err)
+}